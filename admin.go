@@ -0,0 +1,220 @@
+package burstcache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+	The admin handler answers operator questions about a running cache over HTTP.
+	It tells a lot about the API behind the cache, so mount it on an internal
+	listener or behind authentication:
+
+		mux.Handle("/burstcache/", http.StripPrefix("/burstcache", cache.AdminHandler()))
+
+	GET /config			the effective configuration, see EffectiveConfig
+	DELETE /entries?key=K		remove the response cached under K, see Remove
+	DELETE /entries?pattern=P	remove the responses whose keys match P, see RemoveMatching
+	DELETE /entries?url=U		remove the response a GET of U is served from, see RemoveRequest
+	GET /resolve?url=U&method=M	the key a request for U (GET unless M) is stored under, see ResolveKey
+
+	Failures are answered with the status matching their error: 404 for ErrNotFound,
+	400 for ErrInvalidPattern and ErrKeyerRequired, 503 for ErrStoreUnavailable and ErrClosed.
+*/
+
+/*
+	EffectiveConfig describes everything that decides whether and how responses are
+	cached: the settings (including runtime changes) and the hooks and features in use.
+	It marshals to JSON, durations in nanoseconds.
+*/
+type EffectiveConfig struct {
+	CacheConfig
+
+	Incompressible  []string        // content types stored raw when compressing
+	DictionaryBytes int             // size of the compression dictionary in use, 0 for none
+	Hooks           map[string]bool // which optional hooks are set
+	Pinned          int             // number of pinned keys
+}
+
+/*
+	EffectiveConfig returns the configuration the cache is running with right now
+*/
+func (c *Cache) EffectiveConfig() EffectiveConfig {
+	incompressible := c.Incompressible
+	if incompressible == nil {
+		incompressible = DefaultIncompressible
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	dict := c.Dictionary
+	if c.dict != nil {
+		dict = c.dict
+	}
+	return EffectiveConfig{
+		CacheConfig:     c.config(),
+		Incompressible:  append([]string(nil), incompressible...),
+		DictionaryBytes: len(dict),
+		Hooks: map[string]bool{
+			"OnKillDecision":    c.OnKillDecision != nil,
+			"Freshness":         c.Freshness != nil,
+			"SubjectFunc":       c.SubjectFunc != nil,
+			"MayFill":           c.MayFill != nil,
+			"MayPurge":          c.MayPurge != nil,
+			"RouteTTL":          c.RouteTTL != nil,
+			"RefreshHandler":    c.RefreshHandler != nil,
+			"HeadersOnly":       c.HeadersOnly != nil,
+			"RouteContentTypes": c.RouteContentTypes != nil,
+			"ShouldCacheBody":   c.ShouldCacheBody != nil,
+			"Grouper":           c.Grouper != nil,
+			"KeyRewriter":       c.KeyRewriter != nil,
+			"DedupKey":          c.DedupKey != nil,
+			"Redact":            c.Redact != nil,
+		},
+		Pinned: len(c.pinned),
+	}
+}
+
+/*
+	AdminHandler returns the admin handler of the cache
+*/
+func (c *Cache) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimSuffix(r.URL.Path, "/") {
+		case "/config":
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				notAllowed(w, "GET, HEAD")
+				return
+			}
+			writeJSON(w, c.EffectiveConfig())
+		case "/entries":
+			if r.Method != http.MethodDelete {
+				notAllowed(w, "DELETE")
+				return
+			}
+			c.adminRemove(w, r)
+		case "/resolve":
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				notAllowed(w, "GET, HEAD")
+				return
+			}
+			c.adminResolve(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+/*
+	adminRemove serves DELETE /entries
+*/
+func (c *Cache) adminRemove(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var removed int
+	var err error
+	switch {
+	case query.Has("key"):
+		if err = c.Remove(query.Get("key")); err == nil {
+			removed = 1
+		}
+	case query.Has("pattern"):
+		removed, err = c.RemoveMatching(query.Get("pattern"))
+	case query.Has("url"):
+		var target *http.Request
+		target, err = http.NewRequest(http.MethodGet, query.Get("url"), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = c.RemoveRequest(target); err == nil {
+			removed = 1
+		}
+	default:
+		http.Error(w, "one of key, pattern or url is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, map[string]int{"removed": removed})
+}
+
+/*
+	Resolution answers GET /resolve: what a request is keyed as, and whether something is cached under it
+*/
+type Resolution struct {
+	Key        string // the key as stored, for DELETE /entries?key=
+	DisplayKey string // the key as logs and events show it, see Redact
+	Cacheable  bool   // the request is cached at all, the keys are "" when not
+	Exists     bool   // an entry is cached under the key right now
+}
+
+/*
+	adminResolve serves GET /resolve
+*/
+func (c *Cache) adminResolve(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !query.Has("url") {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	if c.Keymaker == nil {
+		http.Error(w, ErrKeyerRequired.Error(), errorStatus(ErrKeyerRequired))
+		return
+	}
+	method := http.MethodGet
+	if m := query.Get("method"); m != "" {
+		method = strings.ToUpper(m)
+	}
+	target, err := http.NewRequest(method, query.Get("url"), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var res Resolution
+	res.Key, res.DisplayKey = c.ResolveKey(target)
+	if res.Key != "" {
+		res.Cacheable = true
+		c.mu.RLock()
+		res.Exists = c.caches[res.Key] != nil
+		c.mu.RUnlock()
+	}
+	writeJSON(w, res)
+}
+
+/*
+	errorStatus maps an error of the cache to the HTTP status reporting it
+*/
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidPattern), errors.Is(err, ErrKeyerRequired):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrStoreUnavailable), errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func notAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+/*
+	writeJSON writes v as an indented JSON response
+*/
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,95 @@
+package burstcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdminConfig(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.MayFill = func(r *http.Request) bool { return true }
+	c.Pin("/critical")
+	c.SetTTL(3 * time.Second)
+	cfg := c.Config()
+	cfg.MaxAge = time.Minute
+	cfg.SubjectMax = 5
+	if err := c.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get(c.AdminHandler(), "/config")
+	var got EffectiveConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if !reflect.DeepEqual(got, c.EffectiveConfig()) {
+		t.Fatalf("GET /config answered\n%+v\nthe cache runs\n%+v", got, c.EffectiveConfig())
+	}
+	if got.TTL != 3*time.Second || got.MaxAge != time.Minute || got.SubjectMax != 5 {
+		t.Fatalf("the runtime changes don't show: %s", rec.Body.String())
+	}
+	if !got.Hooks["MayFill"] || got.Hooks["Freshness"] || got.Pinned != 1 {
+		t.Fatalf("hooks %v and %d pinned keys, want MayFill and /critical", got.Hooks, got.Pinned)
+	}
+
+	post := httptest.NewRecorder()
+	c.AdminHandler().ServeHTTP(post, httptest.NewRequest("POST", "/config", nil))
+	if post.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /config answered %d", post.Code)
+	}
+}
+
+func TestResolveKeyAgreesWithChain(t *testing.T) {
+	spec, err := NewSpecKeymaker("path", "query:q", "header:X-Tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := func(r *http.Request) *http.Request {
+		r.Header.Set("X-Tenant", "acme")
+		return r
+	}
+	for name, tc := range map[string]struct {
+		keyer         Keyer
+		filled, asked *http.Request // alike as far as the keyer goes
+	}{
+		"path":  {&Keymaker{}, httptest.NewRequest("GET", "/a?x=1", nil), httptest.NewRequest("GET", "/a?x=2", nil)},
+		"query": {&QueryKeymaker{Keyer: &Keymaker{}}, httptest.NewRequest("GET", "/a?z=1&b=2&_=123", nil), httptest.NewRequest("GET", "/a?b=2&z=1", nil)},
+		"spec":  {spec, tenant(httptest.NewRequest("GET", "/a?q=go&page=1", nil)), tenant(httptest.NewRequest("GET", "/a?page=2&q=go", nil))},
+	} {
+		c := NewCache(tc.keyer, nil, time.Minute, time.Minute)
+		c.Chain(&counting{body: "x"}).ServeHTTP(httptest.NewRecorder(), tc.filled)
+		key, display := c.ResolveKey(tc.asked)
+		if _, ok := c.Peek(key); !ok {
+			t.Fatalf("%s: resolved %q, not what Chain stored", name, key)
+		}
+		if display != c.redact(key) {
+			t.Fatalf("%s: displayed %q, want %q", name, display, c.redact(key))
+		}
+	}
+}
+
+func TestAdminResolve(t *testing.T) {
+	c := NewCache(&QueryKeymaker{Keyer: &Keymaker{}}, nil, time.Minute, time.Minute)
+	get(c.Chain(&counting{body: "x"}), "/a?z=1&b=2")
+	resolve := func(query string) Resolution {
+		rec := httptest.NewRecorder()
+		c.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/resolve?"+query, nil))
+		var res Resolution
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %v in %q", query, err, rec.Body.String())
+		}
+		return res
+	}
+	key, display := c.ResolveKey(httptest.NewRequest("GET", "/a?b=2&z=1", nil))
+	if res := resolve("url=" + url.QueryEscape("/a?b=2&z=1&_=9")); !res.Cacheable || !res.Exists || res.Key != key || res.DisplayKey != display {
+		t.Fatalf("resolved %+v, want %q cached", res, key)
+	}
+	if res := resolve("url=/a&method=head"); !res.Cacheable || res.Exists || res.Key == key {
+		t.Fatalf("resolved %+v for a HEAD never served", res)
+	}
+}
@@ -0,0 +1,66 @@
+package burstcache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+	With AgeHeaders, served cached responses tell clients how old they are (RFC 9111):
+	Age counts the seconds since the response was stored in the first place (by
+	another instance, for one from the shared tier), also once it is stale and
+	past its time to die. Stale responses carry Warning 110, and those kept alive
+	because their refresh doesn't come back (the backend may well be unreachable)
+	Warning 112 on top.
+*/
+
+/*
+	grace is why a stale cache is still alive past its time to die
+*/
+type grace int
+
+const (
+	graceNone         grace = iota // it isn't, or not yet
+	graceVetoed                    // OnKillDecision vetoed its kill
+	graceDisconnected              // its refresh was still out when it was due to die
+)
+
+const (
+	warningStale        = `110 - "Response is Stale"`
+	warningDisconnected = `112 - "Disconnected Operation"`
+)
+
+/*
+	graced records why the cache, if it is still the given generation and phase,
+	outlives its time to die
+*/
+func (c *Cache) graced(key string, id int64, phase int, reason grace) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cache := c.caches[key]; cache != nil && cache.id == id && cache.phase == phase {
+		cache.grace = reason
+	}
+}
+
+/*
+	age sets the Age and Warning headers of the cache served at now
+*/
+func (c *Cache) age(h http.Header, cache *ResponseCacher, now time.Time) {
+	c.mu.RLock()
+	fresh, reason := cache.fresh, cache.grace
+	c.mu.RUnlock()
+
+	age := now.Sub(cache.stored) / time.Second
+	if age < 0 {
+		age = 0
+	}
+	h.Set("Age", strconv.FormatInt(int64(age), 10))
+	if fresh {
+		return
+	}
+	h.Add("Warning", warningStale)
+	if reason == graceDisconnected {
+		h.Add("Warning", warningDisconnected)
+	}
+}
@@ -0,0 +1,55 @@
+package burstcache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAgeHeadersInGrace(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	c := NewCache(&Keymaker{}, nil, 20*time.Millisecond, 20*time.Millisecond)
+	c.Clock = clock
+	c.AgeHeaders = true
+	c.KillGrace = 40 * time.Millisecond
+	var veto int32 = 1
+	c.OnKillDecision = func(string, CacheMeta) bool { return atomic.LoadInt32(&veto) == 0 }
+	block := make(chan struct{})
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			// the backend stops answering
+			<-block
+		}
+		w.Write([]byte("x"))
+	}))
+	warnings := func(header http.Header) []string { return header.Values("Warning") }
+
+	get(h, "/a")
+	if header := get(h, "/a").Header(); header.Get("Age") != "0" || len(warnings(header)) != 0 {
+		t.Fatalf("fresh: %v", header)
+	}
+
+	// past its time to die, kept by the veto; this request starts the refresh that never comes back
+	clock.Advance(60 * time.Millisecond)
+	if header := get(h, "/a").Header(); header.Get("Age") != "0" || len(warnings(header)) != 1 || warnings(header)[0] != warningStale {
+		t.Fatalf("vetoed: %v", header)
+	}
+
+	// due to die again, at the end of the grace, with its refresh still out
+	atomic.StoreInt32(&veto, 0)
+	clock.Advance(20 * time.Millisecond)
+	if header := get(h, "/a").Header(); len(warnings(header)) != 2 || warnings(header)[0] != warningStale || warnings(header)[1] != warningDisconnected {
+		t.Fatalf("disconnected: %v", header)
+	}
+
+	// Age keeps counting from when it was stored
+	clock.Advance(2 * time.Second)
+	if header := get(h, "/a").Header(); header.Get("Age") != "2" || len(warnings(header)) != 2 {
+		t.Fatalf("two seconds on: %v", header)
+	}
+
+	close(block)
+	waitIdle(t, c)
+}
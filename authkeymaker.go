@@ -0,0 +1,46 @@
+package burstcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+/*
+	AuthKeymaker wraps another Keyer and gives every Authorization header (typically
+	a bearer token) a cache of its own, for token scoped APIs where per token caching
+	is acceptable. The credential is hashed, it never appears in keys.
+
+	Beware of cardinality: every token holds its own entries, so with many tokens
+	in use, cap the cache (e.g. with a SubjectFunc over the token and SubjectMax)
+	or the entries of busy tokens get evicted by the long tail of quiet ones.
+
+	Requests without Authorization bypass the cache, unless Shared is set,
+	in which case they share one anonymous bucket.
+*/
+type AuthKeymaker struct {
+	Keyer  Keyer // the keyer whose keys are split per credential
+	Shared bool  // let requests without credentials share a bucket instead of bypassing the cache
+}
+
+func (k *AuthKeymaker) Key(w http.ResponseWriter, r *http.Request) string {
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" && !k.Shared {
+		// bypass
+		return ""
+	}
+
+	bucket := "anonymous"
+	if auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		bucket = hex.EncodeToString(sum[:16])
+	}
+
+	key := k.Keyer.Key(w, r)
+	if key == "" {
+		return ""
+	}
+
+	return key + "|auth=" + bucket
+}
@@ -0,0 +1,57 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthKeymaker(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		c := NewCache(&AuthKeymaker{Keyer: &Keymaker{}, Shared: shared}, nil, time.Hour, time.Hour)
+		h := &counting{}
+		served := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r)
+			w.Write([]byte("for " + r.Header.Get("Authorization")))
+		}))
+		as := func(auth string) string {
+			r := httptest.NewRequest("GET", "/me", nil)
+			if auth != "" {
+				r.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+			served.ServeHTTP(rec, r)
+			return rec.Body.String()
+		}
+
+		for i := 0; i < 2; i++ {
+			for _, token := range []string{"Bearer alice-token", "Bearer bob-token"} {
+				if got := as(token); got != "for "+token {
+					t.Fatalf("%s got %q", token, got)
+				}
+			}
+		}
+		if h.count() != 2 || c.Stats().Entries != 2 {
+			t.Fatalf("%d upstream calls and %d entries for two tokens asking twice", h.count(), c.Stats().Entries)
+		}
+		c.mu.RLock()
+		for key := range c.caches {
+			if strings.Contains(key, "token") {
+				t.Errorf("the token leaked into key %s", key)
+			}
+		}
+		c.mu.RUnlock()
+
+		as("")
+		as("")
+		wantCalls, wantEntries := 4, 2
+		if shared {
+			wantCalls, wantEntries = 3, 3
+		}
+		if h.count() != wantCalls || c.Stats().Entries != wantEntries {
+			t.Fatalf("shared %v: %d upstream calls and %d entries without Authorization", shared, h.count(), c.Stats().Entries)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package burstcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"time"
+)
+
+/*
+	Without RefreshBackoff, a refresh is kept whatever it returned: a failing
+	backend replaces the good stale response with its error. With it, a refresh
+	that fails transiently (502, 503, 504) is dropped instead, the stale response
+	stays until it dies, and the key waits RefreshBackoff before it is refreshed
+	again, twice as long after every failure in a row (but never longer than TTD).
+
+	With a shared tier, the failures of a key are kept there as well, under the
+	key with backoffMarker appended, so all instances back off together instead
+	of each hitting the struggling backend on a schedule of its own. Before
+	refreshing a key, an instance reads its state from the shared tier. If the
+	key is failing and its wait is over, the attempt is claimed there first,
+	pushing the wait on for the others, and its outcome is written once known.
+	The Storer has no compare and swap, so instances racing for a claim may both
+	win it; each attempt after is made by one.
+*/
+
+/*
+	backoff is the refresh failure state of a key
+*/
+type backoff struct {
+	Failures int       // failed refreshes in a row
+	Next     time.Time // no refresh before this
+}
+
+/*
+	backoffMarker is appended to a key to store its backoff in the shared tier
+*/
+const backoffMarker = "|backoff"
+
+/*
+	maxBackoffDoublings caps how often the wait doubles, it can't outgrow a Duration
+*/
+const maxBackoffDoublings = 16
+
+/*
+	backingOff reports whether key failed to refresh recently enough that it must not be refreshed yet.
+	When a failing key may be tried again, the attempt is claimed in the shared tier first,
+	so the other instances wait for its outcome instead of trying along.
+*/
+func (c *Cache) backingOff(key string) bool {
+	c.mu.RLock()
+	base, ttd := c.RefreshBackoff, c.ttd(key)
+	state, known := c.backoffs[key]
+	c.mu.RUnlock()
+	if base <= 0 {
+		return false
+	}
+	now := time.Now()
+	if known && now.Before(state.Next) {
+		return true
+	}
+	if shared, ok := c.fetchBackoff(key); ok && (shared.Failures > state.Failures || shared.Next.After(state.Next)) {
+		state, known = shared, true
+	}
+	if !known {
+		// not failing, as far as anyone knows
+		return false
+	}
+	backing := now.Before(state.Next)
+	var wait time.Duration
+	if !backing {
+		wait = backoffWait(state.Failures+1, base, ttd)
+		state.Next = now.Add(wait)
+	}
+	c.mu.Lock()
+	if c.backoffs == nil {
+		c.backoffs = map[string]backoff{}
+	}
+	c.backoffs[key] = state
+	c.mu.Unlock()
+	if !backing {
+		c.storeBackoff(key, state, wait)
+	}
+	return backing
+}
+
+/*
+	backoffWait returns how long a key waits after failing to refresh failures times in a row
+*/
+func backoffWait(failures int, base, ttd time.Duration) time.Duration {
+	wait := base
+	for i := 1; i < failures && i <= maxBackoffDoublings; i++ {
+		wait *= 2
+	}
+	if ttd > 0 && wait > ttd {
+		wait = ttd
+	}
+	return wait
+}
+
+/*
+	refreshFailed tells whether a refresh of key failed in a way RefreshBackoff covers,
+	in which case the failure is recorded and the refresh must be dropped
+*/
+func (c *Cache) refreshFailed(key string, cache *ResponseCacher) bool {
+	c.mu.Lock()
+	base, ttd := c.RefreshBackoff, c.ttd(key)
+	if base <= 0 || !transient(cache) {
+		c.mu.Unlock()
+		return false
+	}
+	if c.backoffs == nil {
+		c.backoffs = map[string]backoff{}
+	}
+	state := c.backoffs[key]
+	state.Failures++
+	wait := backoffWait(state.Failures, base, ttd)
+	state.Next = time.Now().Add(wait)
+	c.backoffs[key] = state
+	if stale := c.caches[key]; stale != nil {
+		// the stale response stays as it is, up for a refresh once the wait is over
+		stale.regen = false
+	}
+	c.mu.Unlock()
+
+	log.Printf("burstcache: refresh of %s failed with %d (%d in a row), serving stale and retrying in %v", c.redact(key), cache.Code, state.Failures, wait)
+	if c.Shared != nil {
+		c.background(func() {
+			c.storeBackoff(key, state, wait)
+		})
+	}
+	return true
+}
+
+/*
+	refreshed forgets the failures of key once a refresh went through
+*/
+func (c *Cache) refreshed(key string) {
+	c.mu.Lock()
+	_, known := c.backoffs[key]
+	delete(c.backoffs, key)
+	c.mu.Unlock()
+	if known && c.Shared != nil {
+		c.background(func() {
+			err := c.Shared.Delete(key + backoffMarker)
+			c.countStore(err)
+		})
+	}
+}
+
+/*
+	fetchBackoff reads the backoff of key from the shared tier, ok is false when it has none
+*/
+func (c *Cache) fetchBackoff(key string) (state backoff, ok bool) {
+	if c.Shared == nil {
+		return state, false
+	}
+	data, found, err := c.Shared.Get(key + backoffMarker)
+	c.countStore(err)
+	if err != nil || !found {
+		return state, false
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return state, false
+	}
+	return state, true
+}
+
+/*
+	storeBackoff writes the backoff of key to the shared tier. It is kept twice
+	as long as the wait, so the next failure still finds the count to double.
+*/
+func (c *Cache) storeBackoff(key string, state backoff, wait time.Duration) {
+	if c.Shared == nil {
+		return
+	}
+	data := new(bytes.Buffer)
+	if err := gob.NewEncoder(data).Encode(state); err != nil {
+		return
+	}
+	err := c.Shared.Set(key+backoffMarker, data.Bytes(), 2*wait)
+	c.countStore(err)
+	if err != nil {
+		log.Printf("burstcache: shared store set of the refresh backoff of %s failed: %v", c.redact(key), err)
+	}
+}
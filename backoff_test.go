@@ -0,0 +1,95 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	flaky answers "good" until failing is set, and 503 after
+*/
+type flaky struct {
+	failing  int32
+	attempts int32 // requests while failing
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&f.failing) == 1 {
+		atomic.AddInt32(&f.attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("good"))
+}
+
+func TestRefreshBackoffKeepsStale(t *testing.T) {
+	backend := &flaky{}
+	c := NewCache(&Keymaker{}, nil, 10*time.Millisecond, 10*time.Second)
+	c.RefreshBackoff = 40 * time.Millisecond
+	h := c.Chain(backend)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	atomic.StoreInt32(&backend.failing, 1)
+
+	deadline := time.Now().Add(130 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+		if rec.Code != 200 || rec.Body.String() != "good" {
+			t.Fatalf("served %d %q, the failed refresh replaced the stale response", rec.Code, rec.Body.String())
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	waitIdle(t, c)
+	// failures after 0, 40 and 120ms: the waits double
+	if n := atomic.LoadInt32(&backend.attempts); n < 2 || n > 3 {
+		t.Fatalf("%d refreshes in 130ms, want 2 or 3 for a backoff from 40ms doubling", n)
+	}
+
+	atomic.StoreInt32(&backend.failing, 0)
+	time.Sleep(200 * time.Millisecond)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	waitIdle(t, c)
+	c.mu.RLock()
+	_, failed := c.backoffs["/x"]
+	c.mu.RUnlock()
+	if failed {
+		t.Fatal("the failures are remembered after a refresh went through")
+	}
+}
+
+func TestRefreshBackoffShared(t *testing.T) {
+	backend := &flaky{}
+	shared := NewMemoryStore()
+	instance := func() http.Handler {
+		c := NewCache(&Keymaker{}, nil, 10*time.Millisecond, 10*time.Second)
+		c.RefreshBackoff = 50 * time.Millisecond
+		c.Shared = shared
+		return c.Chain(backend)
+	}
+	one, two := instance(), instance()
+	one.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	time.Sleep(5 * time.Millisecond)
+	two.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	atomic.StoreInt32(&backend.failing, 1)
+	time.Sleep(15 * time.Millisecond)
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		for _, h := range []http.Handler{one, two} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+			if rec.Code != 200 {
+				t.Fatalf("served %d, the failed refresh replaced the stale response", rec.Code)
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	// one schedule for both: failures after 0, 50 and 150ms (both may take
+	// the first), where each instance on its own schedule would make 6
+	if n := atomic.LoadInt32(&backend.attempts); n < 3 || n > 4 {
+		t.Fatalf("%d refreshes in 300ms by two instances, want 3 or 4 for a single backoff schedule", n)
+	}
+}
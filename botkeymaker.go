@@ -0,0 +1,67 @@
+package burstcache
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+	DefaultBots are the User-Agent fragments BotKeymaker recognizes crawlers by
+	when no list of its own is configured
+*/
+var DefaultBots = []string{
+	"googlebot",
+	"bingbot",
+	"yandexbot",
+	"baiduspider",
+	"duckduckbot",
+	"slurp",
+	"applebot",
+	"facebookexternalhit",
+	"twitterbot",
+	"linkedinbot",
+	"crawler",
+	"spider",
+}
+
+/*
+	BotKeymaker wraps another Keyer and puts crawlers and humans in separate
+	buckets, so endpoints that serve fuller content to crawlers (SEO) cache
+	both versions separately. Requests without a recognized User-Agent are human.
+*/
+type BotKeymaker struct {
+	Keyer Keyer    // the keyer whose keys are split into bot and human buckets
+	Bots  []string // case insensitive User-Agent fragments identifying crawlers, defaults to DefaultBots
+}
+
+func (k *BotKeymaker) Key(w http.ResponseWriter, r *http.Request) string {
+
+	key := k.Keyer.Key(w, r)
+	if key == "" {
+		return ""
+	}
+
+	bucket := "human"
+	if k.bot(r.UserAgent()) {
+		bucket = "bot"
+	}
+
+	return key + "|" + bucket
+}
+
+/*
+	bot reports whether the User-Agent belongs to a crawler
+*/
+func (k *BotKeymaker) bot(agent string) bool {
+	bots := k.Bots
+	if bots == nil {
+		bots = DefaultBots
+	}
+	agent = strings.ToLower(agent)
+	for _, bot := range bots {
+		if bot != "" && strings.Contains(agent, strings.ToLower(bot)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBotKeymaker(t *testing.T) {
+	c := NewCache(&BotKeymaker{Keyer: &Keymaker{}}, nil, time.Hour, time.Hour)
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.UserAgent()))
+	}))
+	const (
+		googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+		browser   = "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	)
+	for _, agent := range []string{googlebot, browser, googlebot, browser, ""} {
+		r := httptest.NewRequest("GET", "/page", nil)
+		r.Header.Set("User-Agent", agent)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	for key, want := range map[string]string{"/page|bot": googlebot, "/page|human": browser} {
+		rec := httptest.NewRecorder()
+		if !c.ServeCached(key, rec) || rec.Body.String() != want {
+			t.Errorf("%s holds %q, want %q", key, rec.Body.String(), want)
+		}
+	}
+	if n := c.Stats().Entries; n != 2 {
+		t.Fatalf("%d entries, want one for bots and one for humans, unknown agents among them", n)
+	}
+
+	custom := &BotKeymaker{Keyer: &Keymaker{}, Bots: []string{"MyCrawler"}}
+	r := httptest.NewRequest("GET", "/page", nil)
+	for agent, want := range map[string]string{"mycrawler/1.0": "/page|bot", googlebot: "/page|human"} {
+		r.Header.Set("User-Agent", agent)
+		if key := custom.Key(httptest.NewRecorder(), r); key != want {
+			t.Errorf("%q keyed %q with custom bots, want %q", agent, key, want)
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package burstcache
 
 import (
+	"fmt"
+	"log"
 	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,17 +36,159 @@ import (
 		avg req duration: 100 msec, stddev: 30 msec -> TTD should be at least 100+30+30 = 160 msec
 */
 type Cache struct {
-	Keymaker Keyer // provides unique keys given the request parameters
+	Keymaker Keyer    // provides unique keys given the request parameters, only needed by Chain
+	Methods  []string // the methods whose requests Chain caches, each keyed apart, defaults to DefaultMethods; others pass through
+	Shared   Storer   // optional second tier, consulted on local misses before the handler is
+
+	RefreshHandler http.Handler // if set, background refreshes in Chain run through it instead of the chained handler (e.g. to spare the primary backend)
 
 	TTL time.Duration // time to live, amount of time before fresh caches becomes stale
 	TTD time.Duration // time to die , amount of time before stale caches are killed
 
-	mu     sync.RWMutex
-	caches map[string]*ResponseCacher // caching responsewriter
+	RouteTTL  func(r *http.Request) (ttl time.Duration, ok bool) // if set and ok, the time to live of what r fills instead of TTL
+	MaxTTL    time.Duration                                      // if set, caps the time to live set per request (RouteTTL, WithTTL)
+	StatusTTL map[int]time.Duration                              // time to live per status code (e.g. 301: time.Hour), instead of TTL or what the request set
+
+	HeadersOnly func(r *http.Request) bool // if set and true, what r fills is cached without its body: status and headers only (e.g. for 204 or HEAD routes)
+
+	RouteContentTypes func(r *http.Request) (types []string, ok bool) // if set and ok, what r fills is only cached with one of these content types (e.g. "application/json", "image/*")
+
+	MinBodyBytes int           // responses with a smaller body are passed through uncached
+	MaxBodyBytes int           // responses with a larger body are passed through uncached, buffering stops at this size
+	MaxBytes     int64         // if set, evict entries (stale ones first) while the estimated memory held exceeds this
+	IdleTimeout  time.Duration // if set, evict entries not served for this long, whatever their freshness; refreshes don't count, pinned keys stay
+
+	MemoryLimit int64        // the memory WatchMemory yields against, defaults to GOMEMLIMIT
+	MemoryHigh  float64      // fraction of MemoryLimit above which WatchMemory starts evicting, defaults to 0.9
+	MemoryLow   float64      // fraction of MemoryLimit WatchMemory evicts down to, defaults to 0.8
+	HeapBytes   func() int64 // reports the memory in use to WatchMemory, defaults to the heap objects as runtime/metrics has them
+
+	SkipUnwritten   bool                                      // don't cache responses the handler wrote nothing at all for, instead of caching them as a 200 with an empty body
+	ShouldCacheBody func(body []byte, header http.Header) bool // if set, consulted on the whole body of a filled response, false leaves it uncached (e.g. a 200 with an error envelope)
+
+	ForwardInformational bool // pass informational responses (e.g. 103 Early Hints) of a cold fill on to the client waiting for it; they are never cached
+
+	DefaultContentType string // if set, the Content-Type of filled responses that lack one, instead of sniffing it on every serve
+	Digest             bool   // serve cached responses with a Digest header holding the sha-256 of their body, computed once when stored
+
+	OnKillDecision func(key string, meta CacheMeta) bool // consulted before a stale cache is killed, false vetoes the kill
+	KillGrace      time.Duration                         // extra life granted by a vetoed kill, defaults to TTD
+
+	RescheduleExisting bool // make SetTTL and SetTTD apply to the caches already stored, not just new ones
+
+	Clock Clock // what entries are stored, go stale, die and go idle by, defaults to the wall clock, see clock.go
+
+	StrictTuning bool                    // extend TTD at runtime when regenerations take longer than it
+	TuningMargin time.Duration           // added to the p95 regeneration duration when extending TTD
+	Grouper      func(key string) string // if set, the endpoint family of a key; StrictTuning then learns per family
+
+	BypassUnfriendly bool // let UnfriendlyRoutes switch the routes it reports to bypass the cache
+
+	MaxAge       time.Duration // if set, tell clients to cache served responses for this long (Cache-Control max-age)
+	MaxAgeJitter time.Duration // subtract a random amount up to this from MaxAge, so client copies expire staggered
+	ErrorMaxAge  time.Duration // if set, the max-age of cached error responses (400 and up) instead, so clients keep them briefly
+	AgeHeaders   bool          // serve cached responses with Age, and Warning once stale, see age.go
+
+	RetryBudget      int           // how often a failed (5xx) cold fill is retried by one of the requests waiting for it
+	ColdRetries      int           // how often a cold fill that failed transiently (502, 503, 504) is retried right away by the same request
+	ColdRetryBackoff time.Duration // wait before the first of those retries, doubling with every next one, defaults to 10ms
+	RefreshBackoff   time.Duration // if set, a refresh failing transiently is dropped for the stale response, and its key waits this long (doubling) before the next, see backoff.go
+
+	Freshness func(meta CacheMeta) State // if set, decides on every access whether a cache is fresh, stale or dead
+
+	SubjectFunc     func(r *http.Request) string // if set, caches are kept per subject (e.g. a verified user id), "" is anonymous
+	SubjectMax      int                          // max caches per subject, the least recently used one is evicted beyond that
+	BypassAnonymous bool                         // pass requests without subject through uncached, instead of sharing their caches
+
+	MaxBatch int // most keys per batch operation on a shared tier that is a BatchStorer, defaults to 100
+
+	Compress         bool     // keep bodies gzip compressed in memory, they are decompressed when served
+	CompressMinBytes int      // don't bother compressing smaller bodies
+	Incompressible   []string // content types stored raw, defaults to DefaultIncompressible
+	Dictionary       []byte   // compress against this preset dictionary, see SetDictionary and TrainDictionary
+
+	RefreshDelay time.Duration // serve stale for this long before the first request triggers a refresh
+	RateBucket   time.Duration // request rates are counted per bucket of this width, defaults to a second, see RateOf
+	MeasureTTFB  bool          // keep time to first byte histograms per outcome, see Stats.TTFB
+	Events       int           // if set, keep the last this many decisions of the cache, see RecentEvents
+
+	StoreErrorRate float64 // share of recent shared tier operations that may fail before Health reports Degraded, defaults to 0.1
+	MaxInFlight    int     // running regenerations at which Health reports Degraded, 0 for no limit
+	HealthHeader   string  // if set, served cached responses carry the Health status in this header, e.g. for edge routers
+
+	KeyRewriter func(key string, r *http.Request) string // if set, rewrites the key of every request, e.g. to add an experiment variant; "" bypasses the cache
+	DedupKey    func(key string, r *http.Request) string // if set, regenerations of keys with the same dedup key at the same time share one run of the handler
+
+	Redact func(key string) string // how keys are shown to operators (logs), defaults to RedactQuery; return key to show it as is
+
+	VaryHeaders []string // response headers naming request headers responses vary on (e.g. "Vary", "X-Cache-Vary"); responses are then kept per value of those
+
+	RegenRate  float64       // if set, the most regenerations per second the cache starts in total, a ceiling for the backend
+	RegenBurst int           // regenerations RegenRate allows at once, defaults to 1
+	RegenWait  time.Duration // how long a cold miss waits for RegenRate to allow its fill, before it is shed with a 503
+
+	HedgeAfter time.Duration // if set, a cold fill still running after this long is raced by a second (hedged) request to the handler
+
+	DevVerify       bool             // development only: compare the first replay of every regenerated entry with another run of the handler
+	VolatileHeaders []string         // headers DevVerify ignores, defaults to DefaultVolatileHeaders
+	OnMismatch      func(m Mismatch) // if set, gets what DevVerify finds, instead of the log
+
+	MayFill  func(r *http.Request) bool // if set, only requests it approves (e.g. internal warmers) fill cold caches, other misses pass through
+	MayPurge func(r *http.Request) bool // if set, Chain answers PURGE requests it approves by removing the entry, and refuses the others
+
+	WarmStrategy WarmStrategy // which instances Warm fills which entries, defaults to WarmAll, see warm.go
+	Leader       func() bool  // with WarmLeader, whether this instance is the one to warm (e.g. an external leader election flag)
+	WarmPeers    []string     // with WarmPartitioned, the names of all instances warming, WarmSelf among them
+	WarmSelf     string       // with WarmPartitioned, the name of this instance
+
+	snapshot atomic.Pointer[CacheConfig] // the tunable settings in effect, see CacheConfig
+
+	mu       sync.RWMutex
+	caches   map[string]*ResponseCacher     // caching responsewriter
+	flights  map[string]*flight             // cold fills in progress
+	bytes    int64                          // estimated memory held by all caches, see estimate
+	lru      subjects                       // per subject usage order of the caches
+	dict     []byte                         // replaces Dictionary once set, see SetDictionary
+	tagged   map[string]map[string]struct{} // tag -> keys of the caches carrying it
+	routed   map[string]map[string]struct{} // route -> keys of its caches, see InvalidateRoute
+	pinned   map[string]bool                // keys exempt from eviction, see Pin
+	dims     map[string][]string            // key -> request headers its responses vary on, see VaryHeaders
+	varied   map[string]int                 // key -> how many of its variants are cached, see VaryHeaders
+	dedups   map[string]*dedup              // regenerations in progress by dedup key, see DedupKey
+	routes   map[string]*route              // how requests were answered per route, see UnfriendlyRoutes
+	bypassed map[string]bool                // routes passed through uncached, see BypassRoute
+	fences   map[string]int64               // keys invalidated while being filled, see fence
+	backoffs map[string]backoff             // keys whose refreshes failed, see RefreshBackoff
+	sweep    Timer                          // the pending sweep for idle entries, see IdleTimeout
+	pressed  bool                           // under memory pressure, see WatchMemory
+	released int64                          // bytes evicted under pressure since the last GC, the heap doesn't show it yet
+	cycles   uint64                         // the GC cycle released is counted since
+
+	draining int32 // set once draining, see Drain
+	idle     idle  // background work, see WaitIdle
+
+	stats  Stats  // counters, updated atomically
+	events events // recent decisions, see Events
+	gen    int64  // last handed out cache id, updated atomically
+	tuner  tuner             // recent regeneration durations
+	groups map[string]*tuner // recent regeneration durations per group, see Grouper
+
+	origins  [numOrigins]int64      // caches stored per origin, updated atomically
+	removals [numCauses]int64       // caches removed per cause, updated atomically
+	details  [numDetails]int64      // serves per Detail, updated atomically
+	ttfb     [numOutcomes]histogram // time to first byte per outcome, see MeasureTTFB
+	inflight int64                  // regenerations running right now, updated atomically
+
+	storeOps    rate // shared tier operations, for Health
+	storeErrors rate // failed shared tier operations, for Health
+	vetoes      rate // kills vetoed by OnKillDecision, for Health
+
+	regens tokens // regenerations allowed, see RegenRate
 }
 
 /*
-	Factory function
+	Factory function. The keymaker may be nil when the cache is only used
+	through Store, ServeCached, Peek and Invalidate, and never through Chain.
 */
 func NewCache(keymaker Keyer, l api.ILogger, ttl time.Duration, ttd time.Duration) *Cache {
 
@@ -49,6 +198,7 @@ func NewCache(keymaker Keyer, l api.ILogger, ttl time.Duration, ttd time.Duratio
 		TTL:      ttl,
 		TTD:      ttd,
 		caches:   map[string]*ResponseCacher{},
+		flights:  map[string]*flight{},
 	}
 }
 
@@ -56,106 +206,897 @@ func NewCache(keymaker Keyer, l api.ILogger, ttl time.Duration, ttd time.Duratio
 
 func (c *Cache) Chain(next http.Handler) http.Handler {
 
+	if c.Keymaker == nil {
+		log.Printf("burstcache: Chain needs a Keymaker to key requests, all requests will fail")
+		return service.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		})
+	}
+
 	f := func(w http.ResponseWriter, r *http.Request) {
 
-		key := c.Keymaker.Key(w, r)
+		if r.Method == MethodPurge && c.MayPurge != nil {
+			// not a request for the handler, but for us
+			c.purge(w, r)
+			return
+		}
 
-		exists, _, fresh, regen := c.status(key)
+		start := time.Now()
+		client := w
+		w, tw := c.measure(w)
 
-		if !exists {
+		// the settings this request goes by, whatever Reconfigure does meanwhile
+		cfg := c.settings()
 
-			// fill cache and wait for it
-			c.regenerate(next, key, w, r)
+		base, ok := c.key(cfg, w, r)
+		if !ok {
+			// not to be cached, straight through
+			c.passThrough(next, client, r)
+			return
+		}
+		key := c.vary(base, r)
 
-			// serve from cache without marking the response
-			c.serve(key, w, false)
+		// how the request was answered, for the TTFB histograms and the recent events
+		done := func(outcome Outcome) {
+			c.record(tw, outcome)
+			c.event(key, outcome.String(), start)
+			c.countRoute(base, outcome)
+		}
+
+		if c.recursive(r, key) {
+			// the handler filling key calls back into us for key, don't wait for ourselves
+			atomic.AddInt64(&c.stats.Recursions, 1)
+			log.Printf("burstcache: request for %s while filling it, passing it through; is the cache chained twice?", c.redact(key))
+			c.passThrough(next, client, r)
+			c.event(key, DecisionPassThrough, start)
 			return
 		}
 
-		if !fresh && !regen {
+		if sharedOnly(r) {
+			// a warmer filling the shared tier, leave the local cache alone
+			c.warm(cfg, next, key, client, r)
+			return
+		}
+
+		cache, fresh, regen := c.lookup(key)
+
+		if cache == nil && (c.Draining() || c.MayFill != nil && !c.MayFill(r)) {
+			// no new fills while draining, nor by requests that may only read
+			c.passThrough(next, client, r)
+			c.event(key, DecisionPassThrough, start)
+			return
+		}
+
+		if cache == nil {
+
+			// fill cache and wait for it, together with anyone else missing this key
+			cache, shared := c.collapse(key, func() *ResponseCacher {
+				return c.retryCold(r, func() *ResponseCacher {
+					if !c.admit(r) {
+						return c.shed()
+					}
+					return c.dedup(cfg, key, r, func() *ResponseCacher {
+						return c.hedge(cfg, next, key, r, w)
+					})
+				})
+			})
+
+			if cache.oversize {
+				if shared || !cache.spilled {
+					// too large to share (or to hedge), get our own
+					c.passThrough(next, client, r)
+				}
+				// otherwise it went straight to our client while filling
+				done(OutcomeMiss)
+				return
+			}
+
+			if shared && cache.key != "" && cache.key != c.vary(base, r) {
+				// it turned out to vary, and not our way
+				c.passThrough(next, client, r)
+				done(OutcomeMiss)
+				return
+			}
 
-			// mark this cache is regenerating so other requests don't stampede
-			c.regen(key)
+			// serve the filled response, marked only if somebody else filled it
+			c.serve(cfg, w, cache, shared)
+			outcome := OutcomeMiss
+			if shared {
+				outcome = OutcomeCollapsed
+			}
+			cache.counts.count(outcome)
+			done(outcome)
+			return
+		}
+
+		// a stale cache is refreshed by one request, marking it as regenerating so the others don't stampede
+		if c.refreshes(cfg, key, cache, fresh, regen) {
 
 			// refill cache but this time do not wait for it
-			go c.regenerate(next, key, w, r)
+			c.background(func() {
+				c.regenerate(cfg, next, key, w, r)
+			})
 		}
 
+		// a refresh may have landed since we looked, prefer it
+		cache, fresh = c.recheck(key, cache, fresh)
+
 		// serve from cache, marking the response as cached
-		c.serve(key, w, true)
+		err := c.serve(cfg, w, cache, true)
+		if c.DevVerify {
+			c.verify(next, key, r, cache)
+		}
+		outcome := OutcomeHit
+		if !fresh {
+			c.stats.countStale(err == nil && r.Context().Err() == nil)
+			outcome = OutcomeStale
+		}
+		cache.counts.count(outcome)
+		done(outcome)
 		return
 	}
 	return service.HandlerFunc(f)
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////////
-// private parts
+// programmatic access, usable without a Keymaker
 ///////////////////////////////////////////////////////////////////////////////////////////////////////
 
-func (c *Cache) regenerate(next http.Handler, key string, w http.ResponseWriter, r *http.Request) {
+/*
+	Store puts a filled response into the cache under key, replacing what was there.
+	It expires like a regenerated response, but with no handler to refresh it,
+	it is simply killed once TTL and TTD have passed.
+	Fails with ErrClosed once the cache is draining, with ErrTooLarge when the body
+	exceeds MaxBodyBytes and with ErrNotCacheable when the response isn't cacheable
+	for another reason (see MinBodyBytes).
+*/
+func (c *Cache) Store(key string, cache *ResponseCacher) error {
+	if c.Draining() {
+		return fmt.Errorf("%w: not storing %s", ErrClosed, c.redact(key))
+	}
+	c.adopt(cache, OriginStore)
+	if !c.cacheable(cache) {
+		if c.tooLarge(cache) {
+			return fmt.Errorf("%w: not storing %s", ErrTooLarge, c.redact(key))
+		}
+		return fmt.Errorf("%w: not storing %s", ErrNotCacheable, c.redact(key))
+	}
+	c.keep(key, cache)
+	return nil
+}
 
-	// TODO: make proper UUID
-	id := rand.Intn(1000000)
+/*
+	tooLarge reports whether the body of the cache exceeds MaxBodyBytes
+*/
+func (c *Cache) tooLarge(cache *ResponseCacher) bool {
+	if cache.oversize {
+		return true
+	}
+	max := c.settingsOf(cache).MaxBodyBytes
+	if max <= 0 {
+		return false
+	}
+	if cache.stream != nil {
+		return cache.contentLength() > max
+	}
+	return cache.Body.Len() > max
+}
 
-	cache := NewResponseCacher(id)
+/*
+	GetOrFill returns the response cached under key. On a miss, fill is called
+	to produce it, with the same semantics as a cold miss in Chain: concurrent
+	callers for the same key wait for a single fill. A stale response is returned
+	as is, while fill refreshes it in the background.
+	The returned response is shared, it must not be modified.
+*/
+func (c *Cache) GetOrFill(key string, fill func() *ResponseCacher) *ResponseCacher {
 
-	// down the rabbit hole......
-	next.ServeHTTP(cache, r)
+	cfg := c.settings()
+	generate := func(origin Origin) *ResponseCacher {
+		// the id of when the fill started, see fence
+		id := atomic.AddInt64(&c.gen, 1)
+		atomic.AddInt64(&c.inflight, 1)
+		cache := fill()
+		atomic.AddInt64(&c.inflight, -1)
+		c.adopt(cache, origin)
+		cache.id = id
+		cache.settings = cfg
+		return cache
+	}
 
-	// swap stale with fresh result
-	c.swap(key, cache)
+	cache, fresh, regen := c.lookup(key)
 
-	// schedule two-phase cache expiration
-	go func() {
+	if cache == nil {
+		cache, _ = c.collapse(key, func() *ResponseCacher {
+			return generate(OriginFill)
+		})
+		return cache
+	}
 
-		// when ttl expires, cache becomes stale
-		time.Sleep(c.TTL)
-		exists, stale_id, fresh, _ := c.status(key)
-		if exists && fresh {
-			if stale_id == id {
-				c.stale(key)
+	if c.refreshes(cfg, key, cache, fresh, regen) {
+		c.background(func() {
+			if cache := generate(OriginRefresh); !c.refreshFailed(key, cache) {
+				c.refreshed(key)
+				c.keep(key, cache)
 			}
+		})
+	}
+
+	cache, _ = c.recheck(key, cache, fresh)
+	cache.counts.access(c.now())
+	return cache
+}
+
+/*
+	ServeCached serves the response cached under key, marked as a cached one.
+	Returns false, without writing anything, when there is no such response.
+*/
+func (c *Cache) ServeCached(key string, w http.ResponseWriter) bool {
+	cache, fresh, _ := c.lookup(key)
+	if cache == nil {
+		return false
+	}
+	err := c.serve(c.settings(), w, cache, true)
+	if !fresh {
+		c.stats.countStale(err == nil)
+	}
+	return true
+}
+
+/*
+	Access looks key up like a request in Chain (or GetOrFill) does, by the Clock,
+	without serving or filling anything, for tools that drive the cache themselves
+	(package sim replays traces through it). It returns the state of the entry,
+	Dead when there is none, and counts as a serve of it (see IdleTimeout and
+	MaxBytes). refresh tells a stale entry is to be refreshed by this access:
+	it is marked as regenerating, so later accesses don't, and it doesn't die
+	until it is replaced, so the caller must Store the refreshed response.
+*/
+func (c *Cache) Access(key string) (state State, refresh bool) {
+	cache, fresh, regen := c.lookup(key)
+	if cache == nil {
+		return Dead, false
+	}
+	refresh = c.refreshes(c.settings(), key, cache, fresh, regen)
+	now := c.now()
+	cache.use(now)
+	cache.counts.access(now)
+	if fresh {
+		return Fresh, false
+	}
+	return Stale, refresh
+}
+
+/*
+	refreshes reports whether the request that found cache (as lookup had it) is
+	the one to refresh it, marking it as regenerating if so. That is when it is
+	stale and no refresh is out, it has been for RefreshDelay (see refreshDue),
+	and neither Drain, RefreshBackoff nor RegenRate hold refreshes back.
+*/
+func (c *Cache) refreshes(cfg *CacheConfig, key string, cache *ResponseCacher, fresh, regen bool) bool {
+	if fresh || regen || !c.refreshDue(cfg, cache) || c.Draining() || c.backingOff(key) || !c.mayRegenerate() {
+		return false
+	}
+	c.regen(key)
+	return true
+}
+
+/*
+	Peek returns the CacheMeta of the response cached under key, if any
+*/
+func (c *Cache) Peek(key string) (CacheMeta, bool) {
+	return c.meta(key)
+}
+
+/*
+	Invalidate removes the response cached under key, from the shared tier too.
+	When the responses for key vary (see VaryHeaders), all variants are removed.
+	Returns false when there was nothing to remove locally.
+*/
+func (c *Cache) Invalidate(key string) bool {
+	removed, _ := c.invalidate(key)
+	return removed
+}
+
+/*
+	Remove is Invalidate reporting what went wrong: ErrNotFound when nothing was
+	cached locally under key, ErrStoreUnavailable when the shared tier couldn't
+	be updated (what was cached locally is removed all the same).
+*/
+func (c *Cache) Remove(key string) error {
+	removed, err := c.invalidate(key)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("%w: %s", ErrNotFound, c.redact(key))
+	}
+	return nil
+}
+
+/*
+	RemoveRequest removes the response Chain would serve the request from, see Remove.
+	It keys the request like Chain does, which takes a Keymaker (ErrKeyerRequired).
+	A request that isn't cached at all is ErrNotFound.
+*/
+func (c *Cache) RemoveRequest(r *http.Request) error {
+	if c.Keymaker == nil {
+		return ErrKeyerRequired
+	}
+	key, ok := c.key(c.settings(), discard{}, r)
+	if !ok {
+		return fmt.Errorf("%w: %s isn't cacheable", ErrNotFound, r.URL.Path)
+	}
+	return c.Remove(c.vary(key, r))
+}
+
+/*
+	RemoveMatching removes the responses whose keys match pattern (see path.Match),
+	from the shared tier too, and returns how many were removed locally.
+	A malformed pattern is ErrInvalidPattern, and nothing is removed.
+	The shared tier isn't searched, only keys cached locally are removed from it.
+*/
+func (c *Cache) RemoveMatching(pattern string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, fmt.Errorf("%w %q: %v", ErrInvalidPattern, pattern, err)
+	}
+
+	c.mu.RLock()
+	var keys []string
+	for key := range c.caches {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
 		}
+	}
+	c.mu.RUnlock()
 
-		// when ttd expires, cache is killed
-		time.Sleep(c.TTD)
-		exists, stale_id, fresh, regen := c.status(key)
-		if exists && !fresh && !regen {
-			if stale_id == id {
-				c.kill(key)
-			}
+	return c.invalidateAll(keys)
+}
+
+/*
+	invalidate removes key and its variants locally and from the shared tier.
+	removed tells whether something was cached locally, err whether the shared tier failed.
+*/
+func (c *Cache) invalidate(key string) (removed bool, err error) {
+	n, err := c.invalidateAll([]string{key})
+	return n > 0, err
+}
+
+/*
+	invalidateAll removes the keys and their variants, from the shared tier first
+	(in batches, if it can) so a concurrent miss can't bring them back from there.
+	Returns how many of the keys were cached locally.
+*/
+func (c *Cache) invalidateAll(keys []string) (removed int, err error) {
+	variants := make([][]string, len(keys))
+	all := make([]string, 0, len(keys))
+	for i, key := range keys {
+		variants[i] = c.variants(key)
+		for _, other := range c.methodKeys(key) {
+			// what other methods of key filled goes with it
+			variants[i] = append(variants[i], other)
+			variants[i] = append(variants[i], c.variants(other)...)
+		}
+		all = append(all, variants[i]...)
+		all = append(all, key)
+	}
+	c.fence(all)
+	err = c.unpublishAll(all)
+
+	for i, key := range keys {
+		found := false
+		for _, variant := range variants[i] {
+			found = c.kill(variant) || found
+		}
+		if c.kill(key) || found {
+			removed++
+		}
+	}
+	return removed, err
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////////
+// private parts
+///////////////////////////////////////////////////////////////////////////////////////////////////////
+
+/*
+	key derives the cache key of a request from the Keymaker (unless WithKey set it),
+	the KeyRewriter and, with a SubjectFunc, the subject of the request. Requests with another method
+	than GET get keys of their own (see methodMarker). ok is false when the request must not be cached,
+	which is the case for methods not in Methods, and also when either of them panics: a broken Keyer
+	shouldn't take the requests down with it.
+*/
+func (c *Cache) key(cfg *CacheConfig, w http.ResponseWriter, r *http.Request) (key string, ok bool) {
+
+	if !c.cacheableMethod(r.Method) {
+		return "", false
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("burstcache: panic while keying %s, passing the request through: %v", r.URL.Path, p)
+			key, ok = "", false
 		}
 	}()
 
+	key, ok = contextKeyOf(r)
+	if !ok {
+		key = c.Keymaker.Key(w, r)
+	}
+	if key != "" && c.KeyRewriter != nil {
+		key = c.KeyRewriter(key, r)
+	}
+	if key == "" || c.bypassRoute(key) {
+		return "", false
+	}
+
+	if c.SubjectFunc != nil {
+		subject := c.SubjectFunc(r)
+		if subject != "" {
+			key += "|sub=" + url.QueryEscape(subject)
+		} else if cfg.BypassAnonymous {
+			return "", false
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != "" {
+		// a HEAD is never answered with what a GET filled, nor the other way around
+		key += methodMarker + r.Method
+	}
+
+	return key, true
+}
+
+/*
+	methodMarker separates a key from the method of the requests it is for,
+	GET requests have none
+*/
+const methodMarker = "|method="
+
+/*
+	DefaultMethods are the methods whose requests are cached when Methods isn't set.
+	Unsafe methods (POST, PUT, DELETE, ...) must reach the handler every time, so
+	think twice before adding them.
+*/
+var DefaultMethods = []string{http.MethodGet, http.MethodHead}
+
+/*
+	methods returns the methods whose requests are cached
+*/
+func (c *Cache) methods() []string {
+	if c.Methods == nil {
+		return DefaultMethods
+	}
+	return c.Methods
+}
+
+/*
+	cacheableMethod reports whether requests with method are cached, "" is GET;
+	PURGE never is, whatever Methods lists, it is answered or passed through
+*/
+func (c *Cache) cacheableMethod(method string) bool {
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method == MethodPurge {
+		return false
+	}
+	for _, m := range c.methods() {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	methodKeys returns the keys of the requests for key with another cached method
+	than GET that are cached, or being filled, here
+*/
+func (c *Cache) methodKeys(key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var keys []string
+	for _, method := range c.methods() {
+		if method == http.MethodGet {
+			continue
+		}
+		k := key + methodMarker + method
+		if _, varies := c.dims[k]; c.caches[k] != nil || c.flights[k] != nil || varies {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (c *Cache) regenerate(cfg *CacheConfig, next http.Handler, key string, w http.ResponseWriter, r *http.Request) *ResponseCacher {
+
+	if c.RefreshHandler != nil {
+		next = c.RefreshHandler
+	}
+	start := time.Now()
+	cache := c.dedup(cfg, key, r, func() *ResponseCacher {
+		return c.fill(cfg, next, key, r, OriginRefresh, nil)
+	})
+	if c.refreshFailed(key, cache) {
+		// the stale response beats the error, see RefreshBackoff
+		c.event(key, DecisionBackoff, start)
+		return cache
+	}
+	c.refreshed(key)
+
+	c.keep(key, cache)
+	c.event(key, DecisionRefresh, start)
+
 	// success!
-	return
+	return cache
+}
+
+/*
+	Run the request through the handler into a new cache, by the settings cfg of
+	the request. When the body grows beyond MaxBodyBytes, the response is handed
+	over to spill (if not nil).
+*/
+func (c *Cache) fill(cfg *CacheConfig, next http.Handler, key string, r *http.Request, origin Origin, spill http.ResponseWriter) *ResponseCacher {
+
+	cache := NewResponseCacher(atomic.AddInt64(&c.gen, 1))
+	cache.origin = origin
+	cache.settings = cfg
+	cache.limit = cfg.MaxBodyBytes
+	cache.contentType = cfg.DefaultContentType
+	cache.spill = spill
+	cache.informational = c.ForwardInformational
+	cache.onLate = func() {
+		atomic.AddInt64(&c.stats.LateWrites, 1)
+		log.Printf("burstcache: the handler for %s wrote after it returned, the write is dropped", c.redact(key))
+	}
+	defer func() {
+		cache.spill = nil
+	}()
+
+	if c.SubjectFunc != nil {
+		cache.subject = c.SubjectFunc(r)
+	}
+	cache.ttl = c.requestTTL(cfg, r)
+	if c.RouteContentTypes != nil {
+		if types, ok := c.RouteContentTypes(r); ok {
+			cache.types = types
+		}
+	}
+	if c.HeadersOnly != nil && c.HeadersOnly(r) {
+		cache.headersOnly = true
+		if r.Method != http.MethodHead {
+			cache.onBody = func() {
+				log.Printf("burstcache: the handler for %s wrote a body while HeadersOnly, caching it with its body", c.redact(key))
+			}
+		}
+	}
+
+	// down the rabbit hole......
+	atomic.AddInt64(&c.inflight, 1)
+	start := time.Now()
+	next.ServeHTTP(cache, withFilling(r, c, key))
+	cache.freeze()
+	cache.settle()
+	c.tune(key, time.Since(start))
+	atomic.AddInt64(&c.inflight, -1)
+
+	// never replay header values that could split the response
+	cache.sanitize()
+	// nor the framing of the upstream response
+	cache.normalize()
+	// and keep one encoding of the body, whatever the upstream sent
+	cache.identity()
+	cache.captureTags()
+	c.dimensions(key, cache, r)
+
+	return cache
+}
+
+/*
+	passThrough hands a request the cache stays out of to next, with the very
+	ResponseWriter of the client: not wrapped (not even to measure it, see
+	MeasureTTFB), so nothing is buffered, copied or marked, and whatever else it
+	implements (http.Flusher, http.Hijacker, ...) works as without the cache.
+	Every decision to bypass the cache ends here.
+*/
+func (c *Cache) passThrough(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	next.ServeHTTP(w, r)
+}
+
+/*
+	Prepare a cache filled outside of Chain to be swapped in, as if it was filled by fill
+*/
+func (c *Cache) adopt(cache *ResponseCacher, origin Origin) {
+	cache.id = atomic.AddInt64(&c.gen, 1)
+	cache.origin = origin
+	cache.fresh = true
+	cache.regen = false
+	cache.freeze()
+	cache.settle()
+	cache.sanitize()
+	cache.normalize()
+	cache.identity()
+	cache.captureTags()
+}
+
+/*
+	Swap a filled cache in and schedule its expiration, or drop it when it isn't cacheable.
+	Returns false when key was invalidated while the cache was being filled: the
+	cache is history then and left out, see fence.
+*/
+func (c *Cache) keep(key string, cache *ResponseCacher) bool {
+
+	filled := key
+	if cache.variant != "" {
+		// it declared dimensions, keep it as the variant of its request
+		key = c.declare(key, cache)
+	}
+
+	if !c.cacheable(cache) {
+		// not worth keeping, also drop whatever stale result we had
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.fenced(filled, cache.id) {
+			// invalidated meanwhile, what is there now isn't ours to drop
+			return false
+		}
+		c.drop(key, CauseUncacheable)
+		return true
+	}
+
+	if c.Grouper != nil {
+		// for the route index, the route of what is kept under a variant is that of its key
+		cache.route = c.Grouper(filled)
+	}
+	// never replay the marker and debug headers of a cache in front of the handler
+	scrub(cache.Head, c.HealthHeader)
+	if cache.retryAt.IsZero() {
+		// counted from when it was stored, which for a shared entry may be a while ago, see ttlFor
+		if cache.stored.IsZero() {
+			cache.recordRetryAfter(c.now())
+		} else {
+			cache.recordRetryAfter(cache.stored)
+		}
+	}
+	if c.Digest {
+		// of the body as served, so before it is compressed
+		cache.digest()
+	}
+	c.compress(cache)
+
+	// swap stale with fresh result, this also schedules its expiration
+	if !c.swap(filled, key, cache) {
+		return false
+	}
+	atomic.AddInt64(&c.origins[cache.origin], 1)
+
+	// and share it with the other instances
+	c.publish(key, cache)
+	return true
+}
+
+/*
+	maxAge returns MaxAge minus a random jitter of at most MaxAgeJitter.
+	Clients that fetched at the same time will then not all come back at the same time.
+	Error responses (code 400 and up) get ErrorMaxAge instead, if set, without jitter:
+	it is short to begin with. ok is false when neither applies.
+*/
+func (c *Cache) maxAge(cfg *CacheConfig, code int) (age time.Duration, ok bool) {
+	age, jitter, errorAge := cfg.MaxAge, cfg.MaxAgeJitter, cfg.ErrorMaxAge
+	if code >= 400 && errorAge > 0 {
+		return errorAge, true
+	}
+	if age <= 0 {
+		return 0, false
+	}
+	if jitter > 0 {
+		age -= time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	if age < 0 {
+		return 0, true
+	}
+	return age, true
+}
+
+/*
+	Decide whether a freshly filled response is worth caching at all, by the settings it was filled by
+*/
+func (c *Cache) cacheable(cache *ResponseCacher) bool {
+	if cache.oversize || cache.shed || cache.unwritten && c.SkipUnwritten {
+		return false
+	}
+	if !cache.complete() {
+		// only what the handler returned from is whole, whatever it flushed before
+		return false
+	}
+	cfg := c.settingsOf(cache)
+	min, max := cfg.MinBodyBytes, cfg.MaxBodyBytes
+	if cache.stream != nil {
+		// the body isn't in hand, its length (if known) is all there is to go by
+		if n := cache.contentLength(); n >= 0 && (min > 0 && n < min || max > 0 && n > max) {
+			return false
+		}
+	} else {
+		if min > 0 && cache.Body.Len() < min && !cache.headersOnly {
+			return false
+		}
+		if max > 0 && cache.Body.Len() > max {
+			return false
+		}
+		if isNDJSON(cache.Head.Get("Content-Type")) && !completeNDJSON(cache.Body.Bytes()) {
+			return false
+		}
+	}
+	if cache.types != nil && !expected(cache.Head.Get("Content-Type"), cache.types) {
+		// not what the route answers with, e.g. the HTML error page of a proxy in between
+		return false
+	}
+	if varyAll(cache.Head) {
+		return false
+	}
+	if redirect(cache.Code) && len(cache.Head.Values("Set-Cookie")) > 0 {
+		// a redirect that sets a cookie is somebody's login or session, not a renamed resource
+		return false
+	}
+	if c.ShouldCacheBody != nil && cache.stream == nil && !c.ShouldCacheBody(cache.Body.Bytes(), cache.Head) {
+		return false
+	}
+	return true
+}
+
+/*
+	expected reports whether contentType is one of types, which may have a
+	wildcard for the subtype or for both, as OpenAPI has them
+*/
+func expected(contentType string, types []string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediatype || t == "*/*" || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediatype, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	redirect reports whether code is a redirect that names its target in Location
+*/
+func redirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
 }
 
 /*
-	Replace a stale cache with a newly filled response
+	varyAll reports whether the headers say Vary: *, the response depends on more
+	than the request headers and can't be served to anybody else (RFC 9110, section 12.5.5)
 */
-func (c *Cache) swap(key string, cache *ResponseCacher) {
+func varyAll(h http.Header) bool {
+	for _, val := range h.Values("Vary") {
+		for _, field := range strings.Split(val, ",") {
+			if strings.TrimSpace(field) == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+	Replace a stale cache with a newly filled response.
+
+	The new cache is complete and frozen before it gets here, and its headers and
+	body are never changed afterwards; only its state (fresh, regen, ...) is, under
+	the lock. Requests take the cache pointer once (see lookup) and serve from it,
+	so a response is always wholly the old or wholly the new generation.
+
+	A response filled (under key filled) since before an Invalidate of it isn't
+	swapped in, false tells so, see fence.
+*/
+func (c *Cache) swap(filled, key string, cache *ResponseCacher) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.fenced(filled, cache.id) {
+		return false
+	}
+	cache.rate, cache.counts = new(rate), new(keyCounts)
+	if old := c.caches[key]; old != nil {
+		// the rate and counts are those of the key, they carry over
+		cache.rate, cache.counts = old.rate, old.counts
+	}
+	if atomic.AddInt64(&cache.counts.generation, 1) == 1 {
+		cache.counts.access(c.now())
+	}
+	c.remove(key)
+	cache.key = key
+	if cache.origin != OriginRestore || cache.stored.IsZero() {
+		// a cache from the shared tier ages from when it was stored in the first place
+		cache.stored = c.now()
+	}
+	cache.size = estimate(key, cache)
 	c.caches[key] = cache
+	c.countVariant(key, 1)
+	c.bytes += int64(cache.size)
+	c.schedule(key, cache)
+	cache.use(cache.stored)
+	c.index(cache)
+	if cache.subject != "" {
+		c.limitSubject(cache)
+	}
+	c.evict(cache)
+	c.armSweep()
+	return true
+}
+
+/*
+	remove the cache from the map and from the byte accounting, the caller must hold the lock
+*/
+func (c *Cache) remove(key string) {
+	if cache := c.caches[key]; cache != nil {
+		disarm(cache)
+		c.bytes -= int64(cache.size)
+		c.unindex(cache)
+		c.countVariant(key, -1)
+	}
+	c.lru.drop(key)
+	delete(c.caches, key)
+}
+
+/*
+	drop removes the cache for good, counting why. Returns whether there was one.
+	The caller must hold the lock.
+*/
+func (c *Cache) drop(key string, cause Cause) bool {
+	if c.caches[key] == nil {
+		return false
+	}
+	c.remove(key)
+	delete(c.backoffs, key)
+	c.forgetDimensions(key)
+	atomic.AddInt64(&c.removals[cause], 1)
+	return true
 }
 
 /*
-	Mark the cache as stale. In this state a subsequent request may start a regeneration.
+	Whether a stale cache has been stale for RefreshDelay, so a refresh may be triggered.
+	This keeps very hot keys from all refreshing the instant they go stale.
 */
-func (c *Cache) stale(key string) {
+func (c *Cache) refreshDue(cfg *CacheConfig, cache *ResponseCacher) bool {
+	if cfg.RefreshDelay <= 0 {
+		return true
+	}
+	c.mu.RLock()
+	staled := cache.staled
+	c.mu.RUnlock()
+	return c.now().Sub(staled) >= cfg.RefreshDelay
+}
+
+/*
+	kill the cache, removing the response completely from the map.
+	Returns whether there was a cache to kill.
+*/
+func (c *Cache) kill(key string) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.caches[key].fresh = false
+	return c.drop(key, CauseInvalidated)
 }
 
 /*
-	kill the cache, removing the response completely from the map
+	kill the cache, but only if it is still the given generation
 */
-func (c *Cache) kill(key string) {
+func (c *Cache) killGeneration(key string, id int64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.caches[key] = nil
+	if cache := c.caches[key]; cache != nil && cache.id == id {
+		c.drop(key, CauseDied)
+	}
 }
 
 /*
@@ -165,27 +1106,153 @@ func (c *Cache) kill(key string) {
 func (c *Cache) regen(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.caches[key].regen = true
+	if cache := c.caches[key]; cache != nil {
+		cache.regen = true
+	}
 }
 
 /*
 	serve the cached response as an actual response.
 	When mark==true a header will be set to mark the response as a cached one.
+	The returned error reports whether the body could be written.
+
+	All header work is done before the status goes out. Once it has, a panic
+	(e.g. from a wrapping ResponseWriter) is logged and turned into an aborted
+	connection, so the client can never mistake a half written body for a whole one.
 */
-func (c *Cache) serve(key string, w http.ResponseWriter, mark bool) {
+func (c *Cache) serve(cfg *CacheConfig, w http.ResponseWriter, cache *ResponseCacher, mark bool) error {
+	now := c.now()
+	atomic.AddInt64(&cache.serves, 1)
+	cache.rate.hit(now, c.rateBucket())
+	cache.use(now)
+	cache.counts.access(now)
+	if cache.subject != "" {
+		c.touch(cache)
+	}
+
+	cache.copyHeader(w.Header(), mark)
+	if mark {
+		c.detail(w.Header(), cache)
+	}
+	if age, ok := c.maxAge(cfg, cache.Code); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", age/time.Second))
+	}
+	if !cache.retryAt.IsZero() {
+		w.Header().Set("Retry-After", cache.retryAfter(now))
+	}
+	if cache.sum != "" {
+		w.Header().Set("Digest", "sha-256="+cache.sum)
+	}
+	if c.HealthHeader != "" {
+		w.Header().Set(c.HealthHeader, c.Health().Status.String())
+	}
+	if c.AgeHeaders {
+		c.age(w.Header(), cache, now)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("burstcache: panic while writing the cached response for %s, aborting it: %v", c.redact(cache.key), p)
+			panic(http.ErrAbortHandler)
+		}
+	}()
+	return cache.write(w)
+}
+
+/*
+	lookup returns the cache stored under key (nil if there is none) together
+	with its freshness and regeneration state, all read under the same lock.
+	A cache is never modified after it has been swapped in (apart from
+	its state flags), so it can be served after the lock is released.
+
+	When a Freshness hook is set, it overrides the freshness of the cache.
+	A cache it declares dead is killed on the spot and reported missing.
+*/
+func (c *Cache) lookup(key string) (cache *ResponseCacher, fresh bool, regen bool) {
+	c.mu.RLock()
+	cache = c.caches[key]
+	if cache == nil {
+		c.mu.RUnlock()
+		return nil, false, false
+	}
+	fresh, regen = cache.fresh, cache.regen
+	if c.Freshness == nil {
+		c.mu.RUnlock()
+		return cache, fresh, regen
+	}
+	meta := cache.meta()
+	c.mu.RUnlock()
+
+	switch c.Freshness(meta) {
+	case Fresh:
+		fresh = true
+	case Stale:
+		fresh = false
+	case Dead:
+		c.killGeneration(key, cache.id)
+		return nil, false, false
+	}
+	return cache, fresh, regen
+}
+
+/*
+	recheck re-reads the cache right before it is served. When a newer generation
+	was swapped in since the serving decision was made, that one is served instead.
+	This is checked exactly once, so a key that is swapped continuously can't keep
+	a request from being served.
+*/
+func (c *Cache) recheck(key string, cache *ResponseCacher, fresh bool) (*ResponseCacher, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	current := c.caches[key]
+	if current != nil && current.id > cache.id {
+		return current, current.fresh
+	}
+	return cache, fresh
+}
+
+/*
+	InFlight returns how many regenerations, cold fills and background refreshes
+	alike, are running right now
+*/
+func (c *Cache) InFlight() int {
+	return int(atomic.LoadInt64(&c.inflight))
+}
+
+/*
+	Generation returns the id of the cache currently stored under key.
+	Ids increase with every regeneration, so comparing two of them tells
+	how many times the cache was (at most) regenerated in between.
+*/
+func (c *Cache) Generation(key string) (id int64, ok bool) {
+	exists, id, _, _ := c.status(key)
+	return id, exists
+}
+
+/*
+	meta returns the CacheMeta of a cache, if it exists
+*/
+func (c *Cache) meta(key string) (CacheMeta, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	c.caches[key].Serve(w, mark)
+	cache, ok := c.caches[key]
+	if ok && cache != nil {
+		return cache.meta(), true
+	}
+	return CacheMeta{}, false
 }
 
 /*
 	status returns
 	- whether a cache exists (initialized)
-	- its id (unique identifier)
+	- its id (unique, increasing with every regeneration)
 	- is still fresh
 	- is being regenerated
 */
-func (c *Cache) status(key string) (exists bool, id int, fresh bool, regen bool) {
+func (c *Cache) status(key string) (exists bool, id int64, fresh bool, regen bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	cache, ok := c.caches[key]
@@ -0,0 +1,1005 @@
+package burstcache
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	counting is a handler writing body, counting how often it is called
+*/
+type counting struct {
+	body  string
+	calls int32
+}
+
+func (h *counting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.calls, 1)
+	w.Write([]byte(h.body))
+}
+
+func (h *counting) count() int {
+	return int(atomic.LoadInt32(&h.calls))
+}
+
+/*
+	get sends a GET for path through h
+*/
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestMinBodyBytes(t *testing.T) {
+	small, large := &counting{body: "tiny"}, &counting{body: "large enough to cache"}
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MinBodyBytes = 10
+	for i := 0; i < 3; i++ {
+		if rec := get(c.Chain(small), "/small"); rec.Body.String() != "tiny" {
+			t.Fatalf("served %q", rec.Body.String())
+		}
+		if rec := get(c.Chain(large), "/large"); rec.Body.String() != "large enough to cache" {
+			t.Fatalf("served %q", rec.Body.String())
+		}
+	}
+	if n := small.count(); n != 3 {
+		t.Fatalf("%d calls for a body below MinBodyBytes, want every request passed through", n)
+	}
+	if n := large.count(); n != 1 {
+		t.Fatalf("%d calls for a body above MinBodyBytes, want it cached", n)
+	}
+	if _, ok := c.Peek("/small"); ok {
+		t.Fatal("the body below MinBodyBytes was cached")
+	}
+}
+
+/*
+	keyerFunc is a Keyer made of a function
+*/
+type keyerFunc func(r *http.Request) string
+
+func (f keyerFunc) Key(w http.ResponseWriter, r *http.Request) string {
+	return f(r)
+}
+
+func TestGenerationAdvancesOncePerBurst(t *testing.T) {
+	backend := &counting{body: "body"}
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	h := c.Chain(backend)
+	get(h, "/x")
+	before, ok := c.Generation("/x")
+	if !ok {
+		t.Fatal("/x isn't cached")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(h, "/x")
+		}()
+	}
+	wg.Wait()
+	waitIdle(t, c)
+
+	after, _ := c.Generation("/x")
+	if after != before+1 {
+		t.Fatalf("generation went from %d to %d in a burst on a stale entry, want one refresh", before, after)
+	}
+	if n := backend.count(); n != 2 {
+		t.Fatalf("%d handler calls, want the fill and one refresh", n)
+	}
+	if _, ok := c.Generation("/missing"); ok {
+		t.Fatal("a generation for a key that isn't cached")
+	}
+}
+
+/*
+	pausingStore holds the first read of a refresh backoff until released,
+	which pauses a request between looking its entry up and serving it
+*/
+type pausingStore struct {
+	*MemoryStore
+	once             sync.Once
+	paused, released chan struct{}
+}
+
+func (s *pausingStore) Get(key string) ([]byte, bool, error) {
+	if strings.HasSuffix(key, backoffMarker) {
+		s.once.Do(func() {
+			close(s.paused)
+			<-s.released
+		})
+	}
+	return s.MemoryStore.Get(key)
+}
+
+func TestServesGenerationSwappedInMeanwhile(t *testing.T) {
+	store := &pausingStore{MemoryStore: NewMemoryStore(), paused: make(chan struct{}), released: make(chan struct{})}
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	c.Shared = store
+	c.RefreshBackoff = time.Second
+	h := c.Chain(&counting{body: "refreshed"})
+	c.Store("/x", filled("old"))
+	time.Sleep(10 * time.Millisecond)
+
+	served := make(chan string)
+	go func() {
+		served <- get(h, "/x").Body.String()
+	}()
+	<-store.paused
+	// the request decided on the stale "old", now a newer generation lands
+	c.Store("/x", filled("new"))
+	close(store.released)
+
+	if body := <-served; body != "new" {
+		t.Fatalf("served %q, want the generation swapped in after the lookup", body)
+	}
+	waitIdle(t, c)
+}
+
+func TestMaxAgeJitter(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MaxAge = 100 * time.Second
+	c.MaxAgeJitter = 50 * time.Second
+	h := c.Chain(&counting{body: "body"})
+	seen := map[int]bool{}
+	for i := 0; i < 200; i++ {
+		header := get(h, "/x").Header().Get("Cache-Control")
+		var age int
+		if _, err := fmt.Sscanf(header, "max-age=%d", &age); err != nil {
+			t.Fatalf("Cache-Control %q: %v", header, err)
+		}
+		if age < 50 || age > 100 {
+			t.Fatalf("max-age %d outside MaxAge minus up to MaxAgeJitter", age)
+		}
+		seen[age] = true
+	}
+	if len(seen) < 10 {
+		t.Fatalf("%d distinct max-ages in 200 serves, want them spread over the jitter band", len(seen))
+	}
+
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.MaxAgeJitter = 0 })
+	if header := get(h, "/x").Header().Get("Cache-Control"); header != "max-age=100" {
+		t.Fatalf("Cache-Control %q without jitter, want max-age=100", header)
+	}
+}
+
+func TestErrorMaxAge(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MaxAge = time.Minute
+	c.MaxAgeJitter = 30 * time.Second
+	c.ErrorMaxAge = 5 * time.Second
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("body"))
+	}))
+	get(h, "/gone")
+	for i := 0; i < 20; i++ {
+		// without jitter
+		if rec := get(h, "/gone"); rec.Code != http.StatusNotFound || rec.Header().Get("Cache-Control") != "max-age=5" {
+			t.Fatalf("cached 404 served %d with Cache-Control %q, want max-age=5", rec.Code, rec.Header().Get("Cache-Control"))
+		}
+	}
+
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.MaxAgeJitter = 0 })
+	get(h, "/ok")
+	if header := get(h, "/ok").Header().Get("Cache-Control"); header != "max-age=60" {
+		t.Fatalf("cached 200 served with Cache-Control %q, want max-age=60", header)
+	}
+}
+
+func TestWithoutKeymaker(t *testing.T) {
+	c := NewCache(nil, nil, 5*time.Millisecond, time.Hour)
+
+	var fills int32
+	fill := func() *ResponseCacher {
+		atomic.AddInt32(&fills, 1)
+		return filled("filled")
+	}
+	for i := 0; i < 3; i++ {
+		if got := c.GetOrFill("k", fill); got.Body.String() != "filled" {
+			t.Fatalf("GetOrFill returned %q", got.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&fills); n != 1 {
+		t.Fatalf("%d fills, want the later calls served from the cache", n)
+	}
+
+	if err := c.Store("s", filled("stored")); err != nil {
+		t.Fatalf("Store refused a response: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	if !c.ServeCached("s", rec) || rec.Body.String() != "stored" || rec.Header().Get(markerHeader) == "" {
+		t.Fatalf("ServeCached served %q, headers %v", rec.Body.String(), rec.Header())
+	}
+	if c.ServeCached("missing", httptest.NewRecorder()) {
+		t.Fatal("ServeCached served a key that isn't cached")
+	}
+
+	// stale, GetOrFill refreshes it in the background
+	time.Sleep(10 * time.Millisecond)
+	c.GetOrFill("k", fill)
+	waitIdle(t, c)
+	if meta, _ := c.Peek("k"); !meta.Fresh || atomic.LoadInt32(&fills) != 2 {
+		t.Fatalf("fresh %v after %d fills, want the stale response refreshed once", meta.Fresh, fills)
+	}
+
+	if !c.Invalidate("k") || c.Invalidate("k") {
+		t.Fatal("Invalidate doesn't report what it removed")
+	}
+	if err := c.RemoveRequest(httptest.NewRequest("GET", "/s", nil)); !errors.Is(err, ErrKeyerRequired) {
+		t.Fatalf("RemoveRequest without a Keymaker: %v", err)
+	}
+	if rec := get(c.Chain(&counting{}), "/s"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Chain without a Keymaker answered %d", rec.Code)
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["X-Evil"] = []string{"a\r\nSet-Cookie: pwned=1"}
+		w.Header()["X-Bad\r\nName"] = []string{"b"}
+		w.Write([]byte("body"))
+	})
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	served := c.Chain(h)
+	get(served, "/page")
+
+	rec := httptest.NewRecorder()
+	if !c.ServeCached("/page", rec) {
+		t.Fatal("/page isn't cached")
+	}
+	if got := rec.Header().Get("X-Evil"); got != "aSet-Cookie: pwned=1" {
+		t.Fatalf("served X-Evil %q, want CR and LF stripped", got)
+	}
+	for name := range rec.Header() {
+		if strings.ContainsAny(name, "\r\n") {
+			t.Fatalf("served header name %q", name)
+		}
+	}
+	if wire := raw(t, served, "/page"); strings.Contains(wire, "\r\nSet-Cookie") || !strings.HasSuffix(wire, "\r\n\r\nbody") {
+		t.Fatalf("the cached response was split:\n%q", wire)
+	}
+}
+
+func TestFreshnessByServes(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Freshness = func(meta CacheMeta) State {
+		if meta.Serves >= 3 {
+			return Stale
+		}
+		return Fresh
+	}
+	h := &counting{body: "body"}
+	served := c.Chain(h)
+
+	get(served, "/a")
+	for i := 0; i < 3; i++ {
+		get(served, "/a")
+	}
+	if h.count() != 1 {
+		t.Fatalf("%d upstream calls within 3 serves, want 1", h.count())
+	}
+	if rec := get(served, "/a"); rec.Body.String() != "body" {
+		t.Fatalf("served %q once stale", rec.Body.String())
+	}
+	waitIdle(t, c)
+	if h.count() != 2 {
+		t.Fatalf("%d upstream calls after 3 serves, want the entry refreshed", h.count())
+	}
+	if meta, _ := c.Peek("/a"); meta.Serves != 0 || meta.Origin != OriginRefresh {
+		t.Fatalf("after the refresh %+v", meta)
+	}
+
+	// dead ones are filled anew, not served
+	c.Freshness = func(meta CacheMeta) State { return Dead }
+	get(served, "/a")
+	if h.count() != 3 {
+		t.Fatalf("%d upstream calls, want the dead entry filled anew", h.count())
+	}
+}
+
+func TestGetOrFillCollapses(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	var fills int32
+	release := make(chan struct{})
+	fill := func() *ResponseCacher {
+		atomic.AddInt32(&fills, 1)
+		<-release
+		return filled("shared")
+	}
+
+	var wg sync.WaitGroup
+	got := make([]*ResponseCacher, 50)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i] = c.GetOrFill("k", fill)
+		}(i)
+	}
+	// let them all pile up on the one fill
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fills); n != 1 {
+		t.Fatalf("fill ran %d times for 50 concurrent callers", n)
+	}
+	for i, cache := range got {
+		if cache != got[0] || cache.Body.String() != "shared" {
+			t.Fatalf("caller %d got %q, not the one fill", i, cache.Body.String())
+		}
+	}
+}
+
+func TestAccess(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	c := NewCache(nil, nil, time.Second, time.Second)
+	c.Clock = clock
+	c.RefreshDelay = 100 * time.Millisecond
+	access := func(wantState State, wantRefresh bool) {
+		t.Helper()
+		if state, refresh := c.Access("/a"); state != wantState || refresh != wantRefresh {
+			t.Fatalf("at %v: %v refreshing %v, want %v refreshing %v", clock.Now().Unix(), state, refresh, wantState, wantRefresh)
+		}
+	}
+
+	access(Dead, false)
+	c.Store("/a", filled("x"))
+	access(Fresh, false)
+	clock.Advance(time.Second)
+	// stale, but not for RefreshDelay yet
+	access(Stale, false)
+	clock.Advance(100 * time.Millisecond)
+	access(Stale, true)
+	access(Stale, false)
+	if meta, _ := c.Peek("/a"); !meta.Regen || !meta.Staled.Equal(time.Unix(1, 0)) {
+		t.Fatalf("refreshing: %+v", meta)
+	}
+	// lives on past its time to die until the refresh comes in
+	clock.Advance(time.Hour)
+	access(Stale, false)
+	c.Store("/a", filled("y"))
+	access(Fresh, false)
+	clock.Advance(2 * time.Second)
+	access(Dead, false)
+}
+
+/*
+	panicking is a ResponseWriter panicking on WriteHeader or on Write, as phase says
+*/
+type panicking struct {
+	http.ResponseWriter
+	phase string
+}
+
+func (w *panicking) WriteHeader(code int) {
+	if w.phase == "WriteHeader" {
+		panic("boom")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *panicking) Write(b []byte) (int, error) {
+	if w.phase == "Write" {
+		panic("boom")
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func TestPanicWhileServingAborts(t *testing.T) {
+	logged := captureLog(t)
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Store("/a", filled("body"))
+	cached := c.Chain(&counting{body: "body"})
+
+	for _, phase := range []string{"WriteHeader", "Write"} {
+		logged.Reset()
+		func() {
+			defer func() {
+				if p := recover(); p != http.ErrAbortHandler {
+					t.Errorf("%s: panicked with %v, want http.ErrAbortHandler", phase, p)
+				}
+			}()
+			c.ServeCached("/a", &panicking{httptest.NewRecorder(), phase})
+		}()
+		if !strings.Contains(logged.String(), "panic while writing the cached response for /a") {
+			t.Errorf("%s: logged %q", phase, logged.String())
+		}
+
+		// over the wire, the client sees the connection drop rather than a status
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cached.ServeHTTP(&panicking{w, phase}, r)
+		})
+		if wire := raw(t, h, "/a"); wire != "" {
+			t.Errorf("%s: the client got %q", phase, wire)
+		}
+	}
+}
+
+func TestMayFill(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MayFill = func(r *http.Request) bool { return r.Header.Get("X-Warmer") != "" }
+	h := &counting{body: "body"}
+	served := c.Chain(h)
+
+	if rec := get(served, "/a"); rec.Body.String() != "body" {
+		t.Fatalf("a client missing got %q", rec.Body.String())
+	}
+	if _, ok := c.Peek("/a"); ok {
+		t.Fatal("a client's cold miss filled the cache")
+	}
+
+	warm := httptest.NewRequest("GET", "/a", nil)
+	warm.Header.Set("X-Warmer", "1")
+	served.ServeHTTP(httptest.NewRecorder(), warm)
+	if _, ok := c.Peek("/a"); !ok {
+		t.Fatal("the warmer's cold miss didn't fill the cache")
+	}
+	if rec := get(served, "/a"); rec.Header().Get(markerHeader) == "" || h.count() != 2 {
+		t.Fatalf("%d upstream calls, want clients served what the warmer filled", h.count())
+	}
+}
+
+func TestRecursionPassesThrough(t *testing.T) {
+	logged := captureLog(t)
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	var h http.Handler
+	// a subrequest through the same cache, as a handler behind it might make
+	sub := func(r *http.Request, path string) string {
+		inner := httptest.NewRequest("GET", path, nil).WithContext(r.Context())
+		inner.Header.Set("X-Inner", "1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, inner)
+		return rec.Body.String()
+	}
+	h = c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Inner") != "" {
+			fmt.Fprint(w, "leaf", r.URL.Path)
+			return
+		}
+		fmt.Fprintf(w, "%s(%s,%s)", r.URL.Path, sub(r, "/b"), sub(r, "/a"))
+	}))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(h, "/a") }()
+	select {
+	case rec := <-done:
+		if rec.Body.String() != "/a(leaf/b,leaf/a)" {
+			t.Fatalf("served %q", rec.Body.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the fill of /a deadlocked waiting on itself")
+	}
+	if n := c.Stats().Recursions; n != 1 {
+		t.Fatalf("%d recursions, want the one for /a, not the one for /b", n)
+	}
+	if _, ok := c.Peek("/b"); !ok {
+		t.Fatal("the nested request for another key wasn't cached")
+	}
+	if !strings.Contains(logged.String(), "request for /a while filling it") {
+		t.Fatalf("no warning, logged %q", logged.String())
+	}
+}
+
+/*
+	panicKeyer is a buggy Keyer
+*/
+type panicKeyer struct{}
+
+func (panicKeyer) Key(w http.ResponseWriter, r *http.Request) string {
+	panic("boom")
+}
+
+func TestPanickingKeyerPassesThrough(t *testing.T) {
+	logged := captureLog(t)
+	c := NewCache(panicKeyer{}, nil, time.Second, time.Second)
+	h := &counting{body: "ok"}
+	if rec := get(c.Chain(h), "/a"); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("answered %d %q", rec.Code, rec.Body.String())
+	}
+	if h.count() != 1 || c.Stats().Entries != 0 {
+		t.Fatalf("%d upstream calls, %d entries, want the request passed through", h.count(), c.Stats().Entries)
+	}
+	if !strings.Contains(logged.String(), "panic while keying /a") || !strings.Contains(logged.String(), "boom") {
+		t.Fatalf("the panic wasn't logged: %q", logged.String())
+	}
+}
+
+func TestChunkedUpstreamNormalized(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	srv := httptest.NewServer(c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("Trailer", "X-Checksum")
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("part"))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Checksum", "abc")
+	})))
+	defer srv.Close()
+
+	for _, want := range []string{"miss", "hit"} {
+		resp, err := http.Get(srv.URL + "/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "partpartpart" {
+			t.Fatalf("%s: read %q, %v", want, body, err)
+		}
+		if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) != 0 || resp.Header.Get("Trailer") != "" {
+			t.Fatalf("%s: Content-Length %d, Transfer-Encoding %v, Trailer %q; want it replayed with a length of its own",
+				want, resp.ContentLength, resp.TransferEncoding, resp.Header.Get("Trailer"))
+		}
+		if cached := resp.Header.Get(markerHeader) != ""; cached != (want == "hit") {
+			t.Fatalf("%s: served from the cache %v", want, cached)
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.DefaultContentType = "application/json"
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/typed" {
+			w.Header().Set("Content-Type", "text/csv")
+		}
+		w.Write([]byte("{}"))
+	}))
+
+	for _, tc := range []struct{ path, want string }{{"/untyped", "application/json"}, {"/typed", "text/csv"}} {
+		for _, served := range []string{"filled", "cached"} {
+			if got := get(h, tc.path).Header().Get("Content-Type"); got != tc.want {
+				t.Fatalf("%s %s with Content-Type %q, want %q", served, tc.path, got, tc.want)
+			}
+		}
+		c.mu.RLock()
+		got := c.caches[tc.path].Head.Get("Content-Type")
+		c.mu.RUnlock()
+		if got != tc.want {
+			t.Fatalf("%s stored with Content-Type %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestLateWritesDropped(t *testing.T) {
+	logged := captureLog(t)
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("good"))
+		// a buggy handler writing on after it returned
+		go func() {
+			defer wg.Done()
+			time.Sleep(10 * time.Millisecond)
+			if _, err := w.Write([]byte("LATE")); !errors.Is(err, ErrLateWrite) {
+				t.Errorf("the late write returned %v", err)
+			}
+		}()
+	}))
+	if rec := get(h, "/x"); rec.Body.String() != "good" {
+		t.Fatalf("the filling request got %q", rec.Body.String())
+	}
+	wg.Wait()
+
+	if rec := get(h, "/x"); rec.Body.String() != "good" {
+		t.Fatalf("served %q from the cache, want the late bytes left out", rec.Body.String())
+	}
+	if n := c.Stats().LateWrites; n != 1 {
+		t.Fatalf("%d late writes counted", n)
+	}
+	if !strings.Contains(logged.String(), "the handler for /x wrote after it returned") {
+		t.Fatalf("the key wasn't logged: %q", logged.String())
+	}
+}
+
+func TestSwapServesWholeGenerations(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Compress = true
+	stop := make(chan struct{})
+	var swapper sync.WaitGroup
+	swapper.Add(1)
+	go func() {
+		defer swapper.Done()
+		for gen := 0; ; gen++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// every generation has a header and a body of a length of its own
+			rc := NewResponseCacher(0)
+			rc.Header().Set("X-Gen", fmt.Sprint(gen))
+			rc.Write([]byte(strings.Repeat(fmt.Sprint(gen, ","), gen%50+1)))
+			c.Store("/k", rc)
+		}
+	}()
+
+	var servers sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			for n := 0; n < 1000; n++ {
+				rec := httptest.NewRecorder()
+				if !c.ServeCached("/k", rec) {
+					continue
+				}
+				var gen int
+				fmt.Sscan(rec.Header().Get("X-Gen"), &gen)
+				want := strings.Repeat(fmt.Sprint(gen, ","), gen%50+1)
+				if body := rec.Body.String(); body != want || rec.Header().Get("Content-Length") != fmt.Sprint(len(want)) {
+					t.Errorf("generation %d served with Content-Length %s and body %.20q", gen, rec.Header().Get("Content-Length"), body)
+					return
+				}
+			}
+		}()
+	}
+	servers.Wait()
+	close(stop)
+	swapper.Wait()
+}
+
+func TestKeyRewriter(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	// users are split into two experiment arms by their id
+	c.KeyRewriter = func(key string, r *http.Request) string {
+		var id int
+		fmt.Sscan(r.Header.Get("X-User"), &id)
+		return fmt.Sprintf("%s|arm=%d", key, id%2)
+	}
+	served := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "page for user ", r.Header.Get("X-User"))
+	}))
+	as := func(user string) string {
+		r := httptest.NewRequest("GET", "/page", nil)
+		r.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		served.ServeHTTP(rec, r)
+		return rec.Body.String()
+	}
+
+	for _, user := range []string{"1", "2", "3", "4"} {
+		as(user)
+	}
+	if got := as("5"); got != "page for user 1" {
+		t.Fatalf("user 5 got %q, want the entry of its arm, filled by user 1", got)
+	}
+	if got := as("6"); got != "page for user 2" {
+		t.Fatalf("user 6 got %q, want the entry of its arm, filled by user 2", got)
+	}
+	if c.Stats().Entries != 2 {
+		t.Fatalf("%d entries, want one per arm", c.Stats().Entries)
+	}
+	for _, key := range []string{"/page|arm=0", "/page|arm=1"} {
+		if _, ok := c.Peek(key); !ok {
+			t.Fatalf("no entry under %s", key)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	for _, code := range []int{301, 302, 307, 308} {
+		c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+		var calls int32
+		h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Add("Link", "<a>")
+			w.Header().Add("Link", "<b>")
+			w.Header().Set("Location", "/new?a=1&b=%20")
+			w.WriteHeader(code)
+		}))
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+			if links := rec.Header().Values("Link"); rec.Code != code || rec.Header().Get("Location") != "/new?a=1&b=%20" || len(links) != 2 || links[1] != "<b>" {
+				t.Fatalf("%d, request %d: served %d with %v", code, i, rec.Code, rec.Header())
+			}
+		}
+		if calls != 1 {
+			t.Fatalf("%d: %d upstream calls, want the redirect cached", code, calls)
+		}
+	}
+
+	// a redirect setting a cookie is for one user
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Set-Cookie", "s=1")
+		http.Redirect(w, r, "/home", http.StatusFound)
+	}))
+	get(h, "/x")
+	get(h, "/x")
+	if calls != 2 {
+		t.Fatalf("%d upstream calls, a redirect with Set-Cookie was cached", calls)
+	}
+
+	// redirects live as long as StatusTTL says
+	c = NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.StatusTTL = map[int]time.Duration{http.StatusMovedPermanently: time.Millisecond}
+	h = c.Chain(http.RedirectHandler("/new", http.StatusMovedPermanently))
+	get(h, "/x")
+	meta, ok := c.Peek("/x")
+	for deadline := time.Now().Add(time.Second); ok && meta.Fresh && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		meta, ok = c.Peek("/x")
+	}
+	if !ok || meta.Fresh {
+		t.Fatalf("a 301 is fresh past its StatusTTL, cached %v", ok)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	body := strings.Repeat("hello world ", 100)
+	sum := sha256.Sum256([]byte(body))
+	want := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	for _, compress := range []bool{false, true} {
+		c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+		c.Compress = compress
+		h := c.Chain(&counting{body: body})
+		if rec := get(h, "/x"); rec.Header().Get("Digest") != "" {
+			t.Fatalf("Compress %v: Digest %q without Digest set", compress, rec.Header().Get("Digest"))
+		}
+
+		c = NewCache(&Keymaker{}, nil, time.Second, time.Second)
+		c.Compress = compress
+		c.Digest = true
+		h = c.Chain(&counting{body: body})
+		for i := 0; i < 2; i++ {
+			rec := get(h, "/x")
+			if rec.Body.String() != body || rec.Header().Get("Digest") != want {
+				t.Fatalf("Compress %v, request %d: Digest %q, want %q", compress, i, rec.Header().Get("Digest"), want)
+			}
+		}
+	}
+}
+
+/*
+	statuses records every status written to it, informational ones included
+*/
+type statuses struct {
+	*httptest.ResponseRecorder
+	written []int
+}
+
+func (s *statuses) WriteHeader(code int) {
+	s.written = append(s.written, code)
+	s.ResponseRecorder.WriteHeader(code)
+}
+
+func TestEarlyHints(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+		c.ForwardInformational = forward
+		h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", "</a.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("body"))
+		}))
+		rec := &statuses{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+		want := []int{http.StatusOK}
+		if forward {
+			want = []int{http.StatusEarlyHints, http.StatusOK}
+		}
+		if fmt.Sprint(rec.written) != fmt.Sprint(want) || rec.Body.String() != "body" {
+			t.Fatalf("ForwardInformational %v: the fill wrote %v %q, want %v", forward, rec.written, rec.Body.String(), want)
+		}
+		// the entry is the final response
+		if rec := get(h, "/x"); rec.Code != http.StatusOK || rec.Body.String() != "body" {
+			t.Fatalf("ForwardInformational %v: replayed %d %q", forward, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestHeadersOnly(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.HeadersOnly = func(r *http.Request) bool { return r.URL.Path == "/ack" || r.URL.Path == "/misconfigured" }
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-RateLimit-Remaining", "9")
+		w.WriteHeader(http.StatusNoContent)
+		// discarded, but counted for the handler
+		if n, err := w.Write([]byte("ignored")); n != 7 || err != nil {
+			t.Errorf("Write returned %d, %v", n, err)
+		}
+	}))
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/ack", nil))
+		if rec.Code != http.StatusNoContent || rec.Header().Get("X-RateLimit-Remaining") != "9" || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "" {
+			t.Fatalf("request %d: served %d %v %q", i, rec.Code, rec.Header(), rec.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("%d upstream calls, want the 204 cached", calls)
+	}
+
+	// a route that does write bodies is warned about, and cached with its body
+	logs := captureLog(t)
+	h = c.Chain(&counting{body: "body"})
+	for i := 0; i < 2; i++ {
+		if rec := get(h, "/misconfigured"); rec.Body.String() != "body" {
+			t.Fatalf("request %d: served %q", i, rec.Body.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "HeadersOnly") {
+		t.Fatalf("no warning logged: %q", logs.String())
+	}
+}
+
+func TestFlushMidResponse(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("part1,"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("part2"))
+	}))
+	for i := 0; i < 2; i++ {
+		if rec := get(h, "/f"); rec.Body.String() != "part1,part2" {
+			t.Fatalf("request %d: served %q", i, rec.Body.String())
+		}
+	}
+	if meta, ok := c.Peek("/f"); !ok || meta.Size != len("part1,part2") {
+		t.Fatalf("cached %v with %d bytes, want the whole body", ok, meta.Size)
+	}
+}
+
+func TestHandlerWritesNothing(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+		c.SkipUnwritten = skip
+		var calls int32
+		h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+		}))
+		for i := 0; i < 2; i++ {
+			if rec := get(h, "/e"); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+				t.Fatalf("SkipUnwritten %v, request %d: served %d %q, want an empty 200", skip, i, rec.Code, rec.Body.String())
+			}
+		}
+		want := int32(1)
+		if skip {
+			want = 2
+		}
+		if calls != want {
+			t.Fatalf("SkipUnwritten %v: %d upstream calls, want %d", skip, calls, want)
+		}
+	}
+}
+
+func TestRefreshHandler(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 10*time.Millisecond, time.Hour)
+	replica := &counting{body: "replica"}
+	c.RefreshHandler = replica
+	primary := &counting{body: "primary"}
+	h := c.Chain(primary)
+	get(h, "/r")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if meta, _ := c.Peek("/r"); !meta.Fresh {
+			break
+		}
+	}
+	get(h, "/r")
+	waitIdle(t, c)
+	if rec := get(h, "/r"); primary.count() != 1 || replica.count() != 1 || rec.Body.String() != "replica" {
+		t.Fatalf("%d cold fills, %d refreshes by the RefreshHandler, serving %q", primary.count(), replica.count(), rec.Body.String())
+	}
+}
+
+func TestHeadKeyedApart(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-Method", r.Method)
+		if r.Method != http.MethodHead {
+			w.Write([]byte("body"))
+		}
+	}))
+	head := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/m", nil))
+		return rec
+	}
+	head()
+	if rec := get(h, "/m"); calls != 2 || rec.Body.String() != "body" || rec.Header().Get("X-Method") != "GET" {
+		t.Fatalf("%d upstream calls, the GET after a HEAD served %q from %s", calls, rec.Body.String(), rec.Header().Get("X-Method"))
+	}
+	if rec := head(); calls != 2 || rec.Header().Get("X-Method") != "HEAD" {
+		t.Fatalf("%d upstream calls, the HEAD served the entry of %s", calls, rec.Header().Get("X-Method"))
+	}
+	if _, ok := c.Peek("/m" + methodMarker + http.MethodHead); !ok {
+		t.Fatal("the HEAD isn't cached apart")
+	}
+
+	// invalidating the path takes both
+	if !c.Invalidate("/m") {
+		t.Fatal("nothing invalidated")
+	}
+	if _, ok := c.Peek("/m" + methodMarker + http.MethodHead); ok {
+		t.Fatal("the HEAD entry survived invalidating its path")
+	}
+}
+
+func TestShouldCacheBody(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.ShouldCacheBody = func(body []byte, header http.Header) bool {
+		return !strings.Contains(string(body), `"errors"`)
+	}
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/bad" {
+			// an error envelope, with a 200
+			w.Write([]byte(`{"data":null,"errors":[{"message":"boom"}]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	for i := 0; i < 2; i++ {
+		if rec := get(h, "/bad"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "boom") {
+			t.Fatalf("request %d: served %d %q", i, rec.Code, rec.Body.String())
+		}
+		get(h, "/good")
+	}
+	if calls != 3 {
+		t.Fatalf("%d upstream calls, want the error envelope twice and the good body once", calls)
+	}
+	if _, ok := c.Peek("/bad"); ok {
+		t.Fatal("the error envelope is cached")
+	}
+}
+
+func TestUnsafeMethodsPassThrough(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	upstream := &counting{body: "x"}
+	h := c.Chain(upstream)
+	for _, method := range []string{"POST", "PUT", "DELETE", "PATCH", "REPORT"} {
+		for i := 0; i < 2; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/m", nil))
+		}
+	}
+	if upstream.count() != 10 || c.Stats().Entries != 0 {
+		t.Fatalf("%d upstream calls for 10 unsafe requests, %d entries", upstream.count(), c.Stats().Entries)
+	}
+
+	// unless asked for
+	c = NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.Methods = []string{http.MethodGet, "REPORT"}
+	upstream = &counting{body: "x"}
+	h = c.Chain(upstream)
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("REPORT", "/m", nil))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/m", nil))
+	}
+	if upstream.count() != 3 {
+		t.Fatalf("%d upstream calls, want REPORT cached and HEAD passed through", upstream.count())
+	}
+	if _, ok := c.Peek("/m" + methodMarker + "REPORT"); !ok {
+		t.Fatal("REPORT isn't cached apart")
+	}
+}
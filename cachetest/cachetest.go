@@ -0,0 +1,341 @@
+/*
+	Package cachetest holds test helpers for implementations of the burstcache
+	extension points, so every Storer and Keyer doesn't need its own concurrency tests.
+
+		func TestRedisStore(t *testing.T) {
+			cachetest.StoreConformanceTest(t, func() burstcache.Storer {
+				return newTestRedisStore(t)
+			})
+		}
+*/
+package cachetest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DapperDodo/burstcache"
+)
+
+/*
+	StoreConformanceTest checks the behaviour burstcache relies on in a Storer, and
+	in its locks if it is a burstcache.Locker: one holder at a time, for no longer
+	than asked, and generations that only go up.
+	newStore must return a new, empty store each time it is called.
+*/
+func StoreConformanceTest(t *testing.T, newStore func() burstcache.Storer) {
+
+	t.Run("SetGetDelete", func(t *testing.T) {
+		s := newStore()
+		if _, ok, err := s.Get("k"); ok || err != nil {
+			t.Fatalf("Get on an empty store: ok=%v err=%v, want a miss", ok, err)
+		}
+		if err := s.Set("k", []byte("v1"), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if data, ok, err := s.Get("k"); !ok || err != nil || string(data) != "v1" {
+			t.Fatalf("Get after Set: %q ok=%v err=%v, want v1", data, ok, err)
+		}
+		if err := s.Set("k", []byte("v2"), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if data, _, _ := s.Get("k"); string(data) != "v2" {
+			t.Fatalf("Get after overwrite: %q, want v2", data)
+		}
+		if err := s.Delete("k"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, ok, _ := s.Get("k"); ok {
+			t.Fatal("Get after Delete: entry resurrected")
+		}
+		if err := s.Delete("missing"); err != nil {
+			t.Fatalf("Delete of a missing key: %v", err)
+		}
+	})
+
+	t.Run("NoAliasing", func(t *testing.T) {
+		s := newStore()
+		data := []byte("value")
+		s.Set("k", data, time.Minute)
+		data[0] = 'X'
+		got, _, _ := s.Get("k")
+		if string(got) != "value" {
+			t.Fatalf("store kept a reference to the data passed to Set: %q", got)
+		}
+		got[0] = 'Y'
+		if again, _, _ := s.Get("k"); string(again) != "value" {
+			t.Fatalf("store hands out a reference to its own data: %q", again)
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		s := newStore()
+		s.Set("k", []byte("v"), 50*time.Millisecond)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, ok, _ := s.Get("k"); !ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("entry still there long after its ttl")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		s := newStore()
+		const workers, rounds, keys = 8, 200, 4
+
+		// every value names the key it was written for, so torn or misplaced reads show
+		value := func(key string, n int) []byte {
+			return []byte(fmt.Sprintf("%s:%d:%s", key, n, bytes.Repeat([]byte("x"), n%64)))
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(int64(w)))
+				for i := 0; i < rounds; i++ {
+					key := fmt.Sprintf("k%d", rnd.Intn(keys))
+					switch rnd.Intn(3) {
+					case 0:
+						s.Set(key, value(key, rnd.Intn(1000)), time.Minute)
+					case 1:
+						s.Delete(key)
+					case 2:
+						data, ok, err := s.Get(key)
+						if err != nil {
+							t.Errorf("Get: %v", err)
+						}
+						if ok && !valid(key, data) {
+							t.Errorf("Get(%s) returned data that was never written for it: %q", key, data)
+						}
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		// deletes are final, even after all that
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("k%d", k)
+			s.Delete(key)
+			if _, ok, _ := s.Get(key); ok {
+				t.Fatalf("%s resurrected after Delete", key)
+			}
+		}
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		l := locker(t, newStore())
+		first, ok, err := l.TryLock("k", time.Minute)
+		if !ok || err != nil {
+			t.Fatalf("TryLock of a free key: ok=%v err=%v", ok, err)
+		}
+		if _, ok, _ := l.TryLock("k", time.Minute); ok {
+			t.Fatal("TryLock of a held key succeeded")
+		}
+		if _, ok, _ := l.TryLock("other", time.Minute); !ok {
+			t.Fatal("the lock of one key holds another")
+		}
+		// locks live apart from the entries
+		l.Set("k", []byte("v"), time.Minute)
+		l.Delete("k")
+		if _, ok, _ := l.TryLock("k", time.Minute); ok {
+			t.Fatal("Set and Delete released a lock")
+		}
+
+		if err := l.Unlock("k", first-1); err != nil {
+			t.Fatalf("Unlock of another generation: %v", err)
+		}
+		if _, ok, _ := l.TryLock("k", time.Minute); ok {
+			t.Fatal("Unlock of another generation released the lock")
+		}
+		if err := l.Unlock("k", first); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+		second, ok, _ := l.TryLock("k", time.Minute)
+		if !ok || second <= first {
+			t.Fatalf("TryLock after Unlock: generation %d ok=%v, want one above %d", second, ok, first)
+		}
+	})
+
+	t.Run("LockTTL", func(t *testing.T) {
+		l := locker(t, newStore())
+		first, _, _ := l.TryLock("k", 50*time.Millisecond)
+		deadline := time.Now().Add(5 * time.Second)
+		var second int64
+		for {
+			generation, ok, _ := l.TryLock("k", time.Minute)
+			if ok {
+				second = generation
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("lock still held long after its ttl")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if second <= first {
+			t.Fatalf("generation %d after an expired lock of generation %d", second, first)
+		}
+		// the holder it expired on doesn't release the lock of the next
+		l.Unlock("k", first)
+		if _, ok, _ := l.TryLock("k", time.Minute); ok {
+			t.Fatal("Unlock of an expired generation released its successor")
+		}
+	})
+
+	t.Run("LockConcurrent", func(t *testing.T) {
+		l := locker(t, newStore())
+		const workers, rounds, keys = 8, 200, 2
+
+		var mu sync.Mutex
+		holders := map[string]int{}
+		last := map[string]int64{}
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(int64(w)))
+				for i := 0; i < rounds; i++ {
+					key := fmt.Sprintf("k%d", rnd.Intn(keys))
+					generation, ok, err := l.TryLock(key, time.Minute)
+					if err != nil {
+						t.Errorf("TryLock: %v", err)
+					}
+					if !ok {
+						continue
+					}
+					mu.Lock()
+					holders[key]++
+					if holders[key] > 1 {
+						t.Errorf("%s held %d times at once", key, holders[key])
+					}
+					if generation <= last[key] {
+						t.Errorf("%s locked with generation %d after %d", key, generation, last[key])
+					}
+					last[key] = generation
+					mu.Unlock()
+
+					// hold it a little, while the others try
+					time.Sleep(time.Duration(rnd.Intn(100)) * time.Microsecond)
+
+					mu.Lock()
+					holders[key]--
+					mu.Unlock()
+					if err := l.Unlock(key, generation); err != nil {
+						t.Errorf("Unlock: %v", err)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+	})
+}
+
+/*
+	locker returns s as a burstcache.Locker, skipping the test when it isn't one
+*/
+func locker(t *testing.T, s burstcache.Storer) burstcache.Locker {
+	l, ok := s.(burstcache.Locker)
+	if !ok {
+		t.Skip("not a burstcache.Locker")
+	}
+	return l
+}
+
+/*
+	valid checks a value written by the Concurrent conformance test
+*/
+func valid(key string, data []byte) bool {
+	var k string
+	var n int
+	if _, err := fmt.Sscanf(string(data), "%2s:%d:", &k, &n); err != nil || k != key {
+		return false
+	}
+	return bytes.Equal(data, []byte(fmt.Sprintf("%s:%d:%s", key, n, bytes.Repeat([]byte("x"), n%64))))
+}
+
+/*
+	KeyerFuzz feeds n generated requests to k and checks that keying is deterministic
+	(the same request always gets the same key, also when keyed concurrently) and
+	that the keyer doesn't write a status or body. Setting headers is allowed.
+*/
+func KeyerFuzz(t *testing.T, k burstcache.Keyer, n int) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < n; i++ {
+		r := generate(rnd)
+
+		w := httptest.NewRecorder()
+		key := k.Key(w, r)
+		if w.Body.Len() > 0 || w.Code != http.StatusOK || w.Flushed {
+			t.Fatalf("keyer wrote to the response for %s %s", r.Method, r.URL)
+		}
+
+		keys := make([]string, 4)
+		var wg sync.WaitGroup
+		for j := range keys {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				keys[j] = k.Key(httptest.NewRecorder(), clone(r))
+			}(j)
+		}
+		wg.Wait()
+		for _, again := range keys {
+			if again != key {
+				t.Fatalf("keyer isn't deterministic for %s %s: %q and %q", r.Method, r.URL, key, again)
+			}
+		}
+	}
+}
+
+/*
+	generate a random request
+*/
+func generate(rnd *rand.Rand) *http.Request {
+	methods := []string{"GET", "HEAD", "POST"}
+	paths := []string{"/", "/a", "/a/b", "/orders/42", "/search"}
+	agents := []string{"", "Mozilla/5.0", "Googlebot/2.1", "curl/8.0"}
+
+	url := paths[rnd.Intn(len(paths))]
+	if rnd.Intn(2) == 0 {
+		url += fmt.Sprintf("?q=%d&page=%d", rnd.Intn(5), rnd.Intn(3))
+	}
+	r := httptest.NewRequest(methods[rnd.Intn(len(methods))], url, nil)
+	r.Header.Set("User-Agent", agents[rnd.Intn(len(agents))])
+	if rnd.Intn(2) == 0 {
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer token%d", rnd.Intn(3)))
+	}
+	if rnd.Intn(2) == 0 {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+	if rnd.Intn(2) == 0 {
+		r.TLS = &tls.ConnectionState{}
+	}
+	r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", rnd.Intn(4))
+	return r
+}
+
+/*
+	clone a generated request, so concurrent keyers don't share it
+*/
+func clone(r *http.Request) *http.Request {
+	c := r.Clone(r.Context())
+	c.TLS = r.TLS
+	return c
+}
@@ -0,0 +1,206 @@
+package burstcache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+/*
+	Entries live by a Clock: it is what they are stored, go stale, die and go idle
+	by, and what their expiration timers run on. That is the wall clock, unless
+	Cache.Clock is set, e.g. to a ManualClock, which only moves when it is told to:
+	tests step through TTL and TTD with it instead of sleeping, and the sim package
+	replays hours of traffic through a real Cache in milliseconds.
+
+	Everything that isn't about the life of an entry (how long a handler takes,
+	request rates, backoffs, rate limits) keeps to the wall clock.
+*/
+
+/*
+	Clock tells the time and runs timers, see Cache.Clock
+*/
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer // calls f once d has passed, outside of whatever arms it
+}
+
+/*
+	Timer is a timer armed by a Clock, Stop reports whether it stopped it from firing
+*/
+type Timer interface {
+	Stop() bool
+}
+
+/*
+	wallClock is the Clock of time.Now and time.AfterFunc
+*/
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+/*
+	clock returns the Clock entries live by
+*/
+func (c *Cache) clock() Clock {
+	if c.Clock == nil {
+		return wallClock{}
+	}
+	return c.Clock
+}
+
+/*
+	now returns the time by the Clock entries live by
+*/
+func (c *Cache) now() time.Time {
+	return c.clock().Now()
+}
+
+/*
+	ManualClock is a Clock that stands still until Advance moves it. Its timers
+	fire from within Advance, one after the other in the order they are due, each
+	with the clock set to its due time; those armed meanwhile fire in the same
+	Advance if they are due by its end. A timer armed for zero or less is due
+	right away, it fires on the next Advance (Advance(0) will do). It is safe for
+	concurrent use, but timers firing in the goroutine calling Advance means a
+	caller must not hold a lock they take.
+*/
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers manualTimers
+	seq    int64 // arming order, breaks ties between timers due at the same time
+}
+
+/*
+	NewManualClock returns a ManualClock that reads start until it is advanced
+*/
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+/*
+	Now returns the time the clock was advanced to
+*/
+func (m *ManualClock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+/*
+	AfterFunc arms a timer calling f once the clock was advanced by d
+*/
+func (m *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	t := &manualTimer{clock: m, at: m.now.Add(d), seq: m.seq, f: f}
+	heap.Push(&m.timers, t)
+	return t
+}
+
+/*
+	Advance moves the clock on by d, firing the timers that are due by then
+*/
+func (m *ManualClock) Advance(d time.Duration) {
+	m.mu.Lock()
+	until := m.now.Add(d)
+	m.mu.Unlock()
+	m.AdvanceTo(until)
+}
+
+/*
+	AdvanceTo moves the clock on to t, firing the timers that are due by then.
+	It never moves the clock back, a t before Now still fires the timers due.
+*/
+func (m *ManualClock) AdvanceTo(t time.Time) {
+	for {
+		m.mu.Lock()
+		if len(m.timers) == 0 || m.timers[0].at.After(t) {
+			if t.After(m.now) {
+				m.now = t
+			}
+			m.mu.Unlock()
+			return
+		}
+		next := heap.Pop(&m.timers).(*manualTimer)
+		if next.at.After(m.now) {
+			m.now = next.at
+		}
+		m.mu.Unlock()
+		next.f()
+	}
+}
+
+/*
+	Pending returns how many timers are armed and not yet fired or stopped
+*/
+func (m *ManualClock) Pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.timers)
+}
+
+/*
+	manualTimer is a timer of a ManualClock
+*/
+type manualTimer struct {
+	clock *ManualClock
+	at    time.Time
+	seq   int64
+	f     func()
+	index int // in the heap of its clock, -1 once fired or stopped
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+/*
+	manualTimers is a heap of timers by when they are due, see container/heap
+*/
+type manualTimers []*manualTimer
+
+func (h manualTimers) Len() int {
+	return len(h)
+}
+
+func (h manualTimers) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h manualTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *manualTimers) Push(x interface{}) {
+	t := x.(*manualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *manualTimers) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,56 @@
+package burstcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewManualClock(start)
+	var fired []string
+	at := func(name string) func() {
+		return func() {
+			fired = append(fired, name+"@"+clock.Now().Sub(start).String())
+		}
+	}
+	clock.AfterFunc(2*time.Second, at("b"))
+	clock.AfterFunc(time.Second, func() {
+		at("a")()
+		// armed while firing, due within the same Advance
+		clock.AfterFunc(0, at("a2"))
+	})
+	clock.AfterFunc(2*time.Second, at("c"))
+	stopped := clock.AfterFunc(time.Second, at("never"))
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Stop must report stopping a pending timer, once")
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	if got := clock.Now().Sub(start); got != 1500*time.Millisecond {
+		t.Fatalf("advanced to %v", got)
+	}
+	clock.Advance(time.Hour)
+	want := []string{"a@1s", "a2@1s", "b@2s", "c@2s"}
+	if len(fired) != len(want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+	for i := range want {
+		if fired[i] != want[i] {
+			t.Fatalf("fired %v, want %v", fired, want)
+		}
+	}
+	if clock.Pending() != 0 {
+		t.Fatalf("%d timers pending", clock.Pending())
+	}
+
+	// due right away, but only once told to move
+	clock.AfterFunc(-time.Second, at("late"))
+	if len(fired) != len(want) {
+		t.Fatal("a timer fired without Advance")
+	}
+	clock.Advance(0)
+	if len(fired) != len(want)+1 {
+		t.Fatal("Advance(0) didn't fire the timer due")
+	}
+}
@@ -0,0 +1,98 @@
+package burstcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"time"
+)
+
+/*
+	wire is the encoded form of a cache, as kept in a shared Storer. It is followed
+	by a CRC-32 of the encoding, so a corrupted or partially written entry is
+	recognized as such and treated as a miss rather than served. What capped the
+	time to live of the entry where it was filled (its request's TTL, see WithTTL
+	and RouteTTL, and its Retry-After) travels along, so it expires everywhere
+	as it would have there. StatusTTL goes by the code, which travels anyway.
+*/
+type wire struct {
+	Code        int
+	Head        http.Header
+	Body        []byte
+	Stored      time.Time
+	Tags        []string
+	HeadersOnly bool
+	TTL         time.Duration // the time to live its request set, 0 for TTL
+	RetryAt     time.Time     // when its Retry-After said to retry, zero for none
+}
+
+/*
+	encode a cache for a shared Storer. The body is stored uncompressed (and a
+	streamed one read in full), so readers don't depend on how the writer was configured.
+*/
+func encode(cache *ResponseCacher) ([]byte, error) {
+	body := new(bytes.Buffer)
+	if cache.Body != nil {
+		if err := cache.copyBody(body); err != nil {
+			return nil, err
+		}
+	}
+
+	// whatever sneaked in, the store is shared with others
+	head := cache.Head.Clone()
+	scrub(head)
+
+	data := new(bytes.Buffer)
+	err := gob.NewEncoder(data).Encode(wire{
+		Code:        cache.Code,
+		Head:        head,
+		Body:        body.Bytes(),
+		Stored:      cache.stored,
+		Tags:        cache.tags,
+		HeadersOnly: cache.headersOnly,
+		TTL:         cache.ttl,
+		RetryAt:     cache.retryAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint32(data.Bytes(), crc32.ChecksumIEEE(data.Bytes())), nil
+}
+
+var errChecksum = errors.New("burstcache: shared entry checksum mismatch")
+
+/*
+	decode a cache read from a shared Storer
+*/
+func decode(data []byte) (*ResponseCacher, error) {
+	if len(data) < crc32.Size {
+		return nil, errChecksum
+	}
+	data, sum := data[:len(data)-crc32.Size], data[len(data)-crc32.Size:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		return nil, errChecksum
+	}
+
+	var w wire
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&w); err != nil {
+		return nil, err
+	}
+	cache := NewResponseCacher(0)
+	cache.Code = w.Code
+	cache.wroteHeader = true
+	if w.Head != nil {
+		// a foreign writer may not have scrubbed them
+		scrub(w.Head)
+		cache.Head = w.Head
+	}
+	cache.Body = bytes.NewBuffer(w.Body)
+	cache.stored = w.Stored
+	cache.tags = w.Tags
+	cache.headersOnly = w.HeadersOnly
+	cache.ttl = w.TTL
+	cache.retryAt = w.RetryAt
+	return cache, nil
+}
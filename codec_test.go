@@ -0,0 +1,258 @@
+package burstcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+shareEntry puts a response into store under key, as if another instance stored it at stored
+*/
+func shareEntry(t *testing.T, store Storer, key string, stored time.Time, prepare func(*ResponseCacher)) {
+	cache := NewResponseCacher(0)
+	cache.WriteHeader(200)
+	cache.Write([]byte("shared"))
+	cache.stored = stored
+	if prepare != nil {
+		prepare(cache)
+	}
+	data, err := encode(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set(key, data, time.Hour)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	cache := NewResponseCacher(0)
+	cache.Head.Set("Content-Type", "text/plain")
+	cache.Head.Set(ReservedHeaderPrefix+"Debug", "1")
+	cache.WriteHeader(503)
+	cache.Write([]byte("down"))
+	cache.stored = time.Now().Add(-time.Second).Round(0)
+	cache.ttl = 2 * time.Second
+	cache.retryAt = cache.stored.Add(15 * time.Second)
+	cache.tags = []string{"a", "b"}
+
+	data, err := encode(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Code != 503 || got.Body.String() != "down" || got.Head.Get("Content-Type") != "text/plain" {
+		t.Fatalf("decoded %d %q %v", got.Code, got.Body.String(), got.Head)
+	}
+	if got.Head.Get(ReservedHeaderPrefix+"Debug") != "" {
+		t.Fatal("reserved header stored")
+	}
+	if !got.stored.Equal(cache.stored) || got.ttl != cache.ttl || !got.retryAt.Equal(cache.retryAt) || len(got.tags) != 2 {
+		t.Fatalf("decoded stored %v ttl %v retryAt %v tags %v", got.stored, got.ttl, got.retryAt, got.tags)
+	}
+
+	data[len(data)/2] ^= 0xff
+	if _, err := decode(data); err == nil {
+		t.Fatal("a corrupted entry decodes")
+	}
+}
+
+func TestSharedEntryAges(t *testing.T) {
+	for _, tc := range []struct {
+		age   time.Duration
+		state State
+	}{
+		{time.Second, Fresh},
+		{10 * time.Second, Stale},
+		{15 * time.Second, Stale},
+		// already past its time to die: killed on arrival, it is filled anew
+		{20 * time.Second, Dead},
+		{25 * time.Second, Dead},
+	} {
+		now := time.Unix(1000, 0)
+		clock := NewManualClock(now)
+		store := NewMemoryStore()
+		shareEntry(t, store, "/x", now.Add(-tc.age), nil)
+		c := NewCache(&Keymaker{}, nil, 10*time.Second, 10*time.Second)
+		c.Clock = clock
+		c.Shared = store
+		// no refresh of the stale one while it is looked at
+		c.RefreshDelay = time.Hour
+		h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("handler"))
+		}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+
+		want := "shared"
+		if tc.state == Dead {
+			want = "handler"
+		}
+		if rec.Body.String() != want {
+			t.Errorf("stored %v ago: served %q, want %q", tc.age, rec.Body.String(), want)
+		}
+		meta, _ := c.Peek("/x")
+		state, _ := c.Contains(httptest.NewRequest("GET", "/x", nil))
+		if tc.state == Dead {
+			// what is cached now is the fill that replaced it
+			if state != Fresh || meta.Origin != OriginMiss {
+				t.Errorf("stored %v ago: cached %v from %v, want a fresh fill", tc.age, state, meta.Origin)
+			}
+			continue
+		}
+		if state != tc.state || meta.Origin != OriginRestore || !meta.Stored.Equal(now.Add(-tc.age)) {
+			t.Errorf("stored %v ago: restored as %v from %v stored %v", tc.age, state, meta.Origin, meta.Stored)
+		}
+
+		// it lives out what was left of its life, counted from when it was stored
+		clock.AdvanceTo(now.Add(10*time.Second - tc.age - time.Nanosecond))
+		if s := peekState(c, "/x"); tc.age < 10*time.Second && s != Fresh {
+			t.Errorf("stored %v ago: %v just before its TTL", tc.age, s)
+		}
+		clock.AdvanceTo(now.Add(20*time.Second - tc.age - time.Nanosecond))
+		if s := peekState(c, "/x"); s != Stale {
+			t.Errorf("stored %v ago: %v just before its TTD", tc.age, s)
+		}
+		clock.AdvanceTo(now.Add(20*time.Second - tc.age))
+		if _, ok := c.Peek("/x"); ok {
+			t.Errorf("stored %v ago: alive at its TTD", tc.age)
+		}
+	}
+}
+
+func TestSharedEntryKeepsItsTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stored := now.Add(-5 * time.Second)
+	retry := func(cache *ResponseCacher) {
+		cache.Code = 503
+		cache.Head.Set("Retry-After", "15")
+	}
+	for name, prepare := range map[string]func(*ResponseCacher){
+		"request ttl": func(cache *ResponseCacher) { cache.ttl = 30 * time.Second },
+		"retry-after": func(cache *ResponseCacher) {
+			retry(cache)
+			cache.recordRetryAfter(cache.stored)
+		},
+		// a writer that didn't record it: counted from when it was stored all the same
+		"retry-after header only": retry,
+	} {
+		store := NewMemoryStore()
+		shareEntry(t, store, "/x", stored, prepare)
+		c := NewCache(&Keymaker{}, nil, time.Minute, time.Minute)
+		c.Clock = NewManualClock(now)
+		c.Shared = store
+		h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("%s: the handler ran, the shared entry should be used", name)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+
+		want := 30 * time.Second
+		if name != "request ttl" {
+			want = 15 * time.Second
+		}
+		c.mu.RLock()
+		cache := c.caches["/x"]
+		var ttl time.Duration
+		if cache != nil {
+			ttl = c.ttlFor(cache)
+		}
+		c.mu.RUnlock()
+		if cache == nil {
+			t.Fatalf("%s: not restored", name)
+		}
+		if ttl != want || !cache.stored.Equal(stored) {
+			t.Errorf("%s: restored with ttl %v stored %v, want %v from %v", name, ttl, cache.stored, want, stored)
+		}
+	}
+}
+
+func TestCorruptSharedEntryIsAMiss(t *testing.T) {
+	for name, corrupt := range map[string]func([]byte) []byte{
+		"flipped bit": func(data []byte) []byte { data[len(data)/2] ^= 1; return data },
+		"truncated":   func(data []byte) []byte { return data[:len(data)-1] },
+		"too short":   func(data []byte) []byte { return data[:3] },
+	} {
+		shared := NewMemoryStore()
+		shareEntry(t, shared, "/x", time.Now(), nil)
+		data, _, _ := shared.Get("/x")
+		data = corrupt(append([]byte(nil), data...))
+		if _, err := decode(data); !errors.Is(err, errChecksum) {
+			t.Fatalf("%s: decoded with %v, want the checksum to fail", name, err)
+		}
+		shared.Set("/x", data, time.Hour)
+
+		c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+		c.Shared = shared
+		h := &counting{body: "refilled"}
+		if rec := get(c.Chain(h), "/x"); rec.Body.String() != "refilled" || h.count() != 1 {
+			t.Fatalf("%s: served %q with %d upstream calls, want a refill", name, rec.Body.String(), h.count())
+		}
+		waitIdle(t, c)
+		if data, _, _ := shared.Get("/x"); data == nil {
+			t.Fatalf("%s: the refill wasn't stored", name)
+		} else if cache, err := decode(data); err != nil || cache.Body.String() != "refilled" {
+			t.Fatalf("%s: the refill didn't replace the corrupted entry: %v", name, err)
+		}
+	}
+}
+
+func TestOwnHeadersNeverShared(t *testing.T) {
+	store := NewMemoryStore()
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.Shared = store
+	c.HealthHeader = "X-Health"
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// as a cache in front of the handler would leave them
+		w.Header().Set(markerHeader, "1")
+		w.Header().Set(ReservedHeaderPrefix+"Debug", "other")
+		w.Header().Set("X-Health", "degraded")
+		w.Header().Set("X-Keep", "yes")
+		w.Write([]byte("x"))
+	}))
+	get(h, "/s")
+	waitIdle(t, c)
+
+	data, ok, _ := store.Get("/s")
+	if !ok {
+		t.Fatal("not shared")
+	}
+	shared, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.RLock()
+	local := c.caches["/s"].Head
+	c.mu.RUnlock()
+	for where, head := range map[string]http.Header{"shared": shared.Head, "local": local} {
+		for name := range head {
+			if reserved(name) || name == "X-Health" {
+				t.Fatalf("%s entry stored %s", where, name)
+			}
+		}
+		if head.Get("X-Keep") != "yes" {
+			t.Fatalf("%s entry lost X-Keep: %v", where, head)
+		}
+	}
+
+	// written by another service, which didn't scrub
+	foreign := new(bytes.Buffer)
+	if err := gob.NewEncoder(foreign).Encode(wire{Code: 200, Head: http.Header{ReservedHeaderPrefix + "Trace": {"abc"}}}); err != nil {
+		t.Fatal(err)
+	}
+	data = binary.BigEndian.AppendUint32(foreign.Bytes(), crc32.ChecksumIEEE(foreign.Bytes()))
+	cache, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.Head) != 0 {
+		t.Fatalf("loaded %v from a foreign writer", cache.Head)
+	}
+}
@@ -0,0 +1,225 @@
+package burstcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"strings"
+)
+
+/*
+	With Compress set, bodies are stored gzip compressed and decompressed while
+	they are served, trading CPU for memory. Content that is compressed already
+	(images, video, archives) gains nothing from another round, so the content
+	types listed in Incompressible are stored raw. An entry ending in a slash
+	matches a whole family of types (e.g. "video/").
+
+	Many small, near identical bodies (think JSON from the same endpoint) hardly
+	compress on their own. Against a preset Dictionary holding typical content
+	they do. Supply one, or let TrainDictionary build one from what is cached.
+	Entries remember the dictionary they were packed with, so it can be swapped
+	with SetDictionary at any time.
+*/
+
+/*
+	MaxDictionary is the largest useful dictionary, flate only looks back this far
+*/
+const MaxDictionary = 32 << 10
+
+/*
+	DefaultIncompressible are the content types stored raw when Incompressible isn't set
+*/
+var DefaultIncompressible = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"video/",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-7z-compressed",
+}
+
+/*
+	compress the body of a cache about to be stored, if that is worthwhile
+*/
+func (c *Cache) compress(cache *ResponseCacher) {
+	cfg := c.settingsOf(cache)
+	if !cfg.Compress || cache.compressed || cache.Body == nil || cache.stream != nil {
+		return
+	}
+	if cache.Body.Len() < cfg.CompressMinBytes || cache.Head.Get("Content-Encoding") != "" {
+		return
+	}
+	if !c.compressible(cache.Head.Get("Content-Type")) {
+		return
+	}
+
+	dict := c.dictionary()
+	packed := new(bytes.Buffer)
+	var zw io.WriteCloser
+	if dict != nil {
+		// packed once, inflated many times: spend the effort, lower levels make little use of dict
+		zw, _ = flate.NewWriterDict(packed, flate.BestCompression, dict)
+	} else {
+		zw = gzip.NewWriter(packed)
+	}
+	if _, err := zw.Write(cache.Body.Bytes()); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil || packed.Len() >= cache.Body.Len() {
+		return
+	}
+	cache.rawLen = cache.Body.Len()
+	// trimmed copy, the spare capacity of packed would count against the memory held
+	cache.Body = bytes.NewBuffer(append([]byte(nil), packed.Bytes()...))
+	cache.compressed = true
+	cache.dict = dict
+}
+
+/*
+	dictionary returns the dictionary to compress new entries with, nil for none
+*/
+func (c *Cache) dictionary() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	dict := c.Dictionary
+	if c.dict != nil {
+		dict = c.dict
+	}
+	if len(dict) == 0 {
+		return nil
+	}
+	return dict
+}
+
+/*
+	SetDictionary replaces the dictionary new entries are compressed with.
+	Entries stored before keep using their own. An empty dict turns the
+	dictionary off, a nil dict falls back to Dictionary. The cache keeps a copy,
+	so dict may be reused once SetDictionary returns.
+*/
+func (c *Cache) SetDictionary(dict []byte) {
+	if len(dict) > MaxDictionary {
+		dict = dict[len(dict)-MaxDictionary:]
+	}
+	if dict != nil {
+		// entries inflate against it for as long as they live, it can't change under them
+		dict = append([]byte{}, dict...)
+	}
+	c.mu.Lock()
+	c.dict = dict
+	c.mu.Unlock()
+}
+
+/*
+	TrainDictionary builds a dictionary of at most size bytes (MaxDictionary if
+	size <= 0) from a sample of the compressible bodies cached right now, taking
+	a slice of each. It only returns the dictionary, use SetDictionary to start
+	using it.
+*/
+func (c *Cache) TrainDictionary(size int) []byte {
+	if size <= 0 || size > MaxDictionary {
+		size = MaxDictionary
+	}
+
+	c.mu.RLock()
+	sample := make([]*ResponseCacher, 0, len(c.caches))
+	for _, cache := range c.caches {
+		if cache.Body != nil && c.compressible(cache.Head.Get("Content-Type")) {
+			sample = append(sample, cache)
+		}
+	}
+	c.mu.RUnlock()
+
+	// entries are immutable once stored, so they can be read outside the lock
+	dict := new(bytes.Buffer)
+	body := new(bytes.Buffer)
+	for _, cache := range sample {
+		body.Reset()
+		if err := cache.copyBody(body); err != nil {
+			continue
+		}
+		take := body.Len()
+		if take > size/8 {
+			// a slice of many bodies beats all of a few
+			take = size / 8
+		}
+		dict.Write(body.Bytes()[:take])
+		if dict.Len() >= size {
+			break
+		}
+	}
+	if dict.Len() > size {
+		// flate favours what comes last, keep the tail
+		return dict.Bytes()[dict.Len()-size:]
+	}
+	return dict.Bytes()
+}
+
+/*
+	compressible reports whether bodies of the content type are worth compressing
+*/
+func (c *Cache) compressible(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// unknown content, give it a try
+		return true
+	}
+	skip := c.Incompressible
+	if skip == nil {
+		skip = DefaultIncompressible
+	}
+	for _, t := range skip {
+		if mediatype == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediatype, t) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	copy the decompressed body of a compressed cache to w
+*/
+func (c *ResponseCacher) inflate(w io.Writer) error {
+	if c.dict != nil {
+		zr := flate.NewReaderDict(bytes.NewReader(c.Body.Bytes()), c.dict)
+		defer zr.Close()
+		_, err := io.Copy(w, zr)
+		return err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(c.Body.Bytes()))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, zr)
+	return err
+}
+
+/*
+	copy the plain body of a cache to w, decompressing it if needed
+*/
+func (c *ResponseCacher) copyBody(w io.Writer) error {
+	if c.stream != nil {
+		body, err := c.stream()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = io.Copy(w, body)
+		return err
+	}
+	if c.compressed {
+		return c.inflate(w)
+	}
+	_, err := w.Write(c.Body.Bytes())
+	return err
+}
@@ -0,0 +1,147 @@
+package burstcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	similar stores n small JSON bodies alike enough to share a dictionary
+*/
+func similar(c *Cache, n int) {
+	for i := 0; i < n; i++ {
+		rc := NewResponseCacher(0)
+		rc.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(rc, `{"id":%d,"name":"user number %d","email":"user%d@example.com","active":true,"roles":["reader","writer"]}`, i, i, i)
+		c.Store(fmt.Sprint("/", i), rc)
+	}
+}
+
+func TestDictionaryRoundTrip(t *testing.T) {
+	plain := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	plain.Compress = true
+	similar(plain, 50)
+
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Compress = true
+	c.Dictionary = plain.TrainDictionary(0)
+	similar(c, 50)
+	if with, without := c.Stats().Bytes, plain.Stats().Bytes; with >= without {
+		t.Fatalf("%d bytes held with the dictionary, %d without", with, without)
+	}
+
+	for _, cache := range []*Cache{plain, c} {
+		rec := httptest.NewRecorder()
+		cache.ServeCached("/7", rec)
+		if !strings.Contains(rec.Body.String(), `"email":"user7@example.com"`) {
+			t.Fatalf("served %q", rec.Body.String())
+		}
+	}
+}
+
+func TestSetDictionaryCopies(t *testing.T) {
+	trainer := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	trainer.Compress = true
+	similar(trainer, 50)
+	dict := trainer.TrainDictionary(0)
+
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Compress = true
+	c.SetDictionary(dict)
+	similar(c, 10)
+	// the caller reuses its buffer
+	for i := range dict {
+		dict[i] = 0
+	}
+	rec := httptest.NewRecorder()
+	c.ServeCached("/3", rec)
+	if !strings.Contains(rec.Body.String(), `"email":"user3@example.com"`) {
+		t.Fatalf("served %q after the dictionary passed in was overwritten", rec.Body.String())
+	}
+
+	// off, entries stored before keep theirs
+	c.SetDictionary([]byte{})
+	rec = httptest.NewRecorder()
+	c.ServeCached("/4", rec)
+	if !strings.Contains(rec.Body.String(), `"email":"user4@example.com"`) {
+		t.Fatalf("served %q once the dictionary was turned off", rec.Body.String())
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Compress = true
+	body := strings.Repeat("compressible enough ", 100)
+	for path, contentType := range map[string]string{
+		"/photo.jpg": "image/jpeg",
+		"/clip.mp4":  "video/mp4",
+		"/data.json": "application/json; charset=utf-8",
+	} {
+		rc := NewResponseCacher(0)
+		rc.Header().Set("Content-Type", contentType)
+		rc.Write([]byte(body))
+		c.Store(path, rc)
+	}
+	compressed := func(key string) bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return c.caches[key].compressed
+	}
+	if compressed("/photo.jpg") || compressed("/clip.mp4") {
+		t.Fatal("an image or video was compressed")
+	}
+	if !compressed("/data.json") {
+		t.Fatal("the JSON wasn't compressed")
+	}
+	for _, path := range []string{"/photo.jpg", "/data.json"} {
+		rec := httptest.NewRecorder()
+		if c.ServeCached(path, rec); rec.Body.String() != body {
+			t.Fatalf("%s served %d bytes", path, rec.Body.Len())
+		}
+	}
+}
+
+func TestGzippedUpstreamNormalized(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		c := NewCache(&Keymaker{}, nil, time.Millisecond, time.Millisecond)
+		c.Compress = compress
+		var calls int32
+		// every other fill arrives gzipped
+		h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1)%2 == 1 {
+				var b bytes.Buffer
+				zw := gzip.NewWriter(&b)
+				zw.Write([]byte("hello"))
+				zw.Close()
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(b.Bytes())
+				return
+			}
+			w.Write([]byte("hello"))
+		}))
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+			if rec.Body.String() != "hello" || rec.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("Compress %v, fill %d: served %q encoded %q", compress, i, rec.Body.String(), rec.Header().Get("Content-Encoding"))
+			}
+			// gone before the next, so every request fills
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				if _, ok := c.Peek("/x"); !ok {
+					break
+				}
+			}
+		}
+		waitIdle(t, c)
+		if n := atomic.LoadInt32(&calls); n != 4 {
+			t.Fatalf("Compress %v: %d fills, want 4", compress, n)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package burstcache
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+/*
+	CacheConfig is a snapshot of the settings a cache is running with,
+	including changes made at runtime (SetTTL, SetTTD, StrictTuning, Reconfigure).
+
+	The cache keeps its tunable settings as one such snapshot, behind an atomic
+	pointer: it is taken from the fields of the Cache on first use, and from then
+	on every change swaps in a whole new one. A request loads it once, when it
+	comes in, and goes by that one throughout, and so does what it fills; it never
+	sees half the old and half the new settings. Setting the fields themselves
+	once the cache is in use has no effect, change them through Reconfigure.
+*/
+type CacheConfig struct {
+	TTL          time.Duration            // time to live
+	TTD          time.Duration            // time to die as configured
+	EffectiveTTD time.Duration            // time to die as applied, differs from TTD with StrictTuning
+	GroupTTD     map[string]time.Duration // time to die as applied per group, with StrictTuning and a Grouper
+
+	MaxTTL             time.Duration
+	MinBodyBytes       int
+	MaxBodyBytes       int
+	MaxBytes           int64
+	DefaultContentType string
+	KillGrace          time.Duration
+	RescheduleExisting bool
+	StrictTuning       bool
+	TuningMargin       time.Duration
+	MaxAge             time.Duration
+	MaxAgeJitter       time.Duration
+	ErrorMaxAge        time.Duration
+	RetryBudget        int
+	RefreshDelay       time.Duration
+	SubjectMax         int
+	BypassAnonymous    bool
+	Compress           bool
+	CompressMinBytes   int
+
+	Keyed    bool // a Keymaker is set, so Chain can be used
+	Shared   bool // a shared tier is configured
+	Draining bool // the cache is draining, see Drain
+}
+
+/*
+	Config returns the settings the cache is running with right now
+*/
+func (c *Cache) Config() CacheConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config()
+}
+
+/*
+	config returns the current settings, the caller must hold the lock
+*/
+func (c *Cache) config() CacheConfig {
+	cfg := *c.settings()
+	if cfg.StrictTuning && len(c.groups) > 0 {
+		cfg.GroupTTD = make(map[string]time.Duration, len(c.groups))
+		for group, t := range c.groups {
+			cfg.GroupTTD[group] = c.extend(t.p95())
+		}
+	}
+	cfg.EffectiveTTD = c.ttd("")
+	cfg.Keyed = c.Keymaker != nil
+	cfg.Shared = c.Shared != nil
+	cfg.Draining = c.Draining()
+	return cfg
+}
+
+/*
+	settings returns the snapshot of the tunable settings in effect, see CacheConfig.
+	The first call takes it from the fields of the Cache.
+*/
+func (c *Cache) settings() *CacheConfig {
+	if cfg := c.snapshot.Load(); cfg != nil {
+		return cfg
+	}
+	c.snapshot.CompareAndSwap(nil, &CacheConfig{
+		TTL:                c.TTL,
+		TTD:                c.TTD,
+		MaxTTL:             c.MaxTTL,
+		MinBodyBytes:       c.MinBodyBytes,
+		MaxBodyBytes:       c.MaxBodyBytes,
+		MaxBytes:           c.MaxBytes,
+		DefaultContentType: c.DefaultContentType,
+		KillGrace:          c.KillGrace,
+		RescheduleExisting: c.RescheduleExisting,
+		StrictTuning:       c.StrictTuning,
+		TuningMargin:       c.TuningMargin,
+		MaxAge:             c.MaxAge,
+		MaxAgeJitter:       c.MaxAgeJitter,
+		ErrorMaxAge:        c.ErrorMaxAge,
+		RetryBudget:        c.RetryBudget,
+		RefreshDelay:       c.RefreshDelay,
+		SubjectMax:         c.SubjectMax,
+		BypassAnonymous:    c.BypassAnonymous,
+		Compress:           c.Compress,
+		CompressMinBytes:   c.CompressMinBytes,
+	})
+	return c.snapshot.Load()
+}
+
+/*
+	settingsOf returns the settings cache was filled by, those in effect for one
+	filled before there was a snapshot to go by
+*/
+func (c *Cache) settingsOf(cache *ResponseCacher) *CacheConfig {
+	if cache.settings != nil {
+		return cache.settings
+	}
+	return c.settings()
+}
+
+/*
+	retune swaps in a copy of the settings that change made changes to, recording
+	what changed, and returns it. The caller must hold the lock, which keeps
+	concurrent changes from losing one another.
+*/
+func (c *Cache) retune(change func(cfg *CacheConfig)) *CacheConfig {
+	old := c.settings()
+	next := *old
+	change(&next)
+	next.EffectiveTTD, next.GroupTTD = 0, nil
+	next.Keyed, next.Shared, next.Draining = false, false, false
+	c.snapshot.Store(&next)
+	if changed := diff(*old, next); len(changed) > 0 && c.Events > 0 {
+		c.events.add(c.Events, Event{At: time.Now(), Decision: DecisionReconfigure, Changed: changed})
+	}
+	return &next
+}
+
+/*
+	Reconfigure applies a whole new configuration to the running cache, typically
+	Config() with whatever needs changing. All settings change at once, in one swap
+	of the snapshot (see CacheConfig), so no request sees half the old and half the
+	new configuration. The changed settings are logged, and recorded as a
+	DecisionReconfigure event. With RescheduleExisting (as in cfg), a new TTL or
+	TTD also applies to the caches already stored, like SetTTL and SetTTD.
+
+	What describes the setup rather than its tuning (Keyed, Shared, Draining)
+	can't be changed this way and is rejected. The settings derived at runtime
+	(EffectiveTTD, GroupTTD) are ignored.
+*/
+func (c *Cache) Reconfigure(cfg CacheConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	// rescheduling walks the caches after the lock is released, see reschedule
+	var fresh, stale bool
+	defer func() {
+		if fresh {
+			c.rescheduleFresh()
+		}
+		if stale {
+			c.rescheduleStale()
+		}
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.config()
+	switch {
+	case cfg.Keyed != old.Keyed:
+		return fmt.Errorf("burstcache: Keyed can't change at runtime, set the Keymaker before serving")
+	case cfg.Shared != old.Shared:
+		return fmt.Errorf("burstcache: Shared can't change at runtime, set the shared tier before serving")
+	case cfg.Draining != old.Draining:
+		return fmt.Errorf("burstcache: Draining can't change through Reconfigure, use Drain")
+	}
+	changed := diff(old, cfg)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	c.retune(func(next *CacheConfig) {
+		*next = cfg
+	})
+
+	if cfg.RescheduleExisting {
+		fresh = cfg.TTL != old.TTL
+		stale = cfg.TTD != old.TTD || cfg.StrictTuning != old.StrictTuning || cfg.TuningMargin != old.TuningMargin
+	}
+	c.evict(nil)
+
+	log.Printf("burstcache: reconfigured %s", strings.Join(changed, ", "))
+	return nil
+}
+
+/*
+	validate rejects negative limits and durations
+*/
+func (cfg CacheConfig) validate() error {
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Int, reflect.Int64:
+			if f.Int() < 0 {
+				return fmt.Errorf("burstcache: %s can't be negative", v.Type().Field(i).Name)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+	diff lists the settings that differ between old and cfg, as "name old -> new"
+*/
+func diff(old, cfg CacheConfig) []string {
+	var changed []string
+	a, b := reflect.ValueOf(old), reflect.ValueOf(cfg)
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if name == "EffectiveTTD" || name == "GroupTTD" {
+			continue
+		}
+		if x, y := a.Field(i).Interface(), b.Field(i).Interface(); x != y {
+			changed = append(changed, fmt.Sprintf("%s %v -> %v", name, x, y))
+		}
+	}
+	return changed
+}
@@ -0,0 +1,196 @@
+package burstcache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	reconfigure changes the settings of c while it is in use, as an operator would
+*/
+func reconfigure(t *testing.T, c *Cache, change func(cfg *CacheConfig)) {
+	t.Helper()
+	cfg := c.Config()
+	change(&cfg)
+	if err := c.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, 4*time.Second)
+	c.MaxBytes = 1 << 20
+	c.RetryBudget = 2
+	cfg := c.Config()
+	if cfg.TTL != time.Second || cfg.TTD != 4*time.Second || cfg.EffectiveTTD != 4*time.Second {
+		t.Fatalf("TTL %v, TTD %v (%v applied), want those passed to NewCache", cfg.TTL, cfg.TTD, cfg.EffectiveTTD)
+	}
+	if cfg.MaxBytes != 1<<20 || cfg.RetryBudget != 2 || !cfg.Keyed || cfg.Shared || cfg.Draining {
+		t.Fatalf("settings not reflected: %+v", cfg)
+	}
+
+	c.SetTTL(2 * time.Second)
+	c.SetTTD(8 * time.Second)
+	c.Shared = NewMemoryStore()
+	c.Drain()
+	cfg = c.Config()
+	if cfg.TTL != 2*time.Second || cfg.TTD != 8*time.Second || !cfg.Shared || !cfg.Draining {
+		t.Fatalf("runtime overrides not reflected: %+v", cfg)
+	}
+
+	cfg.RefreshDelay = time.Second
+	cfg.MaxAge = time.Minute
+	if err := c.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Config(); got.RefreshDelay != time.Second || got.MaxAge != time.Minute || got.TTL != 2*time.Second {
+		t.Fatalf("Reconfigure not reflected: %+v", got)
+	}
+
+	if cfg := NewCache(nil, nil, time.Second, time.Second).Config(); cfg.Keyed {
+		t.Fatal("keyed without a Keymaker")
+	}
+}
+
+func TestReconfigureUnderTraffic(t *testing.T) {
+	logged := captureLog(t)
+	c := NewCache(&Keymaker{}, nil, time.Millisecond, time.Millisecond)
+	// every configuration applied keeps MaxAge in seconds equal to RetryBudget, a hook sees both at once
+	var torn int32
+	c.Freshness = func(meta CacheMeta) State {
+		if cfg := c.Config(); cfg.MaxAge != time.Duration(cfg.RetryBudget)*time.Second {
+			atomic.AddInt32(&torn, 1)
+		}
+		if meta.Fresh {
+			return Fresh
+		}
+		return Stale
+	}
+	h := c.Chain(&counting{body: "hello world"})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := get(h, fmt.Sprint("/", i%10))
+				if cc := rec.Header().Get("Cache-Control"); cc != "" && !strings.HasPrefix(cc, "max-age=") {
+					t.Errorf("served Cache-Control %q", cc)
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 20; i++ {
+		cfg := c.Config()
+		cfg.MaxAge = time.Duration(i) * time.Second
+		cfg.RetryBudget = i
+		cfg.TTL = time.Duration(i%5+1) * time.Millisecond
+		cfg.MinBodyBytes = i % 3
+		cfg.Compress = i%2 == 0
+		cfg.RescheduleExisting = true
+		if err := c.Reconfigure(cfg); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	waitIdle(t, c)
+
+	if n := atomic.LoadInt32(&torn); n != 0 {
+		t.Fatalf("the hook saw %d half applied configurations", n)
+	}
+	if got := c.Config(); got.MaxAge != 20*time.Second || got.RetryBudget != 20 {
+		t.Fatalf("the last configuration isn't the one running: %+v", got)
+	}
+	if !strings.Contains(logged.String(), "MaxAge 19s -> 20s") {
+		t.Fatal("the changes weren't logged")
+	}
+
+	for name, change := range map[string]func(*CacheConfig){
+		"Shared":   func(cfg *CacheConfig) { cfg.Shared = true },
+		"Keyed":    func(cfg *CacheConfig) { cfg.Keyed = false },
+		"Draining": func(cfg *CacheConfig) { cfg.Draining = true },
+		"TTL":      func(cfg *CacheConfig) { cfg.TTL = -time.Second },
+	} {
+		cfg := c.Config()
+		change(&cfg)
+		if err := c.Reconfigure(cfg); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("changing %s: %v", name, err)
+		}
+	}
+	if got := c.Config(); got.TTL <= 0 || !got.Keyed || got.Shared {
+		t.Fatalf("a rejected configuration was applied: %+v", got)
+	}
+}
+
+func TestReconfigureEvent(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.Events = 10
+	reconfigure(t, c, func(cfg *CacheConfig) {
+		cfg.MaxAge = time.Minute
+		cfg.RetryBudget = 2
+	})
+	reconfigure(t, c, func(cfg *CacheConfig) {})
+	c.SetTTL(2 * time.Second)
+
+	events := c.RecentEvents()
+	if len(events) != 2 {
+		t.Fatalf("%d events, want one per change: %+v", len(events), events)
+	}
+	for i, want := range [][]string{{"MaxAge 0s -> 1m0s", "RetryBudget 0 -> 2"}, {"TTL 1s -> 2s"}} {
+		if e := events[i]; e.Decision != DecisionReconfigure || e.Key != "" || fmt.Sprint(e.Changed) != fmt.Sprint(want) {
+			t.Fatalf("event %d is %s %q changing %q, want %s changing %q", i, e.Decision, e.Key, e.Changed, DecisionReconfigure, want)
+		}
+	}
+}
+
+func TestSettingsPerRequest(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MaxAge = time.Minute
+	var once sync.Once
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the settings change while the first request is being filled
+		once.Do(func() {
+			reconfigure(t, c, func(cfg *CacheConfig) {
+				cfg.MaxAge = 2 * time.Minute
+				cfg.MaxBodyBytes = 2
+			})
+		})
+		w.Write([]byte("hello"))
+	}))
+
+	// filled and served by the settings it came in with
+	if cc := get(h, "/a").Header().Get("Cache-Control"); cc != "max-age=60" {
+		t.Fatalf("the first request served Cache-Control %q, want max-age=60", cc)
+	}
+	if _, ok := c.Peek("/a"); !ok {
+		t.Fatal("the first request wasn't cached, as if it went by the MaxBodyBytes set while it was filled")
+	}
+	// the next ones by the new ones
+	if cc := get(h, "/a").Header().Get("Cache-Control"); cc != "max-age=120" {
+		t.Fatalf("a later request served Cache-Control %q, want max-age=120", cc)
+	}
+	get(h, "/b")
+	if _, ok := c.Peek("/b"); ok {
+		t.Fatal("a later fill beyond MaxBodyBytes was cached")
+	}
+
+	// setting the fields once in use changes nothing
+	c.MaxAge = time.Hour
+	if cc := get(h, "/a").Header().Get("Cache-Control"); cc != "max-age=120" {
+		t.Fatalf("served Cache-Control %q after setting MaxAge directly, want max-age=120", cc)
+	}
+}
@@ -0,0 +1,71 @@
+package burstcache
+
+import (
+	"net/http"
+)
+
+/*
+	Contains tells whether Chain would serve the request from cache, and if so, whether
+	from a fresh or a stale response. It keys the request like Chain does, but serves
+	nothing, counts nothing and leaves the usage order alone, so it is safe to call
+	from middleware in front of Chain (e.g. to skip rate limiting for cache hits).
+	Headers the Keymaker sets while keying are discarded.
+*/
+func (c *Cache) Contains(r *http.Request) (state State, ok bool) {
+	if c.Keymaker == nil {
+		return Dead, false
+	}
+	key, ok := c.key(c.settings(), discard{}, r)
+	if !ok {
+		return Dead, false
+	}
+	key = c.vary(key, r)
+
+	c.mu.RLock()
+	cache := c.caches[key]
+	if cache == nil {
+		c.mu.RUnlock()
+		return Dead, false
+	}
+	state = Stale
+	if cache.fresh {
+		state = Fresh
+	}
+	meta := cache.meta()
+	c.mu.RUnlock()
+
+	if c.Freshness != nil {
+		state = c.Freshness(meta)
+	}
+	return state, state != Dead
+}
+
+/*
+	ResolveKey returns the key Chain stores the response to the request under, exactly
+	as Remove and Invalidate take it, and the same key as logs and events show it (see
+	Redact). It keys the request like Chain does, variant included (see VaryHeaders),
+	so it answers which key to purge for a URL. Both are "" when the request isn't
+	cacheable, or there is no Keymaker.
+*/
+func (c *Cache) ResolveKey(r *http.Request) (key string, displayKey string) {
+	if c.Keymaker == nil {
+		return "", ""
+	}
+	key, ok := c.key(c.settings(), discard{}, r)
+	if !ok {
+		return "", ""
+	}
+	key = c.vary(key, r)
+	return key, c.redact(key)
+}
+
+/*
+	discard is a ResponseWriter that throws away everything written to it
+*/
+type discard struct{}
+
+func (discard) Header() http.Header { return http.Header{} }
+
+func (discard) Write(buf []byte) (int, error) { return len(buf), nil }
+
+func (discard) WriteHeader(code int) {}
@@ -0,0 +1,37 @@
+package burstcache
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContainsAgreesWithChain(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 20*time.Millisecond, time.Hour)
+	c.Events = 16
+	h := c.Chain(&counting{body: "body"})
+	check := func(step string, wantState State, wantOK bool, wantDecision Outcome) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/a", nil)
+		before, _ := c.Peek("/a")
+		state, ok := c.Contains(r)
+		if after, _ := c.Peek("/a"); after.Serves != before.Serves {
+			t.Fatalf("%s: Contains counted a serve", step)
+		}
+		if ok != wantOK || ok && state != wantState {
+			t.Fatalf("%s: Contains says %v, %v", step, state, ok)
+		}
+		// the first event after it is the decision, a refresh may follow
+		n := len(c.RecentEvents())
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got := c.RecentEvents()[n].Decision; got != wantDecision.String() {
+			t.Fatalf("%s: Contains says %v, %v but Chain decided %s", step, state, ok, got)
+		}
+	}
+
+	check("miss", Dead, false, OutcomeMiss)
+	check("hit", Fresh, true, OutcomeHit)
+	time.Sleep(30 * time.Millisecond)
+	check("stale", Stale, true, OutcomeStale)
+	waitIdle(t, c)
+}
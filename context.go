@@ -0,0 +1,105 @@
+package burstcache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+/*
+	Requests can carry instructions for the cache in their context
+*/
+
+type contextKey int
+
+const (
+	sharedOnlyKey contextKey = iota
+	fillingKey
+	ttlKey
+	keyKey
+)
+
+/*
+	WithSharedOnly flags a request to populate the shared tier only. Chain then
+	fills it from the handler and publishes it, without storing or reading the
+	local cache. A warmer can fill the shared tier this way without crowding its
+	own memory. Without a shared tier, flagged requests pass through uncached.
+*/
+func WithSharedOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sharedOnlyKey, true)
+}
+
+/*
+	WithTTL sets the time to live of the response a request fills, instead of TTL
+	(or RouteTTL). It is meant for middleware in front of the cache that knows
+	better, e.g. when the URL names an immutable snapshot. MaxTTL caps it.
+*/
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey, ttl)
+}
+
+/*
+	WithKey sets the cache key of a request, so Chain uses it as is instead of
+	asking the Keymaker. It is meant for middleware in front of the cache that can
+	tell better, e.g. after resolving a slug to an id. With a SubjectFunc, the key
+	is still scoped to the subject of the request, and to its method unless GET.
+*/
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyKey, key)
+}
+
+/*
+	contextKeyOf returns the key set by WithKey, if any
+*/
+func contextKeyOf(r *http.Request) (string, bool) {
+	key, ok := r.Context().Value(keyKey).(string)
+	return key, ok && key != ""
+}
+
+/*
+	contextTTL returns the time to live set by WithTTL, if any
+*/
+func contextTTL(r *http.Request) (time.Duration, bool) {
+	ttl, ok := r.Context().Value(ttlKey).(time.Duration)
+	return ttl, ok && ttl > 0
+}
+
+/*
+	filling marks the requests a cache fill runs the handler with. Through
+	subrequests the marks of nested fills form a chain, innermost first.
+*/
+type filling struct {
+	cache *Cache
+	key   string
+	outer *filling
+}
+
+/*
+	withFilling marks r as filling key of c
+*/
+func withFilling(r *http.Request, c *Cache, key string) *http.Request {
+	outer, _ := r.Context().Value(fillingKey).(*filling)
+	return r.WithContext(context.WithValue(r.Context(), fillingKey, &filling{cache: c, key: key, outer: outer}))
+}
+
+/*
+	recursive reports whether r stems from a fill of key by c. Caching it would
+	have the fill wait for itself.
+*/
+func (c *Cache) recursive(r *http.Request, key string) bool {
+	f, _ := r.Context().Value(fillingKey).(*filling)
+	for ; f != nil; f = f.outer {
+		if f.cache == c && f.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	sharedOnly reports whether the request is flagged by WithSharedOnly
+*/
+func sharedOnly(r *http.Request) bool {
+	flagged, _ := r.Context().Value(sharedOnlyKey).(bool)
+	return flagged
+}
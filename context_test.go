@@ -0,0 +1,74 @@
+package burstcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWithTTL(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewManualClock(start)
+	c := NewCache(&Keymaker{}, nil, 20*time.Millisecond, time.Hour)
+	c.Clock = clock
+	c.MaxTTL = 150 * time.Millisecond
+	chained := c.Chain(&counting{body: "body"})
+	// framework code in front of the cache knows better per request
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/snapshot":
+			r = r.WithContext(WithTTL(r.Context(), 100*time.Millisecond))
+		case "/forever":
+			r = r.WithContext(WithTTL(r.Context(), time.Hour))
+		}
+		chained.ServeHTTP(w, r)
+	})
+	for _, path := range []string{"/default", "/snapshot", "/forever"} {
+		get(h, path)
+	}
+
+	fresh := func(key string) bool {
+		meta, _ := c.Peek(key)
+		return meta.Fresh
+	}
+	// each goes stale right at its TTL, the hour capped by MaxTTL
+	for _, step := range []struct {
+		at                       time.Duration
+		deflt, snapshot, forever bool
+	}{
+		{19 * time.Millisecond, true, true, true},
+		{20 * time.Millisecond, false, true, true},
+		{99 * time.Millisecond, false, true, true},
+		{100 * time.Millisecond, false, false, true},
+		{149 * time.Millisecond, false, false, true},
+		{150 * time.Millisecond, false, false, false},
+	} {
+		clock.AdvanceTo(start.Add(step.at))
+		if fresh("/default") != step.deflt || fresh("/snapshot") != step.snapshot || fresh("/forever") != step.forever {
+			t.Fatalf("at %v: fresh %v, %v, %v, want %v, %v, %v", step.at,
+				fresh("/default"), fresh("/snapshot"), fresh("/forever"), step.deflt, step.snapshot, step.forever)
+		}
+	}
+}
+
+func TestWithKey(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	h := &counting{body: "product 42"}
+	chained := c.Chain(h)
+	// the slug resolved to an id in front of the cache
+	resolve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chained.ServeHTTP(w, r.WithContext(WithKey(r.Context(), "product:42")))
+	})
+	get(resolve, "/products/blue-widget")
+	get(resolve, "/products/42")
+
+	if _, ok := c.Peek("product:42"); !ok {
+		t.Fatal("the context key wasn't used")
+	}
+	if _, ok := c.Peek("/products/blue-widget"); ok {
+		t.Fatal("the Keyer was used despite the context key")
+	}
+	if h.count() != 1 {
+		t.Fatalf("%d upstream calls for two URLs of the same key", h.count())
+	}
+}
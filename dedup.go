@@ -0,0 +1,75 @@
+package burstcache
+
+import (
+	"net/http"
+)
+
+/*
+	Distinct keys can stand for the same upstream work, e.g. variants (see
+	VaryHeaders) of a response the backend computes the same way for all of them.
+	With DedupKey set, regenerations of keys that share a dedup key at the same
+	time run the handler once: the first one fills, the others wait for it and
+	each keep a copy under their own key. DedupKey must cover everything the
+	response depends on, the subject (see SubjectFunc) included, or one request
+	gets the response meant for another.
+*/
+
+/*
+	dedup is a regeneration in progress that others may share
+*/
+type dedup struct {
+	done   chan struct{}   // closed once the fill is over
+	result *ResponseCacher // a pristine copy of the response, nil if the fill panicked
+}
+
+/*
+	dedup regenerates key for r with fill, unless a regeneration with the same
+	dedup key is under way, in which case its response is copied
+*/
+func (c *Cache) dedup(cfg *CacheConfig, key string, r *http.Request, fill func() *ResponseCacher) *ResponseCacher {
+	if c.DedupKey == nil {
+		return fill()
+	}
+	dk := c.DedupKey(key, r)
+	if dk == "" {
+		return fill()
+	}
+
+	c.mu.Lock()
+	if d, ok := c.dedups[dk]; ok {
+		c.mu.Unlock()
+		<-d.done
+		if d.result == nil {
+			// the fill panicked, try our own
+			return fill()
+		}
+		// the id of when the shared fill started, like our own fill would have it (see fence):
+		// an Invalidate while we waited must still win over this copy
+		cache := d.result.clone(d.result.id)
+		// the copy is ours: our subject, our time to live, our settings, our variant
+		if c.SubjectFunc != nil {
+			cache.subject = c.SubjectFunc(r)
+		}
+		cache.ttl = c.requestTTL(cfg, r)
+		cache.settings = cfg
+		c.dimensions(key, cache, r)
+		return cache
+	}
+	if c.dedups == nil {
+		c.dedups = map[string]*dedup{}
+	}
+	d := &dedup{done: make(chan struct{})}
+	c.dedups[dk] = d
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.dedups, dk)
+		c.mu.Unlock()
+		close(d.done)
+	}()
+	cache := fill()
+	// copied before it is kept, keeping compresses it
+	d.result = cache.clone(cache.id)
+	return cache
+}
@@ -0,0 +1,96 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvalidateWinsOverDedupedFill(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Minute, time.Minute)
+	c.DedupKey = func(key string, r *http.Request) string { return "shared" }
+	var n int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) == 1 {
+			close(started)
+			<-release
+			w.Write([]byte("old"))
+			return
+		}
+		w.Write([]byte("new"))
+	}))
+
+	var wg sync.WaitGroup
+	bodies := map[string]*httptest.ResponseRecorder{"/a": httptest.NewRecorder(), "/b": httptest.NewRecorder()}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(bodies["/a"], httptest.NewRequest("GET", "/a", nil))
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		// waits for the fill of /a, to copy it
+		h.ServeHTTP(bodies["/b"], httptest.NewRequest("GET", "/b", nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Invalidate("/b")
+	close(release)
+	wg.Wait()
+
+	if got := bodies["/a"].Body.String(); got != "old" {
+		t.Fatalf("/a got %q", got)
+	}
+	if got := bodies["/b"].Body.String(); got != "new" {
+		t.Fatalf("/b got %q, the shared fill from before it was invalidated", got)
+	}
+	rec := httptest.NewRecorder()
+	if !c.ServeCached("/b", rec) || rec.Body.String() != "new" {
+		t.Fatalf("/b is cached as %q", rec.Body.String())
+	}
+	if n != 2 {
+		t.Fatalf("handler ran %d times, want the shared fill and the retry of /b", n)
+	}
+}
+
+func TestDedupSharesOneFill(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Minute, time.Minute)
+	c.DedupKey = func(key string, r *http.Request) string { return "shared" }
+	var n int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) == 1 {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("body"))
+	}))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a", nil))
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/b", nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n != 1 {
+		t.Fatalf("handler ran %d times for two keys sharing a dedup key", n)
+	}
+	for _, key := range []string{"/a", "/b"} {
+		if _, ok := c.Peek(key); !ok {
+			t.Errorf("%s isn't cached", key)
+		}
+	}
+}
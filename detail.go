@@ -0,0 +1,88 @@
+package burstcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	Served cached responses (those with the X-From-BurstCache marker) that aren't
+	the exact entry as this instance filled it say so in DetailHeader, one comma
+	separated value per way they differ:
+
+		FALLBACK(<key hash>)	promoted from the shared tier, filled by another instance
+		DERIVED(gzip)		inflated from the gzip compressed copy in memory, see Compress
+		DERIVED(deflate)	the same, compressed against a dictionary, see SetDictionary
+		DERIVED(headers-only)	cached without its body, see HeadersOnly
+
+	Keys never show, FALLBACK names the shared entry by the first 8 bytes of the
+	sha-256 of its key, in hex. Stats.Details counts the serves of each kind.
+*/
+
+/*
+	DetailHeader is where served cached responses tell how they were derived, it is one of burstcache's own
+*/
+const DetailHeader = ReservedHeaderPrefix + "Detail"
+
+/*
+	Detail is a way a served response differs from the exact entry filled here
+*/
+type Detail int
+
+const (
+	DetailFallback     Detail = iota // promoted from the shared tier
+	DetailDecompressed               // inflated from its compressed copy
+	DetailHeadersOnly                // cached without its body
+	numDetails
+)
+
+func (d Detail) String() string {
+	switch d {
+	case DetailFallback:
+		return "fallback"
+	case DetailDecompressed:
+		return "decompressed"
+	case DetailHeadersOnly:
+		return "headers-only"
+	}
+	return "unknown"
+}
+
+/*
+	detail sets DetailHeader on h for the cache about to be served, if it differs
+	from the exact entry, counting how
+*/
+func (c *Cache) detail(h http.Header, cache *ResponseCacher) {
+	var values []string
+	add := func(d Detail, value string) {
+		atomic.AddInt64(&c.details[d], 1)
+		values = append(values, value)
+	}
+	if cache.origin == OriginRestore {
+		add(DetailFallback, "FALLBACK("+keyHash(cache.key)+")")
+	}
+	if cache.compressed {
+		encoding := "gzip"
+		if cache.dict != nil {
+			encoding = "deflate"
+		}
+		add(DetailDecompressed, "DERIVED("+encoding+")")
+	}
+	if cache.headersOnly {
+		add(DetailHeadersOnly, "DERIVED(headers-only)")
+	}
+	if len(values) > 0 {
+		h.Set(DetailHeader, strings.Join(values, ", "))
+	}
+}
+
+/*
+	keyHash is how a key shows in DetailHeader: the first 8 bytes of its sha-256, in hex
+*/
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
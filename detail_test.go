@@ -0,0 +1,86 @@
+package burstcache
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetailHeader(t *testing.T) {
+	body := strings.Repeat("compressible ", 100)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/ack" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(body))
+	})
+	shared := NewMemoryStore()
+	instance := func(compress bool) (*Cache, http.Handler) {
+		c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+		c.Shared = shared
+		c.Compress = compress
+		c.HeadersOnly = func(r *http.Request) bool { return r.URL.Path == "/ack" }
+		return c, c.Chain(handler)
+	}
+
+	filler, h := instance(false)
+	for _, path := range []string{"/plain", "/shared", "/both"} {
+		get(h, path)
+	}
+	waitIdle(t, filler)
+	if detail := get(h, "/plain").Header().Get(DetailHeader); detail != "" {
+		t.Fatalf("the exact entry served with detail %q", detail)
+	}
+	if rec := get(h, "/plain"); rec.Body.String() != body || rec.Header().Get(markerHeader) == "" {
+		t.Fatalf("served %q, headers %v", rec.Body.String(), rec.Header())
+	}
+
+	restoring, h := instance(false)
+	get(h, "/shared")
+	compressing, hc := instance(true)
+	get(hc, "/both")
+	get(hc, "/gz")
+	get(hc, "/ack")
+	for _, tc := range []struct {
+		h      http.Handler
+		path   string
+		detail string
+	}{
+		{h, "/shared", "FALLBACK(" + keyHash("/shared") + ")"},
+		{hc, "/both", "FALLBACK(" + keyHash("/both") + "), DERIVED(gzip)"},
+		{hc, "/gz", "DERIVED(gzip)"},
+		{hc, "/ack", "DERIVED(headers-only)"},
+	} {
+		rec := get(tc.h, tc.path)
+		if detail := rec.Header().Get(DetailHeader); detail != tc.detail {
+			t.Fatalf("%s served with detail %q, want %q", tc.path, detail, tc.detail)
+		}
+		if strings.Contains(rec.Header().Get(DetailHeader), tc.path) {
+			t.Fatalf("%s shows its raw key", tc.path)
+		}
+		if tc.path != "/ack" && rec.Body.String() != body {
+			t.Fatalf("%s served %q", tc.path, rec.Body.String())
+		}
+	}
+
+	// the first requests were misses, served unmarked, so without detail
+	if n := restoring.Stats().Details[DetailFallback]; n != 1 {
+		t.Fatalf("%d fallbacks counted, want 1", n)
+	}
+	stats := compressing.Stats().Details
+	if stats[DetailFallback] != 1 || stats[DetailDecompressed] != 2 || stats[DetailHeadersOnly] != 1 {
+		t.Fatalf("details counted %v", stats)
+	}
+
+	// never kept with a response
+	c, _ := instance(false)
+	filled := filled("x")
+	filled.Head.Set(DetailHeader, "FALLBACK(0000000000000000)")
+	c.Store("/stored", filled)
+	if rec := get(c.Chain(handler), "/stored"); rec.Header().Get(DetailHeader) != "" {
+		t.Fatalf("a stored detail header was replayed: %v", rec.Header())
+	}
+}
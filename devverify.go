@@ -0,0 +1,138 @@
+package burstcache
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+/*
+	DevVerify is a development aid: the first time a regenerated entry is served
+	from the cache, the handler is run once more in the background, and what it
+	writes is compared with what the cache replays. Differences (a header lost on
+	the way, a trailing newline, another status) are reported as a Mismatch, to
+	OnMismatch or the log. Clients always get the cached response, the extra run
+	is thrown away.
+
+	It doubles the handler load of every regeneration, so it is off by default
+	and has no place in production.
+*/
+
+/*
+	DefaultVolatileHeaders are the headers DevVerify ignores when VolatileHeaders isn't set
+*/
+var DefaultVolatileHeaders = []string{"Date", "Expires", "Last-Modified", "Set-Cookie", "X-Request-Id"}
+
+/*
+	Mismatch reports how a cached replay differs from a new run of the handler
+*/
+type Mismatch struct {
+	Key         string   // the key, as shown to operators (see Redact)
+	CachedCode  int      // status the cache replays
+	HandlerCode int      // status the handler writes now
+	Headers     []string // names of the headers whose values differ, sorted
+	BodyOffset  int      // offset of the first byte the bodies differ in, -1 if they don't
+	CachedLen   int      // length of the replayed body
+	HandlerLen  int      // length of the body the handler writes now
+}
+
+/*
+	verify compares the entry, if the handler filled it, with a new run of the
+	handler for r. Once per entry, the first request served from it does.
+*/
+func (c *Cache) verify(next http.Handler, key string, r *http.Request, cache *ResponseCacher) {
+	if cache.origin != OriginMiss && cache.origin != OriginRefresh {
+		// not the handler's doing, nothing to compare with
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&cache.verified, 0, 1) {
+		return
+	}
+	// the run outlives the request
+	r = r.Clone(context.Background())
+	c.background(func() {
+		replay := NewResponseCacher(0)
+		if err := cache.Serve(replay, false); err != nil {
+			return
+		}
+		run := NewResponseCacher(0)
+		next.ServeHTTP(run, withFilling(r, c, key))
+		run.freeze()
+		run.sanitize()
+		run.normalize()
+		run.identity()
+
+		if m, ok := c.compare(key, replay, run); ok {
+			if c.OnMismatch != nil {
+				c.OnMismatch(m)
+			} else {
+				log.Printf("burstcache: DevVerify: replay of %s differs from the handler: %+v", m.Key, m)
+			}
+		}
+	})
+}
+
+/*
+	compare a replay with a run of the handler, ok is true when they differ
+*/
+func (c *Cache) compare(key string, replay, run *ResponseCacher) (m Mismatch, ok bool) {
+	volatile := map[string]bool{
+		// set by write, handlers mostly leave it to net/http
+		"Content-Length": true,
+	}
+	headers := c.VolatileHeaders
+	if headers == nil {
+		headers = DefaultVolatileHeaders
+	}
+	for _, name := range headers {
+		volatile[http.CanonicalHeaderKey(name)] = true
+	}
+
+	names := map[string]bool{}
+	for name := range replay.Head {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range run.Head {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	var differ []string
+	for name := range names {
+		if !volatile[name] && !equal(replay.Head.Values(name), run.Head.Values(name)) {
+			differ = append(differ, name)
+		}
+	}
+	sort.Strings(differ)
+
+	cached, handler := replay.Body.Bytes(), run.Body.Bytes()
+	m = Mismatch{
+		Key:         c.redact(key),
+		CachedCode:  replay.Code,
+		HandlerCode: run.Code,
+		Headers:     differ,
+		BodyOffset:  -1,
+		CachedLen:   len(cached),
+		HandlerLen:  len(handler),
+	}
+	if !bytes.Equal(cached, handler) {
+		m.BodyOffset = 0
+		for m.BodyOffset < len(cached) && m.BodyOffset < len(handler) && cached[m.BodyOffset] == handler[m.BodyOffset] {
+			m.BodyOffset++
+		}
+	}
+	return m, m.CachedCode != m.HandlerCode || len(differ) > 0 || m.BodyOffset >= 0
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package burstcache
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDevVerify(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.DevVerify = true
+	var mu sync.Mutex
+	var found []Mismatch
+	c.OnMismatch = func(m Mismatch) {
+		mu.Lock()
+		found = append(found, m)
+		mu.Unlock()
+	}
+	// drifts after its first run: a header and the trailing newline go
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().String())
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("X-Build", "1")
+			w.Write([]byte("hello\n"))
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	for i := 0; i < 3; i++ {
+		// never what clients get
+		if rec := get(h, "/x"); rec.Body.String() != "hello\n" {
+			t.Fatalf("request %d served %q", i, rec.Body.String())
+		}
+	}
+	waitIdle(t, c)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(found) != 1 {
+		t.Fatalf("%d mismatches reported, want one for the first replay", len(found))
+	}
+	m := found[0]
+	if m.Key != "/x" || m.CachedCode != 200 || m.HandlerCode != 200 || m.BodyOffset != 5 || m.CachedLen != 6 || m.HandlerLen != 5 {
+		t.Fatalf("mismatch %+v", m)
+	}
+	// Date is volatile
+	if len(m.Headers) != 1 || m.Headers[0] != "X-Build" {
+		t.Fatalf("headers %v differ, want X-Build only", m.Headers)
+	}
+}
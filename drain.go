@@ -0,0 +1,35 @@
+package burstcache
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+/*
+	A draining cache (e.g. on an instance that is being shut down during a deploy)
+	keeps serving what it has cached, fresh or stale, but no longer starts refreshes.
+	Cold misses are passed through to the handler without being cached, and Store
+	and Warm fail with ErrClosed.
+*/
+
+/*
+	Drain puts the cache in draining mode, which can't be undone
+*/
+func (c *Cache) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+/*
+	Draining reports whether the cache is draining
+*/
+func (c *Cache) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+/*
+	DrainOnShutdown makes the cache start draining as soon as srv.Shutdown is called.
+	Follow up with WaitIdle to let the refreshes that were already running land.
+*/
+func (c *Cache) DrainOnShutdown(srv *http.Server) {
+	srv.RegisterOnShutdown(c.Drain)
+}
@@ -0,0 +1,47 @@
+package burstcache
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainingDoesntRegenerate(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	h := &counting{body: "body"}
+	served := c.Chain(h)
+	get(served, "/a")
+
+	srv := &http.Server{}
+	c.DrainOnShutdown(srv)
+	srv.Shutdown(context.Background())
+	// the shutdown hooks run in goroutines of their own
+	for deadline := time.Now().Add(time.Second); !c.Draining() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if !c.Draining() {
+		t.Fatal("not draining after Shutdown")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if rec := get(served, "/a"); rec.Body.String() != "body" {
+			t.Fatalf("served %q while draining", rec.Body.String())
+		}
+	}
+	waitIdle(t, c)
+	if h.count() != 1 {
+		t.Fatalf("%d upstream calls for a stale key, want no refresh while draining", h.count())
+	}
+	if meta, _ := c.Peek("/a"); meta.Fresh {
+		t.Fatal("the stale cache was refreshed while draining")
+	}
+
+	// cold misses are passed through, not filled
+	get(served, "/b")
+	get(served, "/b")
+	if _, ok := c.Peek("/b"); ok || h.count() != 3 {
+		t.Fatalf("%d upstream calls, a cold miss was cached while draining", h.count())
+	}
+}
@@ -0,0 +1,21 @@
+package burstcache
+
+import (
+	"errors"
+)
+
+/*
+	The errors returned by the cache operations, wrapped with details, so test
+	for them with errors.Is. Writes to a ResponseCacher fail with ErrTooLarge and
+	ErrLateWrite, and Store refuses bodies beyond MaxBodyBytes with ErrTooLarge too.
+	Once a cache is draining (see Drain), Store and Warm fail with ErrClosed.
+*/
+var (
+	ErrNotFound         = errors.New("burstcache: not cached")
+	ErrKeyerRequired    = errors.New("burstcache: a Keymaker is required")
+	ErrStoreUnavailable = errors.New("burstcache: shared store unavailable")
+	ErrInvalidPattern   = errors.New("burstcache: invalid pattern")
+	ErrInvalidSpec      = errors.New("burstcache: invalid key spec")
+	ErrClosed           = errors.New("burstcache: cache is draining")
+	ErrNotCacheable     = errors.New("burstcache: response not cacheable")
+)
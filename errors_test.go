@@ -0,0 +1,80 @@
+package burstcache
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestErrors(t *testing.T) {
+	c := NewCache(nil, nil, time.Second, time.Second)
+	if err := c.Remove("/nope"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Remove of a missing key: %v", err)
+	}
+	if err := c.RemoveRequest(httptest.NewRequest("GET", "/x", nil)); !errors.Is(err, ErrKeyerRequired) {
+		t.Fatalf("RemoveRequest without a Keymaker: %v", err)
+	}
+	if _, err := c.RemoveMatching("[a"); !errors.Is(err, ErrInvalidPattern) {
+		t.Fatalf("RemoveMatching of a bad pattern: %v", err)
+	}
+	if _, err := NewSpecKeymaker(); !errors.Is(err, ErrInvalidSpec) {
+		t.Fatalf("NewSpecKeymaker of nothing: %v", err)
+	}
+	c.Store("/a/1", filled("x"))
+	c.Shared = failStore{}
+	if err := c.Remove("/a/1"); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("Remove with the shared store down: %v", err)
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	c := NewCache(nil, nil, time.Second, time.Second)
+	c.MaxBodyBytes = 4
+	if err := c.Store("/big", filled("too large")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Store of a body beyond MaxBodyBytes: %v", err)
+	}
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.MinBodyBytes = 2 })
+	if err := c.Store("/small", filled("x")); !errors.Is(err, ErrNotCacheable) || errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Store of a body below MinBodyBytes: %v", err)
+	}
+	if err := c.Store("/ok", filled("fine")); err != nil {
+		t.Fatalf("Store of a cacheable response: %v", err)
+	}
+
+	c.Drain()
+	if err := c.Store("/ok", filled("fine")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Store once draining: %v", err)
+	}
+	if code := errorStatus(fmt.Errorf("wrapped: %w", ErrClosed)); code != 503 {
+		t.Fatalf("ErrClosed maps to %d, want 503", code)
+	}
+}
+
+func TestAdminErrorStatus(t *testing.T) {
+	c := NewCache(nil, nil, time.Second, time.Second)
+	c.Store("/a/1", filled("x"))
+	h := c.AdminHandler()
+	for query, code := range map[string]int{
+		"key=/nope":    404,
+		"pattern=%5Ba": 400,
+		"url=/x":       400,
+		"":             400,
+		"pattern=/a/*": 200,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("DELETE", "/entries?"+query, nil))
+		if rec.Code != code {
+			t.Fatalf("DELETE /entries?%s: %d %q, want %d", query, rec.Code, rec.Body.String(), code)
+		}
+	}
+
+	c.Store("/a/1", filled("x"))
+	c.Shared = failStore{}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("DELETE", "/entries?key=/a/1", nil))
+	if rec.Code != 503 {
+		t.Fatalf("DELETE with the shared store down: %d, want 503", rec.Code)
+	}
+}
@@ -0,0 +1,96 @@
+package burstcache
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	With Events set, the cache remembers its last decisions in a ring buffer:
+	how Chain answered each request, and what happened in the background
+	(refreshes, kills, evictions). When something went wrong, RecentEvents
+	shows what the cache was doing, without logging all of it all of the time.
+	Without Events nothing is recorded, and nothing is allocated for it.
+*/
+
+/*
+	The decisions an Event records besides the Outcomes of requests
+*/
+const (
+	DecisionPassThrough = "passthrough" // a miss passed through uncached (draining, MayFill, recursion)
+	DecisionRefresh     = "refresh"     // a background refresh landed, Took is how long it took
+	DecisionBackoff     = "backoff"     // a background refresh failed and was dropped for the stale response, see RefreshBackoff
+	DecisionKill        = "kill"        // a stale entry died
+	DecisionEvict       = "evict"       // an entry was evicted to stay within MaxBytes
+	DecisionIdle        = "idle"        // an entry was evicted for not being served within IdleTimeout
+	DecisionPressure    = "pressure"    // an entry was evicted to relieve memory pressure, see WatchMemory
+	DecisionReconfigure = "reconfigure" // settings changed (Reconfigure, SetTTL, SetTTD), Changed lists them
+)
+
+/*
+	Event is one decision of the cache
+*/
+type Event struct {
+	At       time.Time     // when the decision was made, or the request came in
+	Key      string        // the key, as shown to operators (see Redact)
+	Decision string        // an Outcome (hit, stale, collapsed, miss) or one of the Decision constants
+	Took     time.Duration // how long the request (or refresh) took, 0 for the others
+	Changed  []string      // with DecisionReconfigure, the settings that changed, as "name old -> new"
+}
+
+/*
+	events is the ring buffer, guarded by its own lock so recording never waits for the cache
+*/
+type events struct {
+	mu   sync.Mutex
+	ring []Event // allocated on the first event
+	next int     // where the next event goes
+	full bool    // the ring wrapped, everything in it is an event
+}
+
+func (e *events) add(size int, event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.ring) != size {
+		// first event, or Events changed: start over
+		e.ring, e.next, e.full = make([]Event, size), 0, false
+	}
+	e.ring[e.next] = event
+	e.next++
+	if e.next == size {
+		e.next, e.full = 0, true
+	}
+}
+
+/*
+	event records a decision on key, started at start (zero when it took no time)
+*/
+func (c *Cache) event(key string, decision string, start time.Time) {
+	if c.Events <= 0 {
+		return
+	}
+	event := Event{At: time.Now(), Key: key, Decision: decision}
+	if !start.IsZero() {
+		event.At, event.Took = start, event.At.Sub(start)
+	}
+	c.events.add(c.Events, event)
+}
+
+/*
+	RecentEvents returns the last Events decisions of the cache, oldest first
+*/
+func (c *Cache) RecentEvents() []Event {
+	c.events.mu.Lock()
+	var recent []Event
+	if c.events.full {
+		recent = append(recent, c.events.ring[c.events.next:]...)
+	}
+	recent = append(recent, c.events.ring[:c.events.next]...)
+	c.events.mu.Unlock()
+
+	for i := range recent {
+		// redacted on the way out, recording should stay cheap
+		recent[i].Key = c.redact(recent[i].Key)
+	}
+	return recent
+}
@@ -0,0 +1,34 @@
+package burstcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRecentEvents(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	h := c.Chain(&counting{body: "x"})
+	get(h, "/0")
+	if events := c.RecentEvents(); len(events) != 0 {
+		t.Fatalf("%d events recorded without Events", len(events))
+	}
+
+	c.Events = 3
+	for i := 1; i < 5; i++ {
+		get(h, fmt.Sprint("/", i))
+	}
+	get(h, "/4")
+	events := c.RecentEvents()
+	if len(events) != 3 {
+		t.Fatalf("%d events kept, want the last 3", len(events))
+	}
+	for i, want := range []Event{{Key: "/3", Decision: "miss"}, {Key: "/4", Decision: "miss"}, {Key: "/4", Decision: "hit"}} {
+		if events[i].Key != want.Key || events[i].Decision != want.Decision {
+			t.Fatalf("event %d is %s %s, want %s %s", i, events[i].Decision, events[i].Key, want.Decision, want.Key)
+		}
+	}
+	if events[2].At.Before(events[1].At) {
+		t.Fatalf("events out of order: %v", events)
+	}
+}
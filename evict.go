@@ -0,0 +1,156 @@
+package burstcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+	With MaxBytes set, entries are evicted while the estimated memory held by the
+	cache exceeds it. Stale entries go first, they are past their best anyway,
+	and among equals the least recently used one goes. Pinned keys are never
+	evicted, even if that leaves the cache over MaxBytes. Finding the very best
+	victim would mean scanning the whole cache on every store, so it is picked
+	from a sample of evictSamples entries instead (Go randomizes map iteration).
+*/
+const evictSamples = 16
+
+/*
+	evicts reports whether a should be evicted before b
+*/
+func evicts(a, b *ResponseCacher) bool {
+	if a.fresh != b.fresh {
+		return !a.fresh
+	}
+	return atomic.LoadInt64(&a.used) < atomic.LoadInt64(&b.used)
+}
+
+/*
+	evict entries until the cache fits in MaxBytes again, keep is never evicted.
+	The caller must hold the lock.
+*/
+func (c *Cache) evict(keep *ResponseCacher) {
+	max := c.settings().MaxBytes
+	if max <= 0 {
+		return
+	}
+	n := c.shrink(max, keep, CauseEvicted, DecisionEvict)
+	atomic.AddInt64(&c.stats.Evictions, int64(n))
+}
+
+/*
+	shrink evicts entries until the cache holds at most max bytes, keep is never
+	evicted. Returns how many went, counted as cause and recorded as decision.
+	The caller must hold the lock.
+*/
+func (c *Cache) shrink(max int64, keep *ResponseCacher, cause Cause, decision string) int {
+	evicted := 0
+	for c.bytes > max {
+		var victim *ResponseCacher
+		n := 0
+		for key, cache := range c.caches {
+			if cache == keep || c.pinned[key] {
+				continue
+			}
+			if victim == nil || evicts(cache, victim) {
+				victim = cache
+			}
+			if n++; n == evictSamples {
+				break
+			}
+		}
+		if victim == nil {
+			break
+		}
+		c.drop(victim.key, cause)
+		evicted++
+		c.event(victim.key, decision, time.Time{})
+	}
+	return evicted
+}
+
+/*
+	With IdleTimeout set, entries nobody was served for that long are evicted,
+	however fresh: refreshes (and Store) keep an entry alive, not in use. One
+	timer sweeps them all, armed for when the first of them goes idle, but never
+	sooner than a sixteenth of IdleTimeout from now, so a busy cache isn't swept
+	over and over.
+*/
+
+/*
+	armSweep arms the idle sweep, if there is none pending. The caller must hold the lock.
+*/
+func (c *Cache) armSweep() {
+	if c.IdleTimeout <= 0 || c.sweep != nil {
+		return
+	}
+	c.sweep = c.clock().AfterFunc(c.IdleTimeout, c.sweepIdle)
+}
+
+/*
+	sweepIdle evicts the idle entries, and arms the next sweep if any are left
+*/
+func (c *Cache) sweepIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep = nil
+	timeout := c.IdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	now := c.now()
+	var next time.Time
+	for key, cache := range c.caches {
+		if c.pinned[key] {
+			continue
+		}
+		idle := time.Unix(0, atomic.LoadInt64(&cache.counts.accessed)).Add(timeout)
+		if !idle.After(now) {
+			c.drop(key, CauseIdle)
+			atomic.AddInt64(&c.stats.IdleEvictions, 1)
+			c.event(key, DecisionIdle, time.Time{})
+			continue
+		}
+		if next.IsZero() || idle.Before(next) {
+			next = idle
+		}
+	}
+	if next.IsZero() {
+		// nothing left to go idle, the next swap arms it again
+		return
+	}
+	d := next.Sub(now)
+	if min := timeout / 16; d < min {
+		d = min
+	}
+	c.sweep = c.clock().AfterFunc(d, c.sweepIdle)
+}
+
+/*
+	Pin exempts key from eviction (see MaxBytes, SubjectMax and IdleTimeout), whether it is cached
+	yet or not. It still goes stale and dies like any other entry.
+*/
+func (c *Cache) Pin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pinned == nil {
+		c.pinned = map[string]bool{}
+	}
+	c.pinned[key] = true
+}
+
+/*
+	Unpin makes key subject to eviction again
+*/
+func (c *Cache) Unpin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pinned, key)
+}
+
+/*
+	use marks the cache as used now
+*/
+func (c *ResponseCacher) use(now time.Time) {
+	atomic.StoreInt64(&c.used, now.UnixNano())
+}
@@ -0,0 +1,100 @@
+package burstcache
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvictsStaleFirst(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		staleAge int64 // how much longer ago /stale was used than /fresh
+	}{
+		{"equally old", 0},
+		{"stale used more recently", -int64(time.Minute)},
+	} {
+		c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+		c.Store("/fresh", filled("hello"))
+		c.Store("/stale", filled("hello"))
+		c.mu.Lock()
+		c.caches["/stale"].fresh = false
+		atomic.StoreInt64(&c.caches["/stale"].used, atomic.LoadInt64(&c.caches["/fresh"].used)-tc.staleAge)
+		c.mu.Unlock()
+		reconfigure(t, c, func(cfg *CacheConfig) { cfg.MaxBytes = c.Stats().Bytes })
+
+		c.Store("/new", filled("hello"))
+		_, fresh := c.Peek("/fresh")
+		_, stale := c.Peek("/stale")
+		if !fresh || stale || c.Stats().Evictions != 1 {
+			t.Fatalf("%s: fresh kept %v, stale kept %v, %d evictions; want the stale one evicted", tc.name, fresh, stale, c.Stats().Evictions)
+		}
+	}
+
+	// among equals, the least recently used goes
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Store("/old", filled("hello"))
+	c.Store("/recent", filled("hello"))
+	c.mu.Lock()
+	atomic.AddInt64(&c.caches["/old"].used, -int64(time.Minute))
+	c.mu.Unlock()
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.MaxBytes = c.Stats().Bytes })
+	c.Store("/new", filled("hello"))
+	if _, ok := c.Peek("/old"); ok {
+		t.Fatal("the least recently used fresh entry wasn't evicted")
+	}
+}
+
+func TestPinnedSurvivesEviction(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Pin("/critical")
+	c.Store("/critical", filled("hello"))
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.MaxBytes = 3 * c.Stats().Bytes })
+	for i := 0; i < 10; i++ {
+		c.Store(fmt.Sprint("/", i), filled("hello"))
+	}
+	if _, ok := c.Peek("/critical"); !ok {
+		t.Fatal("the pinned entry was evicted")
+	}
+	if got := c.Stats(); got.Entries != 3 || got.Evictions != 8 {
+		t.Fatalf("%d entries after %d evictions, want the others evicted to fit", got.Entries, got.Evictions)
+	}
+
+	c.Unpin("/critical")
+	for i := 10; i < 20; i++ {
+		c.Store(fmt.Sprint("/", i), filled("hello"))
+	}
+	if _, ok := c.Peek("/critical"); ok {
+		t.Fatal("the unpinned entry was never evicted")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.IdleTimeout = 100 * time.Millisecond
+	c.Pin("/pinned")
+	for _, key := range []string{"/refreshed", "/served", "/pinned"} {
+		c.Store(key, filled("x"))
+	}
+	for i := 0; i < 6; i++ {
+		time.Sleep(25 * time.Millisecond)
+		if i < 3 {
+			// kept warm, never served
+			c.Store("/refreshed", filled("x"))
+		}
+		c.ServeCached("/served", httptest.NewRecorder())
+	}
+	if _, ok := c.Peek("/refreshed"); ok {
+		t.Fatal("an entry refreshed but never served survived IdleTimeout")
+	}
+	for _, key := range []string{"/served", "/pinned"} {
+		if _, ok := c.Peek(key); !ok {
+			t.Fatalf("%s was evicted as idle", key)
+		}
+	}
+	if n := c.Stats().IdleEvictions; n != 1 {
+		t.Fatalf("%d idle evictions, want 1", n)
+	}
+}
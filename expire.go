@@ -0,0 +1,248 @@
+package burstcache
+
+import (
+	"time"
+)
+
+/*
+	Caches expire in two phases, each driven by a timer: when TTL has passed
+	since the cache was stored it becomes stale, and when TTD has passed after
+	that it is killed. Every timer carries the generation and phase it was
+	scheduled for, and does nothing when the cache has been replaced or
+	rescheduled in the meantime.
+
+	On top of that, a cache has at most one pending timer: (re)scheduling stops
+	the one it had, and so does replacing or removing the cache, all under the
+	lock. A timer that fired already but still waits for the lock re-checks the
+	generation and phase once it has it, so with tiny (or zero) TTL and TTD a
+	refresh can't be killed by what was scheduled for the generation it replaced.
+*/
+
+/*
+	schedule the cache to become stale TTL (see ttlFor) after it was stored.
+	A cache that is past that already (e.g. one from the shared tier, which was
+	stored elsewhere a while ago) is stale right away, counting TTD from the moment
+	it went stale. The caller must hold the lock.
+*/
+func (c *Cache) schedule(key string, cache *ResponseCacher) {
+	staleAt := cache.stored.Add(c.ttlFor(cache))
+	if cache.fresh && !staleAt.After(c.now()) {
+		cache.fresh = false
+		cache.staled = staleAt
+		c.scheduleKill(key, cache, staleAt.Add(c.ttd(key)).Sub(c.now()))
+		return
+	}
+	c.arm(cache, staleAt.Sub(c.now()), func(id int64, phase int) {
+		c.expireStale(key, id, phase)
+	})
+}
+
+/*
+	schedule a stale cache to be killed after d.
+	The caller must hold the lock.
+*/
+func (c *Cache) scheduleKill(key string, cache *ResponseCacher, d time.Duration) {
+	c.arm(cache, d, func(id int64, phase int) {
+		c.expireDead(key, id, phase)
+	})
+}
+
+/*
+	arm replaces the pending timer of the cache with one calling f after d, with the
+	generation and (new) phase it was armed for. The caller must hold the lock.
+*/
+func (c *Cache) arm(cache *ResponseCacher, d time.Duration, f func(id int64, phase int)) {
+	disarm(cache)
+	cache.phase++
+	id, phase := cache.id, cache.phase
+	cache.timer = c.clock().AfterFunc(d, func() {
+		f(id, phase)
+	})
+}
+
+/*
+	disarm stops the pending timer of the cache, if any. The caller must hold the lock.
+*/
+func disarm(cache *ResponseCacher) {
+	if cache.timer != nil {
+		cache.timer.Stop()
+		cache.timer = nil
+	}
+}
+
+/*
+	Mark the cache as stale. In this state a subsequent request may start a regeneration.
+*/
+func (c *Cache) expireStale(key string, id int64, phase int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cache := c.caches[key]
+	if cache == nil || cache.id != id || cache.phase != phase {
+		return
+	}
+	if cache.fresh {
+		cache.fresh = false
+		cache.staled = c.now()
+	}
+	c.scheduleKill(key, cache, c.ttd(key))
+}
+
+/*
+	Kill the stale cache, unless it is being regenerated or OnKillDecision vetoes it.
+	The hook runs without the lock, so the kill itself is checked again against
+	what is stored by then.
+*/
+func (c *Cache) expireDead(key string, id int64, phase int) {
+	meta, ok := c.current(key, id, phase)
+	if !ok || meta.Fresh {
+		return
+	}
+	if meta.Regen {
+		// it lives on until its refresh lands, which is overdue
+		c.graced(key, id, phase, graceDisconnected)
+		return
+	}
+	if c.OnKillDecision != nil && !c.OnKillDecision(key, meta) {
+		// vetoed, extend its life and ask again later
+		c.vetoes.hit(time.Now(), c.rateBucket())
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if cache := c.caches[key]; cache != nil && cache.id == id && cache.phase == phase {
+			c.scheduleKill(key, cache, c.killGrace(key))
+			if cache.grace == graceNone {
+				cache.grace = graceVetoed
+			}
+		}
+		return
+	}
+	c.killPhase(key, id, phase)
+}
+
+/*
+	killPhase kills the cache, but only if it is still the given generation and phase,
+	stale and not being regenerated
+*/
+func (c *Cache) killPhase(key string, id int64, phase int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cache := c.caches[key]; cache != nil && cache.id == id && cache.phase == phase && !cache.fresh && !cache.regen {
+		c.drop(key, CauseDied)
+		c.event(key, DecisionKill, time.Time{})
+	}
+}
+
+/*
+	current returns the CacheMeta of the cache, if it is still the given generation and phase
+*/
+func (c *Cache) current(key string, id int64, phase int) (CacheMeta, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cache := c.caches[key]
+	if cache == nil || cache.id != id || cache.phase != phase {
+		return CacheMeta{}, false
+	}
+	return cache.meta(), true
+}
+
+/*
+	How long a vetoed kill is postponed. The caller must hold the lock.
+*/
+func (c *Cache) killGrace(key string) time.Duration {
+	if grace := c.settings().KillGrace; grace > 0 {
+		return grace
+	}
+	if ttd := c.ttd(key); ttd > 0 {
+		return ttd
+	}
+	return time.Second
+}
+
+/*
+	SetTTL changes the time to live at runtime. New caches always get the new TTL,
+	with RescheduleExisting the fresh caches already stored go stale at
+	the moment they were stored plus the new TTL (which may be right away).
+*/
+func (c *Cache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	cfg := c.retune(func(cfg *CacheConfig) {
+		cfg.TTL = ttl
+	})
+	c.mu.Unlock()
+	if cfg.RescheduleExisting {
+		c.rescheduleFresh()
+	}
+}
+
+/*
+	rescheduleFresh applies the current TTL to the fresh caches, see reschedule
+*/
+func (c *Cache) rescheduleFresh() {
+	c.reschedule(func(key string, cache *ResponseCacher) {
+		if cache.fresh {
+			c.schedule(key, cache)
+		}
+	})
+}
+
+/*
+	SetTTD changes the time to die at runtime. New caches always get the new TTD,
+	with RescheduleExisting the stale caches already stored die at the moment
+	they went stale plus the new TTD (which may be right away).
+*/
+func (c *Cache) SetTTD(ttd time.Duration) {
+	c.mu.Lock()
+	cfg := c.retune(func(cfg *CacheConfig) {
+		cfg.TTD = ttd
+	})
+	c.mu.Unlock()
+	if cfg.RescheduleExisting {
+		c.rescheduleStale()
+	}
+}
+
+/*
+	rescheduleStale applies the current TTD to the stale caches, see reschedule
+*/
+func (c *Cache) rescheduleStale() {
+	c.reschedule(func(key string, cache *ResponseCacher) {
+		if !cache.fresh && !cache.staled.IsZero() {
+			c.scheduleKill(key, cache, cache.staled.Add(c.ttd(key)).Sub(c.now()))
+		}
+	})
+}
+
+/*
+	rescheduleChunk is how many caches reschedule handles per hold of the lock
+*/
+const rescheduleChunk = 256
+
+/*
+	reschedule calls f for every cache, with the lock held. It takes the caches
+	rescheduleChunk at a time and releases the lock in between, so requests aren't
+	stalled for as long as a walk over a large cache takes. Caches stored meanwhile
+	are scheduled by the new settings anyway. The caller must not hold the lock.
+*/
+func (c *Cache) reschedule(f func(key string, cache *ResponseCacher)) {
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.caches))
+	for key := range c.caches {
+		keys = append(keys, key)
+	}
+	c.mu.RUnlock()
+
+	for len(keys) > 0 {
+		n := rescheduleChunk
+		if n > len(keys) {
+			n = len(keys)
+		}
+		c.mu.Lock()
+		for _, key := range keys[:n] {
+			if cache := c.caches[key]; cache != nil {
+				// whatever is there now, it may have been replaced or removed meanwhile
+				f(key, cache)
+			}
+		}
+		c.mu.Unlock()
+		keys = keys[n:]
+	}
+}
@@ -0,0 +1,248 @@
+package burstcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	state returns the state Contains has for key
+*/
+func state(c *Cache, key string) State {
+	s, _ := c.Contains(httptest.NewRequest("GET", key, nil))
+	return s
+}
+
+/*
+	waitStale waits for the entry of key to go stale, its timer runs in the background
+*/
+func waitStale(t *testing.T, c *Cache, key string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if meta, ok := c.Peek(key); ok && !meta.Fresh {
+			return
+		}
+	}
+	t.Fatalf("%s didn't go stale", key)
+}
+
+func TestSetTTLReschedulesExisting(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Clock = clock
+	c.RescheduleExisting = true
+	// more than one chunk, every one of them must be rescheduled
+	n := 3*rescheduleChunk + 1
+	for i := 0; i < n; i++ {
+		c.Store(fmt.Sprint("/", i), filled("x"))
+	}
+	c.Pin("/0")
+
+	clock.Advance(10 * time.Millisecond)
+	c.SetTTL(60 * time.Millisecond)
+	clock.Advance(49 * time.Millisecond)
+	for _, key := range []string{"/0", "/1", fmt.Sprint("/", n-1)} {
+		if s := state(c, key); s != Fresh {
+			t.Fatalf("%s is %v 59ms after it was stored, the new TTL is 60ms", key, s)
+		}
+	}
+
+	clock.Advance(time.Millisecond)
+	for i := 0; i < n; i++ {
+		if s := state(c, fmt.Sprint("/", i)); s != Stale {
+			t.Fatalf("/%d is %v at the new TTL", i, s)
+		}
+	}
+
+	// already past the new TTL: stale right away
+	c.Store("/late", filled("x"))
+	clock.Advance(10 * time.Millisecond)
+	c.SetTTL(time.Millisecond)
+	if s := state(c, "/late"); s != Stale {
+		t.Fatalf("/late is %v, stored before the new TTL it is stale at once", s)
+	}
+}
+
+func TestSetTTDReschedulesExisting(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	c.Clock = clock
+	c.RescheduleExisting = true
+	for i := 0; i < rescheduleChunk+1; i++ {
+		c.Store(fmt.Sprint("/", i), filled("x"))
+	}
+	clock.Advance(20 * time.Millisecond)
+	if s := state(c, "/1"); s != Stale {
+		t.Fatalf("/1 is %v past TTL", s)
+	}
+
+	c.SetTTD(50 * time.Millisecond)
+	clock.Advance(34 * time.Millisecond)
+	if s := state(c, "/1"); s != Stale {
+		t.Fatalf("/1 is %v 49ms after going stale, the new TTD is 50ms", s)
+	}
+	clock.Advance(time.Millisecond)
+	if n := c.Stats().Entries; n != 0 {
+		t.Fatalf("%d entries alive at the new TTD", n)
+	}
+}
+
+func TestReconfigureReschedules(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Store("/x", filled("x"))
+	cfg := c.Config()
+	cfg.RescheduleExisting = true
+	cfg.TTL = time.Millisecond
+	if err := c.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if s := state(c, "/x"); s != Stale {
+		t.Fatalf("/x is %v after Reconfigure shortened TTL", s)
+	}
+}
+
+func TestKillVetoedWhileUpstreamDown(t *testing.T) {
+	var down int32 = 1
+	var asked int32
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, 5*time.Millisecond)
+	c.KillGrace = 10 * time.Millisecond
+	c.OnKillDecision = func(key string, meta CacheMeta) bool {
+		atomic.AddInt32(&asked, 1)
+		if key != "/x" || meta.Fresh {
+			t.Errorf("asked to kill %s, fresh %v", key, meta.Fresh)
+		}
+		// while the upstream is down, the stale response beats none
+		return atomic.LoadInt32(&down) == 0
+	}
+	c.Store("/x", filled("last known good"))
+
+	time.Sleep(60 * time.Millisecond)
+	if s := state(c, "/x"); s != Stale {
+		t.Fatalf("/x is %v long past TTL+TTD with every kill vetoed", s)
+	}
+	if n := atomic.LoadInt32(&asked); n < 2 {
+		t.Fatalf("asked %d times, want a veto to postpone the kill by KillGrace and ask again", n)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Peek("/x"); ok {
+		t.Fatal("/x still cached once the kill was allowed")
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	c.RefreshDelay = 50 * time.Millisecond
+	h := &counting{body: "body"}
+	served := c.Chain(h)
+	get(served, "/a")
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if rec := get(served, "/a"); rec.Body.String() != "body" {
+			t.Fatalf("served %q during the delay", rec.Body.String())
+		}
+	}
+	waitIdle(t, c)
+	if h.count() != 1 {
+		t.Fatalf("%d upstream calls during the delay, want no refresh", h.count())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		get(served, "/a")
+	}
+	waitIdle(t, c)
+	if h.count() != 2 {
+		t.Fatalf("%d upstream calls after the delay, want one refresh", h.count())
+	}
+}
+
+func TestTinyDurations(t *testing.T) {
+	for _, d := range []struct{ ttl, ttd time.Duration }{
+		{0, 0},
+		{time.Millisecond, 0},
+		{0, time.Millisecond},
+		{5 * time.Millisecond, time.Millisecond},
+		{20 * time.Millisecond, 5 * time.Millisecond},
+		{250 * time.Millisecond, 50 * time.Millisecond},
+	} {
+		clock := NewManualClock(time.Unix(0, 0))
+		c := NewCache(nil, nil, d.ttl, d.ttd)
+		c.Clock = clock
+		// what an entry stored age ago must be, by then its timers have fired
+		want := func(age time.Duration) State {
+			switch {
+			case age < d.ttl:
+				return Fresh
+			case age < d.ttl+d.ttd:
+				return Stale
+			}
+			return Dead
+		}
+		for i := 0; i < 100; i++ {
+			c.Store("k", filled("x"))
+			// the timers of the superseded generation must never hit the new one
+			var age time.Duration
+			for _, step := range []time.Duration{0, time.Duration(i%3) * time.Millisecond} {
+				clock.Advance(step)
+				age += step
+				if got := peekState(c, "k"); got != want(age) {
+					t.Fatalf("TTL %v, TTD %v: swap %d is %v at %v, want %v", d.ttl, d.ttd, i, got, age, want(age))
+				}
+			}
+		}
+		clock.Advance(d.ttl + d.ttd)
+		if _, ok := c.Peek("k"); ok {
+			t.Fatalf("TTL %v, TTD %v: still cached past TTL+TTD", d.ttl, d.ttd)
+		}
+		if n := clock.Pending(); n != 0 {
+			t.Fatalf("TTL %v, TTD %v: %d timers left behind", d.ttl, d.ttd, n)
+		}
+	}
+}
+
+/*
+	peekState returns the state of the entry cached under key, as Peek has it
+*/
+func peekState(c *Cache, key string) State {
+	meta, ok := c.Peek(key)
+	switch {
+	case !ok:
+		return Dead
+	case meta.Fresh:
+		return Fresh
+	}
+	return Stale
+}
+
+func TestStatusTTL(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 20*time.Millisecond, time.Second)
+	c.StatusTTL = map[int]time.Duration{http.StatusMovedPermanently: time.Hour}
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte("x"))
+	}))
+	get(h, "/old")
+	get(h, "/new")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if meta, _ := c.Peek("/new"); !meta.Fresh {
+			break
+		}
+	}
+	if meta, ok := c.Peek("/old"); !ok || !meta.Fresh {
+		t.Fatal("the 301 went stale within its StatusTTL")
+	}
+	if meta, ok := c.Peek("/new"); !ok || meta.Fresh {
+		t.Fatal("the 200 is fresh past TTL")
+	}
+}
@@ -0,0 +1,183 @@
+package burstcache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Cold misses on the same key are collapsed into a single fill. The request that
+	picks up the turn token generates the response, everybody else waits for it.
+	Before generating, the shared tier (if any) is asked for it.
+
+	When the fill fails (5xx), the token is handed back so exactly one waiter is
+	released to retry with its own request, while the others keep waiting for that
+	retry. Once RetryBudget retries are spent, all waiters get the failure response.
+	The failure is never fed back into the miss path, so there is no failure stampede.
+
+	An Invalidate of the key while it is being filled wins: the fill is thrown away,
+	and the filling request and its waiters start over with a new collapsed miss.
+*/
+type flight struct {
+	done    chan struct{}   // closed once result is final
+	turn    chan struct{}   // holds the token that allows one request to generate
+	result  *ResponseCacher // the final result, read only after done is closed
+	retries int             // retries spent, only touched by the token holder
+}
+
+/*
+	collapse fills the cache for key using generate, unless a fill is already under way,
+	in which case it waits for that one. shared is true when the returned response
+	was produced, or found in the cache, on behalf of another request.
+*/
+func (c *Cache) collapse(key string, generate func() *ResponseCacher) (cache *ResponseCacher, shared bool) {
+
+	c.mu.Lock()
+	if cache := c.caches[key]; cache != nil {
+		// double-checked: filled since we looked
+		c.mu.Unlock()
+		return cache, true
+	}
+	f, ok := c.flights[key]
+	if !ok {
+		f = &flight{
+			done: make(chan struct{}),
+			turn: make(chan struct{}, 1),
+		}
+		f.turn <- struct{}{}
+		c.flights[key] = f
+	}
+	c.mu.Unlock()
+
+	for {
+		select {
+		case <-f.done:
+			if f.result == nil {
+				// invalidated while filling, start over
+				return c.collapse(key, generate)
+			}
+			return f.result, true
+		case <-f.turn:
+			var cache *ResponseCacher
+			if f.retries == 0 {
+				// maybe another instance has it already
+				cache = c.fetch(key)
+			}
+			if cache == nil {
+				cache = generate()
+			}
+			if failed(cache) && !cache.oversize && f.retries < c.settingsOf(cache).RetryBudget {
+				// give somebody else a go, then keep waiting
+				f.retries++
+				f.turn <- struct{}{}
+				continue
+			}
+			kept := c.keep(key, cache)
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+			if !kept {
+				// invalidated while filling: nobody gets what was filled, all start over
+				close(f.done)
+				return c.collapse(key, generate)
+			}
+			f.result = cache
+			close(f.done)
+			return cache, false
+		}
+	}
+}
+
+/*
+	retryCold generates a cold fill for r, retrying it up to ColdRetries times when
+	it fails transiently (502, 503, 504), after a backoff that doubles with every
+	retry. A retry that can't start before the deadline of r (if any) isn't made,
+	nor is one for a client that went away: the last failure is returned instead.
+*/
+func (c *Cache) retryCold(r *http.Request, generate func() *ResponseCacher) *ResponseCacher {
+	cache := generate()
+	backoff := c.ColdRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultColdRetryBackoff
+	}
+	ctx := r.Context()
+	for retry := 0; retry < c.ColdRetries && transient(cache) && !cache.oversize; retry++ {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			break
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return cache
+		case <-timer.C:
+		}
+		cache = generate()
+		backoff *= 2
+	}
+	return cache
+}
+
+/*
+	defaultColdRetryBackoff is the ColdRetryBackoff used when it isn't set
+*/
+const defaultColdRetryBackoff = 10 * time.Millisecond
+
+/*
+	transient reports whether a fill failed in a way that may well pass when tried again
+*/
+func transient(cache *ResponseCacher) bool {
+	if cache.shed {
+		// ours, not the backend's
+		return false
+	}
+	switch cache.Code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+/*
+	failed reports whether a fill failed and may be worth retrying
+*/
+func failed(cache *ResponseCacher) bool {
+	return cache.Code >= 500
+}
+
+/*
+	fence marks the keys that are being filled (cold or refreshed) right now as
+	invalidated, so what those fills produce isn't swapped in afterwards. The fence
+	holds the last handed out cache id: caches with an id up to it were filled
+	from before the invalidation. It is lifted once such a fill lands.
+*/
+func (c *Cache) fence(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gen := atomic.LoadInt64(&c.gen)
+	for _, key := range keys {
+		cache := c.caches[key]
+		if c.flights[key] == nil && (cache == nil || !cache.regen) {
+			// nothing under way, nothing to fence
+			continue
+		}
+		if c.fences == nil {
+			c.fences = map[string]int64{}
+		}
+		c.fences[key] = gen
+	}
+}
+
+/*
+	fenced reports whether a cache with id, filled for key, started before an
+	Invalidate of key, lifting the fence if so. The caller must hold the lock.
+*/
+func (c *Cache) fenced(key string, id int64) bool {
+	gen, ok := c.fences[key]
+	if !ok || id > gen {
+		return false
+	}
+	delete(c.fences, key)
+	return true
+}
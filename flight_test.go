@@ -0,0 +1,225 @@
+package burstcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvalidateReleasesCollapsedWaiters(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	var n int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) == 1 {
+			close(started)
+			<-release
+			w.Write([]byte("old"))
+			return
+		}
+		w.Write([]byte("new"))
+	}))
+	var wg sync.WaitGroup
+	bodies := make([]string, 3)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i > 0 {
+				<-started
+				time.Sleep(10 * time.Millisecond)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+			bodies[i] = rec.Body.String()
+		}(i)
+	}
+	<-started
+	time.Sleep(30 * time.Millisecond)
+	c.Invalidate("/x")
+	close(release)
+	wg.Wait()
+	for i, body := range bodies {
+		if body != "new" {
+			t.Errorf("request %d got %q, the body of the fill that was invalidated", i, body)
+		}
+	}
+	if n != 2 {
+		t.Fatalf("handler ran %d times, want the invalidated fill and one retry", n)
+	}
+}
+
+func TestInvalidateWinsOverRefresh(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 10*time.Millisecond, time.Second)
+	var n int32
+	release := make(chan struct{})
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) == 2 {
+			<-release
+		}
+		w.Write([]byte("x"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	time.Sleep(20 * time.Millisecond)
+	// stale, a refresh starts
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	time.Sleep(10 * time.Millisecond)
+	c.Invalidate("/x")
+	close(release)
+	waitIdle(t, c)
+	if _, ok := c.Peek("/x"); ok {
+		t.Fatal("the refresh recreated the invalidated entry")
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	if _, ok := c.Peek("/x"); !ok {
+		t.Fatal("the fence keeps blocking fills after the invalidated one")
+	}
+}
+
+func waitIdle(t *testing.T, c *Cache) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.WaitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+	failing fails its first n requests with a 500, after taking a while so the others collapse onto them
+*/
+func failing(n int32, calls *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		if call <= n {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+func TestFailedFillIsRetriedByOneWaiter(t *testing.T) {
+	for _, tc := range []struct {
+		budget int
+		calls  int32
+		code   int
+	}{
+		{budget: 5, calls: 3, code: http.StatusOK},
+		{budget: 1, calls: 2, code: http.StatusInternalServerError},
+	} {
+		c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+		c.RetryBudget = tc.budget
+		var calls int32
+		h := c.Chain(failing(2, &calls))
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if rec := get(h, "/a"); rec.Code != tc.code {
+					t.Errorf("budget %d: answered %d, want %d", tc.budget, rec.Code, tc.code)
+				}
+			}()
+		}
+		wg.Wait()
+		if got := atomic.LoadInt32(&calls); got != tc.calls {
+			t.Fatalf("budget %d: %d upstream calls for 20 waiters, want %d", tc.budget, got, tc.calls)
+		}
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	var slow int32
+	release := make(chan struct{})
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-release
+		}
+		w.Write([]byte("body"))
+	}))
+	get(h, "/stale")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if meta, _ := c.Peek("/stale"); !meta.Fresh {
+			break
+		}
+	}
+	atomic.StoreInt32(&slow, 1)
+
+	// a background refresh and two cold fills, one with a waiter collapsed onto it
+	get(h, "/stale")
+	var wg sync.WaitGroup
+	for _, path := range []string{"/a", "/b", "/b"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			get(h, path)
+		}(path)
+	}
+	for deadline := time.Now().Add(time.Second); c.InFlight() < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := c.InFlight(); n != 3 {
+		t.Fatalf("%d in flight, want the refresh and two cold fills", n)
+	}
+
+	close(release)
+	wg.Wait()
+	waitIdle(t, c)
+	if n := c.InFlight(); n != 0 {
+		t.Fatalf("%d in flight once all completed", n)
+	}
+}
+
+func TestColdRetries(t *testing.T) {
+	unavailable := func(n int32, calls *int32) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(calls, 1) <= n {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		})
+	}
+	for _, tc := range []struct {
+		retries int
+		fails   int32
+		calls   int32
+		code    int
+	}{
+		{retries: 0, fails: 1, calls: 1, code: http.StatusServiceUnavailable},
+		{retries: 2, fails: 1, calls: 2, code: http.StatusOK},
+		{retries: 2, fails: 5, calls: 3, code: http.StatusServiceUnavailable},
+	} {
+		c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+		c.ColdRetries = tc.retries
+		c.ColdRetryBackoff = time.Millisecond
+		var calls int32
+		rec := httptest.NewRecorder()
+		c.Chain(unavailable(tc.fails, &calls)).ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+		if rec.Code != tc.code || calls != tc.calls {
+			t.Fatalf("%d retries of %d failures: %d after %d calls, want %d after %d", tc.retries, tc.fails, rec.Code, calls, tc.code, tc.calls)
+		}
+	}
+
+	// no retry that can't start before the deadline of the request
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.ColdRetries = 2
+	c.ColdRetryBackoff = time.Second
+	var calls int32
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	c.Chain(unavailable(1, &calls)).ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil).WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable || calls != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("retried past the deadline: %d after %d calls in %v", rec.Code, calls, time.Since(start))
+	}
+}
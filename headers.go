@@ -0,0 +1,46 @@
+package burstcache
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+	Headers of burstcache's own (the X-From-BurstCache marker, and everything
+	named with ReservedHeaderPrefix, like TagsHeader) are never part of a cached
+	response: they are scrubbed before a response is swapped in, before it is
+	written to the shared tier, and again when it is read from there, as another
+	service writing to the same store may not have. So a response never carries
+	the marker or debug headers of some other cache, be it one chained in front
+	of the handler or one on the other side of a shared store.
+*/
+
+const (
+	ReservedHeaderPrefix = "X-Burstcache-"     // headers of burstcache's own start with this (in canonical form)
+	markerHeader         = "X-From-BurstCache" // marks responses served from the cache, see Serve
+)
+
+/*
+	scrub removes the headers of burstcache's own from h, and those named by also
+	(e.g. the HealthHeader)
+*/
+func scrub(h http.Header, also ...string) {
+	for name := range h {
+		if reserved(name) {
+			delete(h, name)
+		}
+	}
+	for _, name := range also {
+		if name != "" {
+			h.Del(name)
+		}
+	}
+}
+
+/*
+	reserved reports whether the header named name is one of burstcache's own
+*/
+func reserved(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return strings.HasPrefix(name, ReservedHeaderPrefix) || name == http.CanonicalHeaderKey(markerHeader)
+}
@@ -0,0 +1,105 @@
+package burstcache
+
+import (
+	"time"
+)
+
+/*
+	Health tells middleware in front of the cache (e.g. traffic shaping that sheds
+	low priority requests) whether the cache is doing its job. It is derived from
+	what happened over the last rate buckets (see RateBucket): failing shared tier
+	operations, saturated regenerations and kills postponed by OnKillDecision.
+*/
+
+/*
+	HealthStatus is the overall state reported by Health
+*/
+type HealthStatus int
+
+const (
+	Healthy     HealthStatus = iota // all is well
+	Degraded                        // the cache serves, but see the reasons
+	PassThrough                     // the cache fills nothing anymore (draining), misses go straight to the handler
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case PassThrough:
+		return "passthrough"
+	}
+	return "unknown"
+}
+
+/*
+	Reasons for a Degraded health
+*/
+const (
+	ReasonStoreErrors = "store-errors" // too many recent shared tier operations failed, see StoreErrorRate
+	ReasonSaturated   = "saturated"    // too many regenerations are running, see MaxInFlight
+	ReasonGrace       = "grace"        // OnKillDecision recently kept dead caches alive
+)
+
+/*
+	defaultStoreErrorRate is the StoreErrorRate used when it isn't set
+*/
+const defaultStoreErrorRate = 0.1
+
+/*
+	minStoreOps is how many shared tier operations it takes before their error rate counts,
+	so a single failure on a quiet cache doesn't flag it
+*/
+const minStoreOps = 10
+
+/*
+	Health is the state of the cache, with the reasons when it is Degraded
+*/
+type Health struct {
+	Status  HealthStatus
+	Reasons []string
+}
+
+/*
+	Health returns the state of the cache right now
+*/
+func (c *Cache) Health() Health {
+	if c.Draining() {
+		return Health{Status: PassThrough}
+	}
+
+	now, bucket := time.Now(), c.rateBucket()
+	var reasons []string
+
+	threshold := c.StoreErrorRate
+	if threshold <= 0 {
+		threshold = defaultStoreErrorRate
+	}
+	if ops := c.storeOps.total(now, bucket); ops >= minStoreOps && c.storeErrors.total(now, bucket)/ops > threshold {
+		reasons = append(reasons, ReasonStoreErrors)
+	}
+	if c.MaxInFlight > 0 && c.InFlight() >= c.MaxInFlight {
+		reasons = append(reasons, ReasonSaturated)
+	}
+	if c.vetoes.total(now, bucket) > 0 {
+		reasons = append(reasons, ReasonGrace)
+	}
+
+	if len(reasons) > 0 {
+		return Health{Status: Degraded, Reasons: reasons}
+	}
+	return Health{Status: Healthy}
+}
+
+/*
+	countStore counts a shared tier operation and whether it failed, for Health
+*/
+func (c *Cache) countStore(err error) {
+	now, bucket := time.Now(), c.rateBucket()
+	c.storeOps.hit(now, bucket)
+	if err != nil {
+		c.storeErrors.hit(now, bucket)
+	}
+}
@@ -0,0 +1,90 @@
+package burstcache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	failStore is a shared tier that is down
+*/
+type failStore struct{}
+
+func (failStore) Get(string) ([]byte, bool, error)        { return nil, false, errors.New("down") }
+func (failStore) Set(string, []byte, time.Duration) error { return errors.New("down") }
+func (failStore) Delete(string) error                     { return errors.New("down") }
+
+func TestHealth(t *testing.T) {
+	captureLog(t)
+	healthy := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	if h := healthy.Health(); h.Status != Healthy || h.Reasons != nil {
+		t.Fatalf("a new cache is %v %v", h.Status, h.Reasons)
+	}
+	reasons := func(c *Cache, want ...string) {
+		t.Helper()
+		if h := c.Health(); h.Status != Degraded || !reflect.DeepEqual(h.Reasons, want) {
+			t.Fatalf("health %v %v, want degraded for %v", h.Status, h.Reasons, want)
+		}
+	}
+
+	// store errors, shown on the served responses too
+	broken := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	broken.Shared = failStore{}
+	broken.HealthHeader = "X-Cache-Health"
+	h := broken.Chain(&counting{body: "body"})
+	fills(h, "/", minStoreOps)
+	waitIdle(t, broken)
+	reasons(broken, ReasonStoreErrors)
+	if got := get(h, "/0").Header().Get("X-Cache-Health"); got != "degraded" {
+		t.Fatalf("served with health header %q", got)
+	}
+	// unless the threshold allows for it
+	broken.StoreErrorRate = 1
+	if status := broken.Health().Status; status != Healthy {
+		t.Fatalf("%v with every error allowed for", status)
+	}
+
+	// saturated regenerations
+	saturated := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	saturated.MaxInFlight = 2
+	release := make(chan struct{})
+	h = saturated.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			get(h, fmt.Sprint("/", i))
+		}(i)
+	}
+	for deadline := time.Now().Add(time.Second); saturated.InFlight() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	reasons(saturated, ReasonSaturated)
+	close(release)
+	wg.Wait()
+	if status := saturated.Health().Status; status != Healthy {
+		t.Fatalf("%v once the regenerations completed", status)
+	}
+
+	// dead caches kept alive
+	grace := NewCache(&Keymaker{}, nil, time.Millisecond, time.Millisecond)
+	grace.KillGrace = time.Hour
+	grace.OnKillDecision = func(key string, meta CacheMeta) bool { return false }
+	grace.Store("/x", filled("last known good"))
+	time.Sleep(20 * time.Millisecond)
+	reasons(grace, ReasonGrace)
+
+	// draining
+	grace.Drain()
+	if h := grace.Health(); h.Status != PassThrough {
+		t.Fatalf("a draining cache is %v", h.Status)
+	}
+}
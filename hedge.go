@@ -0,0 +1,69 @@
+package burstcache
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	With HedgeAfter set, a cold fill that takes longer than that is raced by a
+	second request to the handler. Whichever finishes first is cached and served,
+	the request of the other one is cancelled (through its context) and its
+	response thrown away. This caps the tail latency of cold misses at the price of
+	extra load on the handler, so set HedgeAfter well above the usual fill duration.
+
+	Requests with a body aren't hedged, it can't be read twice. Neither attempt can
+	hand an oversize response over to the client while it is filling, so when the
+	winner turns out oversize the request is passed through after all.
+*/
+
+/*
+	hedge fills key like fill does, hedging it when it takes longer than HedgeAfter
+*/
+func (c *Cache) hedge(cfg *CacheConfig, next http.Handler, key string, r *http.Request, spill http.ResponseWriter) *ResponseCacher {
+	if c.HedgeAfter <= 0 || r.ContentLength != 0 || r.Body != nil && r.Body != http.NoBody {
+		return c.fill(cfg, next, key, r, OriginMiss, spill)
+	}
+
+	type attempt struct {
+		cache  *ResponseCacher
+		hedged bool
+	}
+	results := make(chan attempt, 2)
+	start := func(hedged bool) context.CancelFunc {
+		ctx, cancel := context.WithCancel(r.Context())
+		go func() {
+			results <- attempt{c.fill(cfg, next, key, r.WithContext(ctx), OriginMiss, nil), hedged}
+		}()
+		return cancel
+	}
+
+	cancelFirst := start(false)
+	defer cancelFirst()
+
+	timer := time.NewTimer(c.HedgeAfter)
+	defer timer.Stop()
+
+	select {
+	case first := <-results:
+		return first.cache
+	case <-timer.C:
+	}
+
+	if !c.mayRegenerate() {
+		// no token to spare for a hedge
+		return (<-results).cache
+	}
+	atomic.AddInt64(&c.stats.Hedges, 1)
+	cancelHedge := start(true)
+	defer cancelHedge()
+
+	winner := <-results
+	if winner.hedged {
+		atomic.AddInt64(&c.stats.HedgeWins, 1)
+	}
+	// the deferred cancels stop the loser
+	return winner.cache
+}
@@ -0,0 +1,67 @@
+package burstcache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgedFill(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.HedgeAfter = 20 * time.Millisecond
+	var calls int32
+	cancelled := make(chan struct{})
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			w.Write([]byte("fast"))
+			return
+		}
+		// the first call hangs until the hedge beat it
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(2 * time.Second):
+		}
+		w.Write([]byte("slow"))
+	}))
+
+	start := time.Now()
+	if rec := get(h, "/x"); rec.Body.String() != "fast" || time.Since(start) > time.Second {
+		t.Fatalf("served %q after %v, want the hedge", rec.Body.String(), time.Since(start))
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow call wasn't cancelled")
+	}
+	if rec := get(h, "/x"); rec.Body.String() != "fast" || rec.Header().Get(markerHeader) == "" {
+		t.Fatalf("cached %q, want the hedge's response", rec.Body.String())
+	}
+	if s := c.Stats(); s.Hedges != 1 || s.HedgeWins != 1 || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("%d hedges, %d won, %d upstream calls", s.Hedges, s.HedgeWins, calls)
+	}
+}
+
+func TestNoHedgeForFastFills(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.HedgeAfter = 50 * time.Millisecond
+	h := &counting{body: "body"}
+	get(c.Chain(h), "/x")
+	time.Sleep(60 * time.Millisecond)
+	if s := c.Stats(); s.Hedges != 0 || h.count() != 1 {
+		t.Fatalf("%d hedges and %d upstream calls for a fast fill", s.Hedges, h.count())
+	}
+}
+
+func TestHedgedOversizeFill(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.HedgeAfter = 20 * time.Millisecond
+	c.MaxBodyBytes = 3
+	if rec := get(c.Chain(&counting{body: "toolarge"}), "/x"); rec.Body.String() != "toolarge" {
+		t.Fatalf("served %q", rec.Body.String())
+	}
+	if _, ok := c.Peek("/x"); ok {
+		t.Fatal("an oversize response was cached")
+	}
+}
@@ -0,0 +1,75 @@
+package burstcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+/*
+	Background work (refreshes and writes to the shared tier) is tracked,
+	so a shutting down instance can give it a chance to finish:
+
+		c.DrainOnShutdown(srv)
+		...
+		srv.Shutdown(ctx)
+		c.WaitIdle(ctx)
+*/
+type idle struct {
+	mu   sync.Mutex
+	n    int           // background jobs running
+	done chan struct{} // closed when n drops to zero
+}
+
+func (i *idle) add() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.n == 0 {
+		i.done = make(chan struct{})
+	}
+	i.n++
+}
+
+func (i *idle) release() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.n--
+	if i.n == 0 {
+		close(i.done)
+	}
+}
+
+/*
+	background runs f in a goroutine, tracked by WaitIdle
+*/
+func (c *Cache) background(f func()) {
+	c.idle.add()
+	go func() {
+		defer c.idle.release()
+		f()
+	}()
+}
+
+/*
+	WaitIdle blocks until all background refreshes and pending writes to the
+	shared tier are done, or ctx expires. In the latter case the error tells
+	how much work was still outstanding.
+*/
+func (c *Cache) WaitIdle(ctx context.Context) error {
+	c.idle.mu.Lock()
+	n, done := c.idle.n, c.idle.done
+	c.idle.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.idle.mu.Lock()
+		n = c.idle.n
+		c.idle.mu.Unlock()
+		return fmt.Errorf("burstcache: %d background jobs still outstanding: %w", n, ctx.Err())
+	}
+}
@@ -0,0 +1,59 @@
+package burstcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitIdle(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	var slow int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("body"))
+	}))
+	if err := c.WaitIdle(context.Background()); err != nil {
+		t.Fatalf("waiting on an idle cache: %v", err)
+	}
+
+	// three slow refreshes
+	for i := 0; i < 3; i++ {
+		get(h, fmt.Sprint("/", i))
+	}
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt32(&slow, 1)
+	for i := 0; i < 3; i++ {
+		get(h, fmt.Sprint("/", i))
+	}
+
+	// too tight a deadline tells how much is left
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := c.WaitIdle(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "3 background jobs") {
+		t.Fatalf("waiting with a tight deadline: %v", err)
+	}
+
+	// a generous one sees them land
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.WaitIdle(ctx); err != nil {
+		t.Fatalf("waiting with a generous deadline: %v", err)
+	}
+	if c.InFlight() != 0 {
+		t.Fatalf("%d in flight once idle", c.InFlight())
+	}
+	for i := 0; i < 3; i++ {
+		if meta, _ := c.Peek(fmt.Sprint("/", i)); !meta.Fresh {
+			t.Fatalf("/%d wasn't refreshed once idle", i)
+		}
+	}
+}
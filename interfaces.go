@@ -1,10 +1,16 @@
 package burstcache
 
+import (
+	"net/http"
+	"time"
+)
+
 /*
 	Keyer implementations produce a key or hash given a request.
 	This interface also includes the responsewriter, allowing communication between upstream
 	handlers and keyers by using response headers. It also allows for keyers to
 	write the key to downstream handlers or the client as a response header.
+	An empty key means the request must not be cached, it is passed through.
 */
 type Keyer interface {
 	Key(w http.ResponseWriter, r *http.Request) string
@@ -16,3 +22,40 @@ type Keyer interface {
 type Chainer interface {
 	Chain(next http.Handler) http.Handler
 }
+
+/*
+	Storer is a shared cache tier (e.g. Redis) behind the local one. On a local miss
+	it is consulted before the handler is, and every response stored locally is
+	stored there too. It deals in encoded responses only, which keeps
+	implementations trivial. ttl is how long the response is of use.
+*/
+type Storer interface {
+	Get(key string) (data []byte, ok bool, err error)
+	Set(key string, data []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+/*
+	BatchStorer is a Storer that can delete many keys in one round trip (e.g. with
+	a pipeline), which invalidating by tag or pattern then does. A batch that fails
+	is retried key by key with Delete, so the error needn't tell which keys failed.
+*/
+type BatchStorer interface {
+	Storer
+	DeleteBatch(keys []string) error
+}
+
+/*
+	Locker is a Storer that can lock keys for all instances sharing it (e.g. with
+	SET NX PX in Redis), so that one of them at a time regenerates a key. A lock is
+	held until Unlock or until ttl has passed, so an instance that dies doesn't hold
+	it forever. Locks live apart from the entries: Set and Delete don't touch them.
+	Every lock granted on a key carries a generation greater than any granted on it
+	before, so a holder whose lock expired (and went to another) can tell, and its
+	Unlock of that generation does nothing.
+*/
+type Locker interface {
+	Storer
+	TryLock(key string, ttl time.Duration) (generation int64, ok bool, err error)
+	Unlock(key string, generation int64) error
+}
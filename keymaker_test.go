@@ -0,0 +1,31 @@
+package burstcache_test
+
+import (
+	"testing"
+
+	"github.com/DapperDodo/burstcache"
+	"github.com/DapperDodo/burstcache/cachetest"
+)
+
+func TestKeymakersFuzz(t *testing.T) {
+	scheme, err := burstcache.NewSchemeKeymaker(&burstcache.Keymaker{}, "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := burstcache.NewSpecKeymaker("path", "query", "header:Accept", "cookie:session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, keyer := range map[string]burstcache.Keyer{
+		"Keymaker":       &burstcache.Keymaker{},
+		"BotKeymaker":    &burstcache.BotKeymaker{Keyer: &burstcache.Keymaker{}},
+		"SchemeKeymaker": scheme,
+		"QueryKeymaker":  &burstcache.QueryKeymaker{Keyer: &burstcache.Keymaker{}},
+		"SpecKeymaker":   spec,
+		"AuthKeymaker":   &burstcache.AuthKeymaker{Keyer: &burstcache.Keymaker{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cachetest.KeyerFuzz(t, keyer, 200)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package burstcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+	KeyStats is a snapshot of the activity of one key, e.g. to find the hot keys
+	or to tune the budgets of subjects. Like the request rate, the counts belong
+	to the key: they carry over when its response is refreshed or replaced.
+*/
+type KeyStats struct {
+	Hits       int64     // requests Chain answered from the cache, fresh, stale or collapsed
+	Misses     int64     // requests Chain filled the key for
+	Serves     int64     // times the current response was served
+	LastAccess time.Time // when the current response was last stored or served
+	Size       int       // estimated memory held by the current response, see CacheMeta.Memory
+	Generation int64     // responses swapped in under the key so far, 1 for the first
+}
+
+/*
+	keyCounts are the counters behind KeyStats, shared by the caches of a key
+*/
+type keyCounts struct {
+	hits       int64 // updated atomically
+	misses     int64 // updated atomically
+	generation int64 // updated atomically
+	accessed   int64 // when the key was first stored or last served in unix nanoseconds, updated atomically, see IdleTimeout
+}
+
+/*
+	count a request Chain answered with outcome
+*/
+func (k *keyCounts) count(outcome Outcome) {
+	if k == nil {
+		// not stored, nobody will ask
+		return
+	}
+	if outcome == OutcomeMiss {
+		atomic.AddInt64(&k.misses, 1)
+	} else {
+		atomic.AddInt64(&k.hits, 1)
+	}
+}
+
+/*
+	access marks the key as accessed at now
+*/
+func (k *keyCounts) access(now time.Time) {
+	if k != nil {
+		atomic.StoreInt64(&k.accessed, now.UnixNano())
+	}
+}
+
+/*
+	KeyStats returns the activity of key. ok is false when key isn't cached.
+*/
+func (c *Cache) KeyStats(key string) (stats KeyStats, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cache := c.caches[key]
+	if cache == nil {
+		return KeyStats{}, false
+	}
+	return KeyStats{
+		Hits:       atomic.LoadInt64(&cache.counts.hits),
+		Misses:     atomic.LoadInt64(&cache.counts.misses),
+		Serves:     atomic.LoadInt64(&cache.serves),
+		LastAccess: time.Unix(0, atomic.LoadInt64(&cache.used)),
+		Size:       cache.size,
+		Generation: atomic.LoadInt64(&cache.counts.generation),
+	}, true
+}
@@ -0,0 +1,36 @@
+package burstcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyStats(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 20*time.Millisecond, time.Hour)
+	h := c.Chain(&counting{body: "hello"})
+	if _, ok := c.KeyStats("/k"); ok {
+		t.Fatal("stats of a key never filled")
+	}
+	for i := 0; i < 3; i++ {
+		get(h, "/k")
+	}
+	s, ok := c.KeyStats("/k")
+	if !ok || s.Hits != 2 || s.Misses != 1 || s.Serves != 3 || s.Generation != 1 {
+		t.Fatalf("after a fill and 2 hits: %+v", s)
+	}
+	if s.Size == 0 || time.Since(s.LastAccess) > time.Second {
+		t.Fatalf("size %d, last access %v ago", s.Size, time.Since(s.LastAccess))
+	}
+
+	// refreshed: the counts carry over, the serves are of the new response
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if meta, _ := c.Peek("/k"); !meta.Fresh {
+			break
+		}
+	}
+	get(h, "/k")
+	waitIdle(t, c)
+	if s, _ = c.KeyStats("/k"); s.Hits != 3 || s.Misses != 1 || s.Generation != 2 || s.Serves != 0 {
+		t.Fatalf("after the refresh: %+v", s)
+	}
+}
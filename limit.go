@@ -0,0 +1,117 @@
+package burstcache
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	With RegenRate set, the regenerations the cache starts are limited to that many
+	per second in total, with bursts of up to RegenBurst, by a token bucket. It is
+	the ceiling a backend can be promised, whatever the traffic:
+
+	- a stale entry that is due for a refresh but gets no token keeps being served
+	  stale, a later request tries again
+	- a cold miss waits up to RegenWait for a token, and is shed with a 503 (with
+	  Retry-After) when none comes; the shed response is never cached
+	- a hedge (see HedgeAfter) without a token isn't sent, the first attempt is awaited
+
+	Throttled regenerations are counted in Stats.Throttled.
+*/
+
+/*
+	tokens is a token bucket
+*/
+type tokens struct {
+	mu     sync.Mutex
+	level  float64   // tokens available at last
+	last   time.Time // when level was last brought up to date
+	primed bool      // level has been set, the bucket starts out full
+}
+
+/*
+	take takes a token at now if there is one. If not, wait is how long until there is.
+*/
+func (t *tokens) take(now time.Time, rate float64, burst int) (ok bool, wait time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	if !t.primed {
+		t.level, t.last, t.primed = float64(burst), now, true
+	}
+	if elapsed := now.Sub(t.last); elapsed > 0 {
+		t.level += elapsed.Seconds() * rate
+		t.last = now
+	}
+	if t.level > float64(burst) {
+		t.level = float64(burst)
+	}
+	if t.level >= 1 {
+		t.level--
+		return true, 0
+	}
+	return false, time.Duration((1 - t.level) / rate * float64(time.Second))
+}
+
+/*
+	mayRegenerate reports whether a regeneration may start now, counting it as throttled if not
+*/
+func (c *Cache) mayRegenerate() bool {
+	if c.RegenRate <= 0 {
+		return true
+	}
+	if ok, _ := c.regens.take(time.Now(), c.RegenRate, c.RegenBurst); ok {
+		return true
+	}
+	atomic.AddInt64(&c.stats.Throttled, 1)
+	return false
+}
+
+/*
+	admit waits for a token for the cold fill of r, for at most RegenWait.
+	Returns false, counting it as throttled, when none came or r was given up on.
+*/
+func (c *Cache) admit(r *http.Request) bool {
+	if c.RegenRate <= 0 {
+		return true
+	}
+	deadline := time.Now().Add(c.RegenWait)
+	for {
+		now := time.Now()
+		ok, wait := c.regens.take(now, c.RegenRate, c.RegenBurst)
+		if ok {
+			return true
+		}
+		if now.Add(wait).After(deadline) {
+			break
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			atomic.AddInt64(&c.stats.Throttled, 1)
+			return false
+		case <-timer.C:
+		}
+	}
+	atomic.AddInt64(&c.stats.Throttled, 1)
+	return false
+}
+
+/*
+	shed returns the response of a cold fill that got no token
+*/
+func (c *Cache) shed() *ResponseCacher {
+	cache := NewResponseCacher(atomic.AddInt64(&c.gen, 1))
+	cache.shed = true
+	cache.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	cache.Header().Set("Retry-After", "1")
+	cache.WriteHeader(http.StatusServiceUnavailable)
+	cache.Write([]byte(http.StatusText(http.StatusServiceUnavailable) + "\n"))
+	cache.freeze()
+	return cache
+}
@@ -0,0 +1,81 @@
+package burstcache
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	// a second of demand at 1000 per second, against 200 per second with bursts of 10
+	var bucket tokens
+	now := time.Unix(0, 0)
+	taken := 0
+	for i := 0; i < 1000; i++ {
+		if ok, _ := bucket.take(now, 200, 10); ok {
+			taken++
+		}
+		now = now.Add(time.Millisecond)
+	}
+	if taken < 205 || taken > 212 {
+		t.Fatalf("%d tokens taken, want the burst and 200 more", taken)
+	}
+
+	var empty tokens
+	empty.take(now, 200, 1)
+	if ok, wait := empty.take(now, 200, 1); ok || wait != 5*time.Millisecond {
+		t.Fatalf("took %v, wait %v for the next token of an empty bucket, want 5ms", ok, wait)
+	}
+}
+
+func TestRegenRate(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.RegenRate = 10
+	c.RegenBurst = 2
+	upstream := &counting{body: "x"}
+	h := c.Chain(upstream)
+	codes := map[int]int{}
+	for i := 0; i < 5; i++ {
+		rec := get(h, fmt.Sprint("/", i))
+		codes[rec.Code]++
+		if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+			t.Fatal("shed without Retry-After")
+		}
+	}
+	if upstream.count() != 2 || codes[http.StatusServiceUnavailable] != 3 {
+		t.Fatalf("%d upstream calls and %d shed, want the burst of 2 through", upstream.count(), codes[http.StatusServiceUnavailable])
+	}
+	if stats := c.Stats(); stats.Throttled != 3 || stats.Entries != 2 {
+		t.Fatalf("%d throttled, %d entries, want 3 and the 2 filled", stats.Throttled, stats.Entries)
+	}
+
+	// with RegenWait, a cold miss waits for the next token
+	c.RegenWait = 200 * time.Millisecond
+	if rec := get(h, "/9"); rec.Code != http.StatusOK {
+		t.Fatalf("served %d after waiting for a token", rec.Code)
+	}
+}
+
+func TestRegenRateServesStale(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Millisecond, time.Hour)
+	c.RegenRate = 0.001
+	c.RegenBurst = 1
+	upstream := &counting{body: "x"}
+	h := c.Chain(upstream)
+	get(h, "/x")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if meta, _ := c.Peek("/x"); !meta.Fresh {
+			break
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if rec := get(h, "/x"); rec.Code != http.StatusOK || rec.Body.String() != "x" {
+			t.Fatalf("request %d served %d %q, want the stale entry", i, rec.Code, rec.Body.String())
+		}
+	}
+	waitIdle(t, c)
+	if upstream.count() != 1 || c.Stats().Throttled != 3 {
+		t.Fatalf("%d upstream calls, %d throttled, want no refresh without a token", upstream.count(), c.Stats().Throttled)
+	}
+}
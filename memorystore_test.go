@@ -0,0 +1,14 @@
+package burstcache_test
+
+import (
+	"testing"
+
+	"github.com/DapperDodo/burstcache"
+	"github.com/DapperDodo/burstcache/cachetest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	cachetest.StoreConformanceTest(t, func() burstcache.Storer {
+		return burstcache.NewMemoryStore()
+	})
+}
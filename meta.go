@@ -0,0 +1,161 @@
+package burstcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+	CacheMeta describes a cache entry without handing out the cached response itself.
+	It is passed to hooks that need to make decisions about an entry.
+*/
+type CacheMeta struct {
+	ID     int64     // unique identifier of this cache
+	Code   int       // the cached HTTP response code
+	Size   int       // the length of the cached body, -1 when not known up front (see StreamBody)
+	Memory int       // estimated memory held by the entry, see estimate
+	Stored time.Time // when the response was stored
+	Staled time.Time // when the entry went stale, zero while it is fresh
+	Fresh  bool      // whether the entry is still fresh
+	Regen  bool      // whether a refresh is being generated
+	Serves int64     // how often the entry has been served
+	Origin Origin    // what created the entry
+}
+
+/*
+	Origin tells what created a cache entry. Entries that no client asked for
+	(e.g. put in through Store) behave differently operationally, so they are
+	kept apart in the stats.
+*/
+type Origin int
+
+const (
+	OriginMiss    Origin = iota // filled by a cold miss in Chain
+	OriginRefresh               // refreshed in the background after going stale
+	OriginStore                 // put in through Store
+	OriginFill                  // filled by a miss in GetOrFill
+	OriginRestore               // restored from the shared tier, filled by another instance
+	OriginWarm                  // filled by a warmer for the shared tier only, see WithSharedOnly
+	numOrigins
+)
+
+func (o Origin) String() string {
+	switch o {
+	case OriginMiss:
+		return "miss"
+	case OriginRefresh:
+		return "refresh"
+	case OriginStore:
+		return "store"
+	case OriginFill:
+		return "fill"
+	case OriginRestore:
+		return "restore"
+	case OriginWarm:
+		return "warm"
+	}
+	return "unknown"
+}
+
+/*
+	Cause tells why an entry left the cache, see Stats.Removals. Entries that are
+	replaced by a refresh don't leave.
+*/
+type Cause int
+
+const (
+	CauseDied        Cause = iota // stale for TTD (or declared Dead by Freshness)
+	CauseEvicted                  // evicted to stay within MaxBytes
+	CauseSubject                  // evicted to keep its subject within SubjectMax
+	CauseIdle                     // not served within IdleTimeout
+	CausePressure                 // evicted to relieve memory pressure, see WatchMemory
+	CauseInvalidated              // removed on request: Invalidate, InvalidateTag, InvalidateRoute, RemoveMatching, PURGE
+	CauseUncacheable              // its refresh turned out not to be cacheable
+	numCauses
+)
+
+func (c Cause) String() string {
+	switch c {
+	case CauseDied:
+		return "died"
+	case CauseEvicted:
+		return "evicted"
+	case CauseSubject:
+		return "subject"
+	case CauseIdle:
+		return "idle"
+	case CausePressure:
+		return "pressure"
+	case CauseInvalidated:
+		return "invalidated"
+	case CauseUncacheable:
+		return "uncacheable"
+	}
+	return "unknown"
+}
+
+/*
+	State is the freshness of an entry as decided by a Freshness hook
+*/
+type State int
+
+const (
+	Fresh State = iota // serve as is
+	Stale              // serve, but trigger a refresh
+	Dead               // don't serve, kill it and fill anew
+)
+
+/*
+	meta returns the CacheMeta of an entry, the caller must hold the cache lock
+*/
+func (c *ResponseCacher) meta() CacheMeta {
+	return CacheMeta{
+		ID:     c.id,
+		Code:   c.Code,
+		Size:   c.contentLength(),
+		Memory: c.size,
+		Stored: c.stored,
+		Staled: c.staled,
+		Fresh:  c.fresh,
+		Regen:  c.regen,
+		Serves: atomic.LoadInt64(&c.serves),
+		Origin: c.origin,
+	}
+}
+
+/*
+	Rough fixed cost of an entry: the ResponseCacher and its buffer,
+	the header map, the request rate counters and the slot in the cache map.
+*/
+const entryOverhead = 576
+
+/*
+	Rough cost of a string header or value (its string header plus slice slot)
+*/
+const headerOverhead = 24
+
+/*
+	estimate the memory an entry holds. The body is counted by the capacity
+	of its buffer rather than its length, as that is what is allocated.
+	This is the one place to tune when the estimates drift from reality.
+*/
+func estimate(key string, cache *ResponseCacher) int {
+	n := entryOverhead + len(key)
+	if cache.Body != nil {
+		n += cache.Body.Cap()
+	}
+	for name, vals := range cache.Head {
+		n += headerOverhead + len(name)
+		for _, val := range vals {
+			n += headerOverhead + len(val)
+		}
+	}
+	for _, tag := range cache.tags {
+		n += headerOverhead + len(tag)
+	}
+	if cache.route != "" {
+		// its slot in the route index
+		n += headerOverhead + len(cache.route)
+	}
+	return n
+}
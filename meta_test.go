@@ -0,0 +1,124 @@
+package burstcache
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrigins(t *testing.T) {
+	shared := NewMemoryStore()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	})
+	c := NewCache(&Keymaker{}, nil, 10*time.Millisecond, time.Hour)
+	c.Shared = shared
+	h := c.Chain(handler)
+	get := func(h http.Handler, path string, r *http.Request) {
+		if r == nil {
+			r = httptest.NewRequest("GET", path, nil)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	origin := func(c *Cache, key string) Origin {
+		meta, ok := c.Peek(key)
+		if !ok {
+			t.Fatalf("%s isn't cached", key)
+		}
+		return meta.Origin
+	}
+
+	get(h, "/miss", nil)
+	if o := origin(c, "/miss"); o != OriginMiss {
+		t.Fatalf("a cold miss stored %v", o)
+	}
+
+	get(h, "/refresh", nil)
+	time.Sleep(20 * time.Millisecond)
+	get(h, "/refresh", nil)
+	waitIdle(t, c)
+	if o := origin(c, "/refresh"); o != OriginRefresh {
+		t.Fatalf("a refresh stored %v", o)
+	}
+
+	c.Store("/store", filled("body"))
+	if o := origin(c, "/store"); o != OriginStore {
+		t.Fatalf("Store stored %v", o)
+	}
+
+	c.GetOrFill("/fill", func() *ResponseCacher { return filled("body") })
+	if o := origin(c, "/fill"); o != OriginFill {
+		t.Fatalf("GetOrFill stored %v", o)
+	}
+
+	r := httptest.NewRequest("GET", "/warm", nil)
+	get(h, "", r.WithContext(WithSharedOnly(r.Context())))
+	waitIdle(t, c)
+	if _, ok := c.Peek("/warm"); ok {
+		t.Fatal("a warmer filled the local cache")
+	}
+
+	// another instance restores them from the shared tier
+	other := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	other.Shared = shared
+	get(other.Chain(handler), "/warm", nil)
+	if o := origin(other, "/warm"); o != OriginRestore {
+		t.Fatalf("an entry from the shared tier stored %v", o)
+	}
+
+	want := map[Origin]int64{OriginMiss: 2, OriginRefresh: 1, OriginStore: 1, OriginFill: 1, OriginWarm: 1}
+	for o := Origin(0); o < numOrigins; o++ {
+		if got := c.Stats().Regenerations[o]; got != want[o] {
+			t.Errorf("%d regenerations by %v, want %d", got, o, want[o])
+		}
+	}
+	if got := other.Stats().Regenerations[OriginRestore]; got != 1 {
+		t.Errorf("%d regenerations by restore, want 1", got)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	cache := NewResponseCacher(0)
+	cache.Head = http.Header{"Ab": {"cde"}}
+	cache.Body = bytes.NewBuffer(make([]byte, 10, 64))
+	cache.tags = []string{"t"}
+	// overhead, key, buffer capacity, then name, value and tag each with their overhead
+	if got, want := estimate("key", cache), 576+3+64+(24+2)+(24+3)+(24+1); got != want {
+		t.Fatalf("estimated %d, want %d", got, want)
+	}
+
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	memory := func(key string) int64 {
+		meta, _ := c.Peek(key)
+		return int64(meta.Memory)
+	}
+	c.Store("/a", filled("small"))
+	if got := c.Stats().Bytes; got != memory("/a") || got < entryOverhead {
+		t.Fatalf("holding %d bytes for an entry of %d", got, memory("/a"))
+	}
+	c.Store("/a", filled(strings.Repeat("x", 4096)))
+	if got := c.Stats().Bytes; got != memory("/a") || got < 4096 {
+		t.Fatalf("holding %d bytes after the swap, the entry holds %d", got, memory("/a"))
+	}
+	c.Store("/b", filled("small"))
+	if got := c.Stats().Bytes; got != memory("/a")+memory("/b") {
+		t.Fatalf("holding %d bytes for entries of %d and %d", got, memory("/a"), memory("/b"))
+	}
+	c.Invalidate("/a")
+	if got := c.Stats().Bytes; got != memory("/b") {
+		t.Fatalf("holding %d bytes once /a is gone, /b holds %d", got, memory("/b"))
+	}
+
+	max := 3 * memory("/b")
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.MaxBytes = max })
+	for i := 0; i < 10; i++ {
+		c.Store(fmt.Sprint("/", i), filled("small"))
+	}
+	if got := c.Stats(); got.Bytes > max || got.Evictions == 0 {
+		t.Fatalf("holding %d bytes of at most %d, after %d evictions", got.Bytes, max, got.Evictions)
+	}
+}
@@ -0,0 +1,45 @@
+package burstcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+)
+
+/*
+	Newline delimited JSON is usually streamed, and a stream that was cut off
+	halfway is still a perfectly valid looking response. Caching one would serve
+	the truncated stream to everybody, so NDJSON is only cached when every line
+	is complete: the body ends with a newline and each line holds valid JSON.
+*/
+
+/*
+	isNDJSON reports whether the content type denotes newline delimited JSON
+*/
+func isNDJSON(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediatype == "application/x-ndjson" || mediatype == "application/ndjson"
+}
+
+/*
+	completeNDJSON reports whether the body is a cleanly terminated NDJSON stream
+*/
+func completeNDJSON(body []byte) bool {
+	if len(body) == 0 {
+		return true
+	}
+	if body[len(body)-1] != '\n' {
+		// truncated mid-line
+		return false
+	}
+	for _, line := range bytes.Split(body[:len(body)-1], []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && !json.Valid(line) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package burstcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNDJSONCachedOnlyComplete(t *testing.T) {
+	streams := map[string]string{
+		"/complete":  "{\"n\":1}\n{\"n\":2}\n",
+		"/truncated": "{\"n\":1}\n{\"n\":",
+		"/torn":      "{\"n\":1}\n{\"n\"\n",
+	}
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	calls := map[string]int{}
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.Write([]byte(streams[r.URL.Path]))
+		w.(http.Flusher).Flush()
+	}))
+	for path, stream := range streams {
+		for i := 0; i < 2; i++ {
+			if rec := get(h, path); rec.Body.String() != stream {
+				t.Fatalf("%s served %q, want %q as it came", path, rec.Body.String(), stream)
+			}
+		}
+	}
+	if calls["/complete"] != 1 {
+		t.Errorf("%d calls for a complete stream, want it cached", calls["/complete"])
+	}
+	for _, path := range []string{"/truncated", "/torn"} {
+		if calls[path] != 2 {
+			t.Errorf("%d calls for %s, want it passed through every time", calls[path], path)
+		}
+	}
+}
+
+func TestCompleteNDJSON(t *testing.T) {
+	for body, want := range map[string]bool{
+		"":                  true,
+		"{}\n":              true,
+		"{}\n\n[1,2]\n":     true,
+		"{}":                false,
+		"{}\nnot json\n":    false,
+		"{\"a\":\"b\n\"}\n": false,
+	} {
+		if got := completeNDJSON([]byte(body)); got != want {
+			t.Errorf("completeNDJSON(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
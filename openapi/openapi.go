@@ -0,0 +1,269 @@
+/*
+	Package openapi derives per route cache settings from an OpenAPI 3 document
+	(in JSON), so what the spec already says about an API doesn't have to be
+	repeated in code:
+
+		routes, err := openapi.LoadFile("api.json")
+		if err != nil {
+			return err
+		}
+		routes.Apply(cache)
+
+	Only safe operations (GET and HEAD) are cacheable. An operation opts out with
+	"x-burstcache-cache": false, and sets a time to live of its own with
+	"x-burstcache-ttl" (a Go duration like "30s"). When an operation documents the
+	content types of its successful responses, responses of another type (e.g. the
+	HTML error page of a proxy in between) aren't cached. Requests for paths the
+	spec doesn't list fall back to the settings of the cache.
+*/
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DapperDodo/burstcache"
+)
+
+/*
+	Route holds the cache settings of one operation of the spec
+*/
+type Route struct {
+	Method       string        // the HTTP method, upper case
+	Path         string        // the path template, e.g. /users/{id}
+	Cacheable    bool          // whether responses may be cached
+	TTL          time.Duration // time to live from x-burstcache-ttl, 0 for the default
+	ContentTypes []string      // the content types the operation documents for its responses
+
+	segments []string // the path template split on slashes
+}
+
+/*
+	Routes is the route table derived from a spec
+*/
+type Routes struct {
+	routes []Route
+}
+
+/*
+	document holds the parts of an OpenAPI document that matter here
+*/
+type document struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+type operation struct {
+	Cache     *bool  `json:"x-burstcache-cache"`
+	TTL       string `json:"x-burstcache-ttl"`
+	Responses map[string]struct {
+		Content map[string]json.RawMessage `json:"content"`
+	} `json:"responses"`
+}
+
+var methods = map[string]bool{
+	"get": true, "head": true, "post": true, "put": true, "patch": true,
+	"delete": true, "options": true, "trace": true,
+}
+
+/*
+	Load reads a spec and derives its route table
+*/
+func Load(r io.Reader) (*Routes, error) {
+	var doc document
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("openapi: can't parse spec: %w", err)
+	}
+
+	routes := &Routes{}
+	for path, item := range doc.Paths {
+		for method, raw := range item {
+			if !methods[method] {
+				// parameters, summary and the like
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("openapi: can't parse %s %s: %w", strings.ToUpper(method), path, err)
+			}
+			route := Route{
+				Method:    strings.ToUpper(method),
+				Path:      path,
+				Cacheable: method == "get" || method == "head",
+				segments:  strings.Split(strings.Trim(path, "/"), "/"),
+			}
+			if op.Cache != nil && !*op.Cache {
+				route.Cacheable = false
+			}
+			if op.TTL != "" {
+				ttl, err := time.ParseDuration(op.TTL)
+				if err != nil || ttl < 0 {
+					return nil, fmt.Errorf("openapi: bad x-burstcache-ttl %q on %s %s", op.TTL, route.Method, path)
+				}
+				route.TTL = ttl
+			}
+			route.ContentTypes = contentTypes(op)
+			routes.routes = append(routes.routes, route)
+		}
+	}
+
+	// literal segments before parameters, so /users/me wins over /users/{id}
+	sort.SliceStable(routes.routes, func(i, j int) bool {
+		return specificity(routes.routes[i]) > specificity(routes.routes[j])
+	})
+	return routes, nil
+}
+
+/*
+	LoadFile reads the spec in the named file, see Load
+*/
+func LoadFile(name string) (*Routes, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+/*
+	content types of the successful responses of an operation, sorted
+*/
+func contentTypes(op operation) []string {
+	seen := map[string]bool{}
+	var types []string
+	for code, response := range op.Responses {
+		if !strings.HasPrefix(code, "2") {
+			continue
+		}
+		for t := range response.Content {
+			if !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+/*
+	specificity counts the literal segments of a route
+*/
+func specificity(route Route) int {
+	n := 0
+	for _, s := range route.segments {
+		if !parameter(s) {
+			n++
+		}
+	}
+	return n
+}
+
+func parameter(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+/*
+	Routes returns the route table
+*/
+func (rs *Routes) Routes() []Route {
+	return append([]Route(nil), rs.routes...)
+}
+
+/*
+	Match returns the route of a request. ok is false when the spec doesn't list its path.
+	A listed path with an unlisted method matches a route that isn't cacheable.
+*/
+func (rs *Routes) Match(r *http.Request) (route Route, ok bool) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	listed := false
+	for _, route := range rs.routes {
+		if !match(route.segments, segments) {
+			continue
+		}
+		if route.Method == r.Method {
+			return route, true
+		}
+		listed = true
+	}
+	if listed {
+		return Route{Method: r.Method, Path: r.URL.Path}, true
+	}
+	return Route{}, false
+}
+
+func match(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, s := range template {
+		if s != segments[i] && !(parameter(s) && segments[i] != "") {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	TTL returns the time to live the spec sets for a request, see burstcache.Cache.RouteTTL
+*/
+func (rs *Routes) TTL(r *http.Request) (time.Duration, bool) {
+	route, ok := rs.Match(r)
+	if !ok || route.TTL == 0 {
+		return 0, false
+	}
+	return route.TTL, true
+}
+
+/*
+	ContentTypes returns the content types the spec documents for the responses
+	to a request, see burstcache.Cache.RouteContentTypes
+*/
+func (rs *Routes) ContentTypes(r *http.Request) ([]string, bool) {
+	route, ok := rs.Match(r)
+	if !ok || len(route.ContentTypes) == 0 {
+		return nil, false
+	}
+	return route.ContentTypes, true
+}
+
+/*
+	Keyer wraps keyer so requests for routes that aren't cacheable bypass the cache.
+	Requests for unlisted paths are keyed by keyer as usual.
+*/
+func (rs *Routes) Keyer(keyer burstcache.Keyer) burstcache.Keyer {
+	return &routeKeymaker{routes: rs, keyer: keyer}
+}
+
+type routeKeymaker struct {
+	routes *Routes
+	keyer  burstcache.Keyer
+}
+
+func (k *routeKeymaker) Key(w http.ResponseWriter, r *http.Request) string {
+	if route, ok := k.routes.Match(r); ok && !route.Cacheable {
+		// bypass
+		return ""
+	}
+	return k.keyer.Key(w, r)
+}
+
+/*
+	Apply configures c with the route table: its Keymaker is wrapped (see Keyer),
+	RouteTTL and RouteContentTypes are set. Call it before c is used.
+*/
+func (rs *Routes) Apply(c *burstcache.Cache) {
+	keyer := c.Keymaker
+	if keyer == nil {
+		keyer = &burstcache.Keymaker{}
+	}
+	c.Keymaker = rs.Keyer(keyer)
+	c.RouteTTL = rs.TTL
+	c.RouteContentTypes = rs.ContentTypes
+}
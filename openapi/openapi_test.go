@@ -0,0 +1,93 @@
+package openapi_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DapperDodo/burstcache"
+	"github.com/DapperDodo/burstcache/openapi"
+)
+
+func load(t *testing.T) *openapi.Routes {
+	routes, err := openapi.LoadFile("testdata/spec.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+func TestLoad(t *testing.T) {
+	type route struct {
+		Method, Path string
+		Cacheable    bool
+		TTL          time.Duration
+		ContentTypes []string
+	}
+	var got []route
+	for _, r := range load(t).Routes() {
+		got = append(got, route{r.Method, r.Path, r.Cacheable, r.TTL, r.ContentTypes})
+	}
+	want := []route{
+		{"GET", "/users/me", false, 0, []string{"application/json"}},
+		{"GET", "/users/{id}", true, time.Hour, []string{"application/json"}},
+		{"PUT", "/users/{id}", false, 0, nil},
+		{"GET", "/avatars/{id}", true, 0, []string{"image/*"}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("routes %+v, want %+v", got, want)
+	}
+	// the order of routes equally specific is up to the map of the spec
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			found = found || reflect.DeepEqual(g, w)
+		}
+		if !found {
+			t.Errorf("no route %+v in %+v", w, got)
+		}
+	}
+	if got[0].Path != "/users/me" {
+		t.Errorf("%s matched first, want the literal /users/me", got[0].Path)
+	}
+}
+
+func TestApply(t *testing.T) {
+	c := burstcache.NewCache(&burstcache.Keymaker{}, nil, time.Second, time.Second)
+	load(t).Apply(c)
+	calls := map[string]int{}
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		switch r.URL.Path {
+		case "/users/2":
+			w.Header().Set("Content-Type", "text/html")
+		case "/avatars/1":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+		}
+		io.WriteString(w, "{}")
+	}))
+	for _, path := range []string{"/users/1", "/users/me", "/users/2", "/avatars/1", "/unlisted"} {
+		for i := 0; i < 2; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+	}
+
+	want := map[string]int{
+		"/users/1":   1, // listed and cacheable
+		"/users/me":  2, // opted out
+		"/users/2":   2, // not the documented content type
+		"/avatars/1": 1, // image/* takes image/png
+		"/unlisted":  1, // the defaults of the cache
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("handler calls %v, want %v", calls, want)
+	}
+	if ttl, ok := c.RouteTTL(httptest.NewRequest("GET", "/users/1", nil)); !ok || ttl != time.Hour {
+		t.Fatalf("time to live %v (%v), want the hour of x-burstcache-ttl", ttl, ok)
+	}
+}
@@ -0,0 +1,111 @@
+package burstcache
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	raw sends a GET for path to h over a real connection, and returns what came back byte for byte, Date left out
+*/
+func raw(t *testing.T, h http.Handler, path string) string {
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, _ := io.ReadAll(bufio.NewReader(conn))
+	return regexp.MustCompile(`Date: .*\r\n`).ReplaceAllString(string(b), "")
+}
+
+func TestPassThroughIsByteExact(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chunked":
+			w.Header().Set("X-A", "1")
+			w.Write([]byte("one"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("two"))
+		case "/hijack":
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			buf.WriteString("RAW BYTES\r\n")
+			buf.Flush()
+			conn.Close()
+		}
+	})
+	// without an Authorization header, every request bypasses the cache
+	c := NewCache(&AuthKeymaker{Keyer: &Keymaker{}}, nil, time.Second, time.Second)
+	c.MeasureTTFB = true
+	for _, path := range []string{"/chunked", "/hijack"} {
+		want, got := raw(t, h, path), raw(t, c.Chain(h), path)
+		if want != got || want == "" {
+			t.Fatalf("%s through the cache\nwant %q\ngot  %q", path, want, got)
+		}
+	}
+}
+
+/*
+	client is the ResponseWriter of a client, to tell it from the ones the cache wraps it in
+*/
+type client struct {
+	*httptest.ResponseRecorder
+}
+
+func TestOversizeCollapsedPassesThrough(t *testing.T) {
+	release := make(chan struct{})
+	var calls, unwrapped int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		} else if _, ok := w.(client); ok {
+			atomic.AddInt32(&unwrapped, 1)
+		}
+		w.Write([]byte("far too large to cache"))
+	})
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.MaxBodyBytes = 4
+	c.MeasureTTFB = true
+	chained := c.Chain(h)
+
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		chained.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	second := make(chan struct{})
+	rec := client{httptest.NewRecorder()}
+	go func() {
+		defer close(second)
+		chained.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	<-first
+	<-second
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("%d handler calls, want the collapsed request to get its own", n)
+	}
+	if atomic.LoadInt32(&unwrapped) != 1 {
+		t.Fatal("the collapsed request was passed through with a wrapped ResponseWriter")
+	}
+	if rec.Body.String() != "far too large to cache" {
+		t.Fatalf("served %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,143 @@
+package burstcache
+
+import (
+	"log"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Instead of (or besides) a fixed MaxBytes, WatchMemory makes the cache yield
+	memory when the process runs short of it. Once the heap grows above MemoryHigh
+	of the limit, the coldest entries (as MaxBytes picks them) are evicted on every
+	sample, until the heap is back under MemoryLow. The gap between the two keeps
+	the cache from flapping around a single threshold. How much to evict is told
+	by the estimated memory of the entries. The heap itself only shrinks once the
+	garbage collector has run, so what was evicted since is taken off the samples
+	until then, or every sample would evict the same excess again.
+*/
+
+const (
+	defaultMemoryHigh  = 0.9
+	defaultMemoryLow   = 0.8
+	defaultMemoryEvery = time.Second
+)
+
+/*
+	gcCycles returns the number of completed GC cycles
+*/
+var gcCycles = func() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/cycles/total:gc-cycles"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+/*
+	WatchMemory samples the heap every interval (every second if every <= 0),
+	evicting entries while it is under pressure (see MemoryLimit). It is off until
+	called, stop ends it and returns once it is done evicting.
+*/
+func (c *Cache) WatchMemory(every time.Duration) (stop func()) {
+	if every <= 0 {
+		every = defaultMemoryEvery
+	}
+	ticker := time.NewTicker(every)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.relieve()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+/*
+	relieve takes one sample of the heap, and evicts what it takes to bring it
+	under MemoryLow when under pressure. Returns how many entries were evicted.
+*/
+func (c *Cache) relieve() int {
+	limit := c.memoryLimit()
+	if limit <= 0 {
+		return 0
+	}
+	high, low := c.MemoryHigh, c.MemoryLow
+	if high <= 0 {
+		high = defaultMemoryHigh
+	}
+	if low <= 0 || low > high {
+		low = math.Min(defaultMemoryLow, high)
+	}
+	heap, cycles := c.heapBytes(), gcCycles()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cycles != c.cycles {
+		// collected since, the heap shows what was released
+		c.released, c.cycles = 0, cycles
+	}
+	heap -= c.released
+	switch {
+	case float64(heap) > high*float64(limit):
+		c.pressed = true
+	case float64(heap) < low*float64(limit):
+		c.pressed = false
+	}
+	if !c.pressed {
+		return 0
+	}
+	excess := heap - int64(low*float64(limit))
+	before := c.bytes
+	n := c.shrink(before-excess, nil, CausePressure, DecisionPressure)
+	c.released += before - c.bytes
+	atomic.AddInt64(&c.stats.PressureEvictions, int64(n))
+	if n > 0 {
+		log.Printf("burstcache: heap at %d of %d bytes, evicted %d entries", heap, limit, n)
+	}
+	return n
+}
+
+/*
+	memoryLimit returns MemoryLimit, or GOMEMLIMIT if it isn't set. 0 when neither is.
+*/
+func (c *Cache) memoryLimit() int64 {
+	if c.MemoryLimit > 0 {
+		return c.MemoryLimit
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return limit
+	}
+	return 0
+}
+
+/*
+	heapBytes returns the heap in use, see HeapBytes
+*/
+func (c *Cache) heapBytes() int64 {
+	if c.HeapBytes != nil {
+		return c.HeapBytes()
+	}
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(sample[0].Value.Uint64())
+}
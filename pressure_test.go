@@ -0,0 +1,99 @@
+package burstcache
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func filled(body string) *ResponseCacher {
+	rc := NewResponseCacher(0)
+	rc.WriteHeader(200)
+	rc.Write([]byte(body))
+	return rc
+}
+
+/*
+	fakeGC replaces the GC cycle count for the duration of a test
+*/
+func fakeGC(t *testing.T) *uint64 {
+	var cycles uint64
+	real := gcCycles
+	gcCycles = func() uint64 { return atomic.LoadUint64(&cycles) }
+	t.Cleanup(func() { gcCycles = real })
+	return &cycles
+}
+
+func TestRelieveHysteresis(t *testing.T) {
+	cycles := fakeGC(t)
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MemoryLimit = 100000
+	var heap int64
+	c.HeapBytes = func() int64 { return atomic.LoadInt64(&heap) }
+	for i := 0; i < 100; i++ {
+		c.Store(fmt.Sprint("/", i), filled("x"))
+	}
+	c.ServeCached("/7", httptest.NewRecorder())
+	per := c.Stats().Bytes / 100
+
+	atomic.StoreInt64(&heap, 85000)
+	if n := c.relieve(); n != 0 {
+		t.Fatalf("evicted %d below MemoryHigh", n)
+	}
+	atomic.StoreInt64(&heap, 95000)
+	n := c.relieve()
+	if n == 0 || c.Stats().PressureEvictions != int64(n) {
+		t.Fatalf("evicted %d above MemoryHigh, PressureEvictions %d", n, c.Stats().PressureEvictions)
+	}
+	if more := c.relieve(); more != 0 {
+		t.Fatalf("evicted %d more before the GC could show the first %d", more, n)
+	}
+
+	// collected, grown back
+	atomic.AddUint64(cycles, 1)
+	atomic.StoreInt64(&heap, 91000)
+	if n := c.relieve(); n == 0 {
+		t.Fatal("evicted nothing once the GC showed the heap still high")
+	}
+	// collected, between low and high: pressed until under MemoryLow
+	atomic.AddUint64(cycles, 1)
+	atomic.StoreInt64(&heap, 80000+3*per)
+	if n := c.relieve(); n != 3 {
+		t.Fatalf("evicted %d between MemoryLow and MemoryHigh, want 3", n)
+	}
+	atomic.AddUint64(cycles, 1)
+	atomic.StoreInt64(&heap, 70000)
+	c.relieve()
+	atomic.StoreInt64(&heap, 85000)
+	if n := c.relieve(); n != 0 {
+		t.Fatalf("evicted %d once released below MemoryLow", n)
+	}
+	if _, ok := c.Peek("/7"); !ok {
+		t.Fatal("the entry in use was evicted")
+	}
+}
+
+func TestWatchMemory(t *testing.T) {
+	fakeGC(t)
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MemoryLimit = 100000
+	var heap int64
+	c.HeapBytes = func() int64 { return atomic.LoadInt64(&heap) }
+	for i := 0; i < 50; i++ {
+		c.Store(fmt.Sprint("/", i), filled("x"))
+	}
+
+	// no interval is the default one, not a panic
+	c.WatchMemory(0)()
+
+	stop := c.WatchMemory(5 * time.Millisecond)
+	atomic.StoreInt64(&heap, 95000)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	stop()
+	if got := c.Stats().Entries; got == 0 || got == 50 {
+		t.Fatalf("%d entries left, the watch should evict some, not all, while the heap lags", got)
+	}
+}
@@ -0,0 +1,38 @@
+package burstcache
+
+import (
+	"net/http"
+)
+
+/*
+	With MayPurge set, Chain answers CDN style PURGE requests itself: PURGE /path
+	removes what a GET of /path is served from, locally and from the shared tier,
+	and answers 200, or 404 when nothing was cached. Purges MayPurge refuses are
+	answered 403. PURGE requests never reach the handler, nor the cache.
+	Without MayPurge they are passed through to the handler, uncached, whatever
+	Methods lists.
+*/
+
+/*
+	MethodPurge is the method of purge requests
+*/
+const MethodPurge = "PURGE"
+
+/*
+	purge serves a PURGE request
+*/
+func (c *Cache) purge(w http.ResponseWriter, r *http.Request) {
+	if !c.MayPurge(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	// keyed as the GET it purges
+	target := r.Clone(r.Context())
+	target.Method = http.MethodGet
+	if err := c.RemoveRequest(target); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
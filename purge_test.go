@@ -0,0 +1,64 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.MayPurge = func(r *http.Request) bool { return r.Header.Get("X-Token") == "secret" }
+	upstream := &counting{body: "x"}
+	h := c.Chain(upstream)
+	get(h, "/x")
+	purge := func(path, token string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(MethodPurge, path, nil)
+		r.Header.Set("X-Token", token)
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	for i, tc := range []struct {
+		path, token string
+		code        int
+	}{
+		{"/x", "wrong", http.StatusForbidden},
+		{"/x", "secret", http.StatusOK},
+		{"/x", "secret", http.StatusNotFound},
+		{"/y", "secret", http.StatusNotFound},
+	} {
+		if code := purge(tc.path, tc.token); code != tc.code {
+			t.Fatalf("purge %d of %s: %d, want %d", i, tc.path, code, tc.code)
+		}
+	}
+	if n := c.Stats().Entries; n != 0 || upstream.count() != 1 {
+		t.Fatalf("%d entries and %d upstream calls after the purges, want 0 and 1", n, upstream.count())
+	}
+
+	// without MayPurge, PURGE is a request like any other
+	c = NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	upstream = &counting{body: "x"}
+	h = c.Chain(upstream)
+	get(h, "/x")
+	if purge("/x", "") != http.StatusOK || purge("/x", "") != http.StatusOK || upstream.count() != 3 {
+		t.Fatalf("%d upstream calls, want both PURGEs passed through", upstream.count())
+	}
+	if _, ok := c.Peek("/x"); !ok {
+		t.Fatal("a PURGE purged without MayPurge")
+	}
+}
+
+func TestPurgeNeverCached(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.Methods = []string{http.MethodGet, MethodPurge}
+	upstream := &counting{body: "x"}
+	h := c.Chain(upstream)
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(MethodPurge, "/x", nil))
+	}
+	if n := upstream.count(); n != 2 || c.Stats().Entries != 0 {
+		t.Fatalf("%d upstream calls and %d entries, want PURGE never cached even when Methods lists it", n, c.Stats().Entries)
+	}
+}
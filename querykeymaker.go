@@ -0,0 +1,154 @@
+package burstcache
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+/*
+	DefaultCacheBusters are the query parameters QueryKeymaker leaves out of its
+	keys when no list of its own is configured. Clients add them with a random or
+	ever increasing value to get past caches, e.g. jQuery's _=1712345678.
+*/
+var DefaultCacheBusters = []string{
+	"_",
+	"cb",
+	"cachebust",
+	"cachebuster",
+	"cache_buster",
+	"nocache",
+	"no_cache",
+	"bust",
+	"rnd",
+	"rand",
+	"random",
+}
+
+/*
+	QueryKeymaker wraps another Keyer and adds the query of the request to its
+	key, parameters sorted so their order doesn't matter. Cache busters (see Busters)
+	are left out, so requests that differ in those only share an entry instead of
+	each filling one of their own. Only the key is affected, the handler still gets
+	the request as it came in.
+
+	With Detect, parameters that look like cache busters nobody listed yet (their
+	values random, and never the same twice) are logged once per route, so the
+	list can be extended.
+*/
+type QueryKeymaker struct {
+	Keyer   Keyer    // the keyer whose keys get the query added
+	Busters []string // query parameters left out of the key, defaults to DefaultCacheBusters
+	Detect  bool     // log parameters that look like unlisted cache busters
+
+	mu       sync.Mutex
+	suspects map[suspect]*sightings // parameters being watched, see Detect
+}
+
+/*
+	suspect is a parameter of a route, watched to see if it busts the cache
+*/
+type suspect struct {
+	route string
+	param string
+}
+
+/*
+	sightings are the values seen of a suspect, until there are enough to tell
+*/
+type sightings struct {
+	values  map[string]bool
+	cleared bool // it repeated or looked tame, or has been logged: no more watching
+}
+
+const (
+	suspectSightings = 16   // values a parameter is watched for, none repeated, before it is logged
+	maxSuspects      = 1024 // parameters watched at once, so the watching can't grow without bound
+)
+
+func (k *QueryKeymaker) Key(w http.ResponseWriter, r *http.Request) string {
+
+	key := k.Keyer.Key(w, r)
+	if key == "" {
+		return ""
+	}
+
+	// a copy, parsed anew, the request is left alone
+	query := r.URL.Query()
+	for _, name := range k.busters() {
+		query.Del(name)
+	}
+	if k.Detect {
+		k.watch(key, query)
+	}
+	if len(query) == 0 {
+		return key
+	}
+
+	return key + "?" + query.Encode()
+}
+
+func (k *QueryKeymaker) busters() []string {
+	if k.Busters == nil {
+		return DefaultCacheBusters
+	}
+	return k.Busters
+}
+
+/*
+	watch the parameters of a request for route, logging those that turn out to
+	be single use and random
+*/
+func (k *QueryKeymaker) watch(route string, query map[string][]string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for param, values := range query {
+		s := suspect{route: route, param: param}
+		seen := k.suspects[s]
+		if seen == nil {
+			if len(k.suspects) >= maxSuspects {
+				continue
+			}
+			if k.suspects == nil {
+				k.suspects = map[suspect]*sightings{}
+			}
+			seen = &sightings{values: map[string]bool{}}
+			k.suspects[s] = seen
+		}
+		if seen.cleared {
+			continue
+		}
+		value := values[0]
+		if len(values) > 1 || seen.values[value] || !random(value) {
+			// repeated, or not a looker: a parameter that matters
+			seen.cleared, seen.values = true, nil
+			continue
+		}
+		seen.values[value] = true
+		if len(seen.values) >= suspectSightings {
+			log.Printf("burstcache: query parameter %q of %s never repeats its random values, if it is a cache buster add it to Busters", param, route)
+			seen.cleared, seen.values = true, nil
+		}
+	}
+}
+
+/*
+	random reports whether a parameter value looks made up to bust caches:
+	a timestamp, a random number, or a random mix of letters and digits
+*/
+func random(value string) bool {
+	if len(value) < 5 {
+		return false
+	}
+	digits := 0
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
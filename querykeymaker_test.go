@@ -0,0 +1,43 @@
+package burstcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheBusters(t *testing.T) {
+	keymaker := &QueryKeymaker{Keyer: &Keymaker{}, Detect: true}
+	c := NewCache(keymaker, nil, time.Second, time.Second)
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// stripped from the key only
+		if r.URL.Query().Get("_") == "" {
+			t.Error("the handler lost the cache buster")
+		}
+		w.Write([]byte(r.URL.Query().Get("page")))
+	}))
+	for i := 0; i < 5; i++ {
+		get(h, fmt.Sprintf("/l?page=1&_=%d&cb=x%d", 1712345+i, i))
+	}
+	if calls != 1 {
+		t.Fatalf("%d upstream calls for one page with busters, want 1", calls)
+	}
+	if rec := get(h, "/l?_=9&page=2"); calls != 2 || rec.Body.String() != "2" {
+		t.Fatalf("%d upstream calls, served %q for another page", calls, rec.Body.String())
+	}
+
+	// a single use parameter nobody listed is flagged, once
+	logs := captureLog(t)
+	for i := 0; i < 20; i++ {
+		keymaker.Key(nil, httptest.NewRequest("GET", fmt.Sprintf("/l?page=1&v=%d", 171234567+i), nil))
+	}
+	if out := logs.String(); !strings.Contains(out, `"v"`) || strings.Contains(out, `"page"`) || strings.Count(out, "\n") != 1 {
+		t.Fatalf("logged %q, want v flagged once", out)
+	}
+}
@@ -0,0 +1,104 @@
+package burstcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Every key keeps count of how often it is served, in a small ring of time
+	buckets (a second each, unless RateBucket says otherwise). The rate survives
+	refreshes of the entry, it belongs to the key rather than to one response.
+	Counting is lock free: a hit that races the reuse of an expired bucket may
+	be lost, which is fine for an estimate.
+*/
+
+const (
+	rateBuckets = 16               // buckets in the ring, the rate looks back this many buckets
+	rateAlpha   = 2.0 / (16 + 1.0) // EWMA weight of the newest bucket
+)
+
+type rate struct {
+	counts [rateBuckets]int64 // hits per bucket
+	stamps [rateBuckets]int64 // the bucket number each count belongs to
+}
+
+/*
+	hit counts a request at now
+*/
+func (r *rate) hit(now time.Time, bucket time.Duration) {
+	if r == nil {
+		// not stored, nobody will ask
+		return
+	}
+	n := now.UnixNano() / int64(bucket)
+	i := n % rateBuckets
+	if stamp := atomic.LoadInt64(&r.stamps[i]); stamp != n {
+		if atomic.CompareAndSwapInt64(&r.stamps[i], stamp, n) {
+			atomic.StoreInt64(&r.counts[i], 0)
+		}
+	}
+	atomic.AddInt64(&r.counts[i], 1)
+}
+
+/*
+	perSecond returns the exponentially weighted moving average of the requests
+	per second over the completed buckets, the newest weighing in most
+*/
+func (r *rate) perSecond(now time.Time, bucket time.Duration) float64 {
+	current := now.UnixNano() / int64(bucket)
+	oldest := current - rateBuckets + 1
+	ewma := r.count(oldest)
+	for n := oldest + 1; n < current; n++ {
+		ewma += rateAlpha * (r.count(n) - ewma)
+	}
+	return ewma / bucket.Seconds()
+}
+
+/*
+	total returns the hits over the whole ring, the current bucket included
+*/
+func (r *rate) total(now time.Time, bucket time.Duration) float64 {
+	current := now.UnixNano() / int64(bucket)
+	var total float64
+	for n := current - rateBuckets + 1; n <= current; n++ {
+		total += r.count(n)
+	}
+	return total
+}
+
+/*
+	count returns the hits in bucket number n, zero if its slot moved on
+*/
+func (r *rate) count(n int64) float64 {
+	i := n % rateBuckets
+	if atomic.LoadInt64(&r.stamps[i]) != n {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&r.counts[i]))
+}
+
+/*
+	The width of the rate buckets
+*/
+func (c *Cache) rateBucket() time.Duration {
+	if c.RateBucket > 0 {
+		return c.RateBucket
+	}
+	return time.Second
+}
+
+/*
+	RateOf returns the recent request rate of key in requests per second, as an
+	exponentially weighted moving average over the last buckets (see RateBucket).
+	ok is false when key isn't cached.
+*/
+func (c *Cache) RateOf(key string) (perSecond float64, ok bool) {
+	c.mu.RLock()
+	cache := c.caches[key]
+	c.mu.RUnlock()
+	if cache == nil {
+		return 0, false
+	}
+	return cache.rate.perSecond(time.Now(), c.rateBucket()), true
+}
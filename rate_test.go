@@ -0,0 +1,69 @@
+package burstcache
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	base := time.Unix(1000, 0)
+	at := func(s float64) time.Time {
+		return base.Add(time.Duration(s * float64(time.Second)))
+	}
+
+	var steady rate
+	for s := 0; s < 20; s++ {
+		for i := 0; i < 10; i++ {
+			steady.hit(at(float64(s)+0.5), time.Second)
+		}
+	}
+	if got := steady.perSecond(at(20), time.Second); got != 10 {
+		t.Fatalf("steady 10/s estimated at %v/s", got)
+	}
+
+	var bursty rate
+	for i := 0; i < 100; i++ {
+		bursty.hit(at(5), time.Second)
+	}
+	if got := bursty.perSecond(at(5.5), time.Second); got != 0 {
+		t.Fatalf("estimated %v/s from an unfinished bucket", got)
+	}
+	right, later := bursty.perSecond(at(6), time.Second), bursty.perSecond(at(12), time.Second)
+	if want := rateAlpha * 100; math.Abs(right-want) > 1e-9 {
+		t.Fatalf("a burst of 100 estimated at %v/s right after, want %v", right, want)
+	}
+	if want := right * math.Pow(1-rateAlpha, 6); math.Abs(later-want) > 1e-9 {
+		t.Fatalf("a burst of 100 estimated at %v/s 6s later, want it decayed to %v", later, want)
+	}
+
+	if got := steady.perSecond(at(200), time.Second); got != 0 {
+		t.Fatalf("idle traffic estimated at %v/s", got)
+	}
+	// half second buckets count the same traffic as twice the hits per bucket, half as long
+	var fine rate
+	for i := 0; i < 40; i++ {
+		fine.hit(at(float64(i)/4), 500*time.Millisecond)
+	}
+	if got := fine.perSecond(at(10), 500*time.Millisecond); got != 4 {
+		t.Fatalf("4/s in half second buckets estimated at %v/s", got)
+	}
+}
+
+func TestRateOf(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.RateBucket = 20 * time.Millisecond
+	if _, ok := c.RateOf("/a"); ok {
+		t.Fatal("a rate for a key that isn't cached")
+	}
+	c.Store("/a", filled("body"))
+	for i := 0; i < 5; i++ {
+		c.ServeCached("/a", httptest.NewRecorder())
+	}
+	// once the bucket of the serves is complete, they show
+	time.Sleep(2 * c.RateBucket)
+	if rate, ok := c.RateOf("/a"); !ok || rate <= 0 {
+		t.Fatalf("rate %v/s after 5 serves", rate)
+	}
+}
@@ -0,0 +1,78 @@
+package burstcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+/*
+	Keys can carry user data, think of an email address in a query parameter.
+	Whatever shows keys to operators (logs and the like) passes them through
+	Redact first. The default, RedactQuery, keeps the shape of a key but hides
+	the values. Redaction is for display only: Invalidate, Peek and friends
+	keep taking the key as the Keymaker made it.
+*/
+
+/*
+	RedactQuery replaces the query parameter values, and the values of the name=value
+	parts Keyers add after a "|" (the subject, see SubjectFunc, and the headers and
+	cookies of a SpecKeymaker), in key by a short hash, keeping the names:
+
+		/search?q=jane@example.com&page=2|sub=jane
+
+	becomes
+
+		/search?q=#8c87b489&page=#d4735e3a|sub=#81f8f6dd
+
+	Equal values get equal hashes, so keys can still be told apart and compared.
+	The method of a key (see WithKey) is no user data, it is kept as is.
+*/
+func RedactQuery(key string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(key, "|") {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		// a dimension, not a path: a SpecKeymaker key may start with one
+		if name, value, ok := strings.Cut(part, "="); ok && name != "method" && (i > 0 || !strings.ContainsAny(name, "/?")) {
+			b.WriteString(name + "=" + fingerprint(value))
+			continue
+		}
+		path, query, ok := strings.Cut(part, "?")
+		b.WriteString(path)
+		if !ok {
+			continue
+		}
+		b.WriteByte('?')
+		for j, param := range strings.Split(query, "&") {
+			if j > 0 {
+				b.WriteByte('&')
+			}
+			name, value, ok := strings.Cut(param, "=")
+			b.WriteString(name)
+			if ok {
+				b.WriteString("=" + fingerprint(value))
+			}
+		}
+	}
+	return b.String()
+}
+
+/*
+	fingerprint is a short hash of a value, for display
+*/
+func fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "#" + hex.EncodeToString(sum[:4])
+}
+
+/*
+	redact a key for display, see Redact
+*/
+func (c *Cache) redact(key string) string {
+	if c.Redact != nil {
+		return c.Redact(key)
+	}
+	return RedactQuery(key)
+}
@@ -0,0 +1,62 @@
+package burstcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactQuery(t *testing.T) {
+	for key, want := range map[string]string{
+		"/search?q=jane@example.com&page=2|sub=jane": "/search?q=#8c87b489&page=#d4735e3a|sub=#81f8f6dd",
+		"/a=b":                    "/a=b",
+		"/items|method=POST":      "/items|method=POST",
+		"/items|bot":              "/items|bot",
+		"host=example.com|/items": "host=" + fingerprint("example.com") + "|/items",
+	} {
+		if got := RedactQuery(key); got != want {
+			t.Errorf("RedactQuery(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestRedactedAdmin(t *testing.T) {
+	c := NewCache(keyerFunc(func(r *http.Request) string { return r.URL.RequestURI() }), nil, time.Hour, time.Hour)
+	c.Events = 8
+	admin := c.AdminHandler()
+	const page = "/search?q=jane@example.com"
+	get(c.Chain(&counting{body: "results"}), page)
+
+	var res Resolution
+	rec := get(admin, "/resolve?url="+url.QueryEscape(page))
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Key != page || strings.Contains(res.DisplayKey, "jane") || !strings.HasPrefix(res.DisplayKey, "/search?q=#") {
+		t.Fatalf("the admin shows %q for %q", res.DisplayKey, res.Key)
+	}
+	if !res.Exists {
+		t.Fatalf("resolved %+v", res)
+	}
+	for _, e := range c.RecentEvents() {
+		if strings.Contains(e.Key, "jane") {
+			t.Fatalf("an event shows key %s", e.Key)
+		}
+	}
+
+	// purged by the key as stored, not as shown
+	del := httptest.NewRecorder()
+	admin.ServeHTTP(del, httptest.NewRequest("DELETE", "/entries?key="+url.QueryEscape(res.DisplayKey), nil))
+	if del.Code != http.StatusNotFound {
+		t.Fatalf("purging the displayed key answered %d", del.Code)
+	}
+	del = httptest.NewRecorder()
+	admin.ServeHTTP(del, httptest.NewRequest("DELETE", "/entries?key="+url.QueryEscape(res.Key), nil))
+	if del.Code != http.StatusOK || c.Stats().Entries != 0 {
+		t.Fatalf("purging the stored key answered %d: %s", del.Code, del.Body.String())
+	}
+}
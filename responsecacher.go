@@ -2,8 +2,16 @@ package burstcache
 
 import (
 	"bytes"
-	"fmt"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 /*
@@ -16,17 +24,66 @@ type ResponseCacher struct {
 	Code int           // the HTTP response code from WriteHeader
 	Head http.Header   // the HTTP response headers
 	Body *bytes.Buffer // if non-nil, the bytes.Buffer to append written data to
-	Done bool
+	Done bool          // the handler flushed at least once; not that the response is complete, see complete
 
 	wroteHeader bool
 
-	id    int  // unique identifier of this cache
-	fresh bool // if fresh, serve it to clients. if not, keep serving but request a refresh
-	regen bool // a refreshed response is being generated, until it arrives keep serving this
+	id      int64         // unique identifier of this cache
+	key     string        // the key this cache is stored under
+	subject string        // the subject (see SubjectFunc) this cache belongs to
+	origin  Origin        // what created this cache
+	share   bool          // published before keep returns instead of in the background, see Warm
+	stored  time.Time     // when this cache was swapped in
+	staled  time.Time     // when this cache became stale
+	fresh   bool          // if fresh, serve it to clients. if not, keep serving but request a refresh
+	regen   bool          // a refreshed response is being generated, until it arrives keep serving this
+	grace   grace         // why it is still alive past its time to die, if it is
+	serves  int64         // number of times this cache was served, updated atomically
+	rate    *rate         // recent request rate of the key, shared with the caches it replaced
+	counts  *keyCounts    // activity of the key, shared like rate, see KeyStats
+	used    int64         // when this cache was last stored or served in unix nanoseconds, updated atomically
+	size    int           // estimated memory footprint, fixed when swapped in
+	phase   int           // bumped whenever the expiration is (re)scheduled, stale timers check it
+	timer   Timer         // the pending expiration timer, see arm
+	retryAt time.Time     // when an error response said to retry, see Retry-After
+	ttl     time.Duration // time to live instead of TTL if set, see RouteTTL
+	tags    []string      // normalized tags, see TagsHeader
+	route   string        // the route of the key as named by Grouper, see InvalidateRoute
+	dims    []string      // request headers the response declared to vary on, see VaryHeaders
+	variant string        // the variant part of the key for the filling request, see VaryHeaders
+
+	verified int32        // set once compared with another run of the handler, see DevVerify
+	sum      string       // base64 sha-256 of the body, see Digest
+	settings *CacheConfig // the settings of the request that filled it, see CacheConfig
+
+	compressed bool   // Body holds the gzip compressed body
+	rawLen     int    // the length of the body before compression
+	dict       []byte // Body is flate compressed against this dictionary instead
+
+	stream    func() (io.ReadCloser, error) // opens the body where a store keeps it, instead of Body, see StreamBody
+	streamLen int                           // the length of the streamed body as served, -1 if not known up front
+
+	contentType string   // Content-Type to assume when the handler sets none
+	types       []string // the content types it may be cached with, see RouteContentTypes
+
+	limit    int                 // max body length to buffer, 0 is unlimited
+	oversize bool                // the body grew beyond limit, it isn't buffered any more
+	spill    http.ResponseWriter // where an oversize response is handed over to while filling
+	spilled  bool                // the oversize response was handed over to spill
+
+	headersOnly   bool   // the body is discarded, only status and headers are cached, see HeadersOnly
+	onBody        func() // called when a headersOnly response turns out to have a body after all
+	informational bool   // pass 1xx responses on to spill, see ForwardInformational
+	shed          bool   // made up by the cache for a fill RegenRate didn't allow, never kept
+	unwritten     bool   // the handler wrote nothing at all, see settle
+
+	wmu    sync.Mutex // guards the writes, against handlers that keep writing after they returned
+	frozen bool       // the handler returned, writes are rejected
+	onLate func()     // called on every write after the handler returned
 }
 
 // NewResponseCacher returns an initialized ResponseCacher.
-func NewResponseCacher(id int) *ResponseCacher {
+func NewResponseCacher(id int64) *ResponseCacher {
 	return &ResponseCacher{
 		Head:  make(http.Header),
 		Body:  new(bytes.Buffer),
@@ -36,24 +93,257 @@ func NewResponseCacher(id int) *ResponseCacher {
 	}
 }
 
+// clone returns an independent copy of a filled response with the given id,
+// as if it was filled just like this. It must not be stored yet.
+func (c *ResponseCacher) clone(id int64) *ResponseCacher {
+	clone := c.copyResponse(id)
+	clone.origin = c.origin
+	clone.subject = c.subject
+	clone.ttl = c.ttl
+	clone.settings = c.settings
+	clone.tags = append([]string(nil), c.tags...)
+	clone.contentType = c.contentType
+	clone.types = c.types
+	clone.oversize = c.oversize
+	clone.shed = c.shed
+	clone.unwritten = c.unwritten
+	clone.frozen = c.frozen
+	return clone
+}
+
+// Clone returns a fresh ResponseCacher holding a copy of the response (status code,
+// headers and body), sharing nothing with c, e.g. to feed it to another cache.
+// A compressed body (see Compress) is copied decompressed, so the clone serves
+// as c does. None of the cache's bookkeeping is copied: the clone is as if just filled.
+func (c *ResponseCacher) Clone() *ResponseCacher {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.copyResponse(0)
+}
+
+// copyResponse copies the response itself (status code, headers and plain body)
+// into a new ResponseCacher with the given id, the part clone and Clone share.
+func (c *ResponseCacher) copyResponse(id int64) *ResponseCacher {
+	clone := NewResponseCacher(id)
+	clone.Code = c.Code
+	for key, val := range c.Head {
+		clone.Head[key] = append([]string(nil), val...)
+	}
+	if c.Body != nil || c.stream != nil {
+		if clone.Body == nil {
+			clone.Body = new(bytes.Buffer)
+		}
+		if err := c.copyBody(clone.Body); err != nil && c.stream != nil {
+			// the store failed it, a clone that serves it later may have more luck
+			clone.Body = new(bytes.Buffer)
+			clone.stream, clone.streamLen = c.stream, c.streamLen
+		} else if err != nil {
+			// can't inflate it, a copy as packed still serves like c does
+			clone.Body = bytes.NewBuffer(append([]byte(nil), c.Body.Bytes()...))
+			clone.compressed, clone.rawLen, clone.dict = c.compressed, c.rawLen, c.dict
+		}
+	} else {
+		clone.Body = nil
+	}
+	clone.Done = c.Done
+	clone.wroteHeader = c.wroteHeader
+	clone.headersOnly = c.headersOnly
+	return clone
+}
+
 // Serve the cached response (headers, statuscode and body) to a ResponseWriter
 // optionally, if mark is true, it sets a header ("X-From-BurstCache")
 // TODO: make this configurable
-func (c *ResponseCacher) Serve(w http.ResponseWriter, mark bool) {
+// The error from writing the body is returned, e.g. when the client went away.
+func (c *ResponseCacher) Serve(w http.ResponseWriter, mark bool) error {
+	c.copyHeader(w.Header(), mark)
+	return c.write(w)
+}
+
+// StreamBody makes the response serve its body from what open returns, opened
+// anew for every serve, instead of from Body. It is for stores that keep bodies
+// elsewhere (e.g. on disk, compressed at rest) and put their responses in with
+// Cache.Store. length is the length of the body as served, or -1 when it isn't
+// known up front: the response then goes out without a Content-Length, chunked,
+// rather than with a guess. With a length, MinBodyBytes and MaxBodyBytes go by
+// it; ShouldCacheBody, Compress and Digest leave a streamed body alone.
+func (c *ResponseCacher) StreamBody(open func() (io.ReadCloser, error), length int) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if length < 0 {
+		length = -1
+	}
+	c.Body = new(bytes.Buffer)
+	c.stream, c.streamLen = open, length
+}
+
+// copyHeader copies the cached headers into h, and the marker header if mark is true.
+// Every value of a header is copied, in the order the handler set them.
+func (c *ResponseCacher) copyHeader(h http.Header, mark bool) {
 	for key, val := range c.Head {
 		if len(val) > 0 {
-			w.Header().Set(key, val[0])
+			h[http.CanonicalHeaderKey(key)] = append([]string(nil), val...)
 		}
 	}
 	if mark {
-		w.Header().Set("X-From-BurstCache", "1")
+		h.Set(markerHeader, "1")
+	}
+}
+
+// write sends the cached statuscode and body. Headers must be in place already.
+// Content-Length is set to the length of the body when that is known up front,
+// when it isn't, it is omitted so net/http falls back to a chunked response.
+// A headers only response has no body to go by: its headers are sent as cached.
+// The body is sent byte for byte as the handler wrote it. The original Serve appended
+// a newline (fmt.Fprintln); that is dropped on purpose, it broke Content-Length,
+// ETags and digests.
+func (c *ResponseCacher) write(w http.ResponseWriter) error {
+	if c.headersOnly {
+		w.WriteHeader(c.Code)
+		return nil
+	}
+	if bodyAllowed(c.Code) {
+		n := c.contentLength()
+		switch {
+		case n < 0:
+			w.Header().Del("Content-Length")
+		case n > 0 || w.Header().Get("Content-Length") == "":
+			// an empty body with a Content-Length is a HEAD response, leave it
+			w.Header().Set("Content-Length", strconv.Itoa(n))
+		}
 	}
 	w.WriteHeader(c.Code)
-	fmt.Fprintln(w, c.Body.String())
+	if c.Body == nil {
+		return nil
+	}
+	return c.copyBody(w)
+}
+
+// contentLength returns the length of the body as served, or -1 when it isn't known up front.
+func (c *ResponseCacher) contentLength() int {
+	if c.stream != nil {
+		return c.streamLen
+	}
+	if c.Body == nil {
+		return -1
+	}
+	if c.compressed {
+		return c.rawLen
+	}
+	return c.Body.Len()
+}
+
+// bodyAllowed reports whether a response with the given status may have a body
+func bodyAllowed(code int) bool {
+	switch {
+	case code >= 100 && code <= 199:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// normalize drops the framing headers of the upstream response. However the
+// upstream streamed it (e.g. with Transfer-Encoding: chunked and no Content-Length),
+// the body is complete once buffered, so it is always replayed with a Content-Length
+// of its own (see write). Trailers are not captured, so their announcements go too.
+func (c *ResponseCacher) normalize() {
+	c.Head.Del("Transfer-Encoding")
+	c.Head.Del("Trailer")
+	for key := range c.Head {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			delete(c.Head, key)
+		}
+	}
+}
+
+// identity decompresses a gzip encoded body, so whether the upstream sent it
+// encoded or not, it is stored in the one canonical form and served the same way.
+// The encoding of a strong ETag is part of it, so it is weakened. A body that
+// doesn't decompress is left alone, one that decompresses beyond the limit (see
+// MaxBodyBytes) makes the response oversize.
+func (c *ResponseCacher) identity() {
+	if c.Body == nil || c.compressed {
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(c.Head.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+	default:
+		return
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(c.Body.Bytes()))
+	if err != nil {
+		return
+	}
+	var src io.Reader = zr
+	if c.limit > 0 {
+		src = io.LimitReader(zr, int64(c.limit)+1)
+	}
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return
+	}
+	if c.limit > 0 && len(raw) > c.limit {
+		c.oversize = true
+		c.Body = new(bytes.Buffer)
+		return
+	}
+	c.Body = bytes.NewBuffer(raw)
+	c.Head.Del("Content-Encoding")
+	c.Head.Del("Content-Length")
+	if etag := c.Head.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		c.Head.Set("ETag", "W/"+etag)
+	}
 }
 
-// Header returns the response headers.
+// digest computes the sum of the body served as the Digest header (RFC 3230),
+// unless the handler sent a Digest of its own.
+func (c *ResponseCacher) digest() {
+	if c.compressed || c.stream != nil || c.Head.Get("Digest") != "" {
+		return
+	}
+	var body []byte
+	if c.Body != nil {
+		body = c.Body.Bytes()
+	}
+	sum := sha256.Sum256(body)
+	c.sum = base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// informational reports whether code is a 1xx that precedes the final status.
+// 101 Switching Protocols is final, the connection changes hands after it.
+func informational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// crlf strips the characters that could split a response when a header is replayed.
+var crlf = strings.NewReplacer("\r", "", "\n", "")
+
+// sanitize removes CR and LF from the cached headers, so replaying them can never
+// inject headers or split the response. Headers with CR or LF in their name are dropped.
+func (c *ResponseCacher) sanitize() {
+	for key, vals := range c.Head {
+		if strings.ContainsAny(key, "\r\n") {
+			delete(c.Head, key)
+			continue
+		}
+		for i, val := range vals {
+			if strings.ContainsAny(val, "\r\n") {
+				vals[i] = crlf.Replace(val)
+			}
+		}
+	}
+}
+
+// Header returns the response headers. Once the cache is frozen (see freeze) it
+// returns a detached map, so changing it can't affect the cached headers.
 func (c *ResponseCacher) Header() http.Header {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.frozen {
+		return make(http.Header)
+	}
 	m := c.Head
 	if m == nil {
 		m = make(http.Header)
@@ -62,10 +352,44 @@ func (c *ResponseCacher) Header() http.Header {
 	return m
 }
 
-// Write always succeeds and writes to c.Body, if not nil.
+// ErrTooLarge is returned by Write once a body grows beyond MaxBodyBytes.
+var ErrTooLarge = errors.New("burstcache: response body exceeds MaxBodyBytes")
+
+// ErrLateWrite is returned by Write once the handler filling the cache has returned.
+var ErrLateWrite = errors.New("burstcache: write after the handler returned")
+
+// Write writes to c.Body, if not nil. It fails after the handler filling the cache
+// returned (ErrLateWrite), and when the body grows beyond
+// the limit (see MaxBodyBytes). Buffering then stops and what was buffered is released,
+// so a runaway response can't exhaust memory. When a client is waiting for this
+// very response, it is handed over to that client and the rest streams straight through.
+// With HeadersOnly the body is discarded, though reported written.
 func (c *ResponseCacher) Write(buf []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.frozen {
+		return 0, c.late()
+	}
 	if !c.wroteHeader {
-		c.WriteHeader(200)
+		c.writeHeader(200)
+	}
+	if c.headersOnly {
+		if c.onBody == nil || !bodyAllowed(c.Code) || len(buf) == 0 {
+			// nobody would get to see it
+			return len(buf), nil
+		}
+		// not a headers only route after all, don't serve it without its body
+		c.onBody()
+		c.headersOnly = false
+	}
+	if c.oversize {
+		if c.spill != nil {
+			return c.spill.Write(buf)
+		}
+		return 0, ErrTooLarge
+	}
+	if c.limit > 0 && c.Body != nil && c.Body.Len()+len(buf) > c.limit {
+		return c.overflow(buf)
 	}
 	if c.Body != nil {
 		c.Body.Write(buf)
@@ -73,18 +397,116 @@ func (c *ResponseCacher) Write(buf []byte) (int, error) {
 	return len(buf), nil
 }
 
-// WriteHeader sets c.Code.
+// overflow stops buffering and hands the response over to the spill writer, if any.
+func (c *ResponseCacher) overflow(buf []byte) (int, error) {
+	c.oversize = true
+	buffered := c.Body.Bytes()
+	c.Body = new(bytes.Buffer)
+	if c.spill == nil {
+		return 0, ErrTooLarge
+	}
+	c.spilled = true
+	for key, val := range c.Head {
+		c.spill.Header()[key] = val
+	}
+	c.spill.WriteHeader(c.Code)
+	if _, err := c.spill.Write(buffered); err != nil {
+		return 0, err
+	}
+	return c.spill.Write(buf)
+}
+
+// WriteHeader sets c.Code, and the default Content-Type (see DefaultContentType)
+// if the response may have a body and the handler set none.
+// Informational codes (1xx but 101, like 103 Early Hints) are not the response,
+// they are never stored; with ForwardInformational they are passed on to the
+// client waiting for a cold fill.
 func (c *ResponseCacher) WriteHeader(code int) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.frozen {
+		c.late()
+		return
+	}
+	c.writeHeader(code)
+}
+
+func (c *ResponseCacher) writeHeader(code int) {
+	if informational(code) {
+		if c.informational && c.spill != nil && !c.wroteHeader {
+			for key, val := range c.Head {
+				c.spill.Header()[key] = val
+			}
+			c.spill.WriteHeader(code)
+		}
+		return
+	}
 	if !c.wroteHeader {
 		c.Code = code
+		if c.contentType != "" && bodyAllowed(code) && c.Head.Get("Content-Type") == "" {
+			if c.Head == nil {
+				c.Head = make(http.Header)
+			}
+			c.Head.Set("Content-Type", c.contentType)
+		}
 	}
 	c.wroteHeader = true
 }
 
-// Flush sets c.Done to true.
+// Flush sets c.Done to true. A handler may flush halfway and write on, so Done
+// doesn't mean the response is complete: that it is once the handler returned.
 func (c *ResponseCacher) Flush() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.frozen {
+		c.late()
+		return
+	}
 	if !c.wroteHeader {
-		c.WriteHeader(200)
+		c.writeHeader(200)
+	}
+	if c.oversize {
+		if f, ok := c.spill.(http.Flusher); ok {
+			f.Flush()
+		}
 	}
 	c.Done = true
 }
+
+// freeze rejects all further writes, once the handler filling the cache has returned
+// or the cache is handed to Store. Whatever a stray goroutine writes later must not
+// end up in the cache: a cache is complete before it is swapped in, and from then
+// on only read (see swap).
+func (c *ResponseCacher) freeze() {
+	c.wmu.Lock()
+	c.frozen = true
+	c.wmu.Unlock()
+}
+
+// complete reports whether the response is whole: the handler returned (or it was
+// handed to Store), however often it flushed before.
+func (c *ResponseCacher) complete() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.frozen
+}
+
+// settle gives a response the handler wrote nothing at all for (no WriteHeader,
+// no Write) the status net/http gives it: a 200, with an empty body. It is marked
+// unwritten, see SkipUnwritten. It must be frozen already.
+func (c *ResponseCacher) settle() {
+	if c.wroteHeader || c.Code != 0 {
+		return
+	}
+	c.Code = http.StatusOK
+	c.wroteHeader = true
+	c.unwritten = true
+}
+
+// late reports a write after freeze, the caller holds wmu.
+func (c *ResponseCacher) late() error {
+	if c.onLate != nil {
+		c.onLate()
+	}
+	return ErrLateWrite
+}
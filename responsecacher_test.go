@@ -0,0 +1,103 @@
+package burstcache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloneIsIndependent(t *testing.T) {
+	body := strings.Repeat(`{"id":1,"name":"burstcache"}`, 64)
+	for _, compress := range []bool{false, true} {
+		c := NewCache(nil, nil, time.Minute, time.Minute)
+		c.Compress = compress
+		cached := c.GetOrFill("k", func() *ResponseCacher {
+			fill := NewResponseCacher(0)
+			fill.Head.Set("Content-Type", "application/json")
+			fill.Head.Add("X-Multi", "a")
+			fill.WriteHeader(201)
+			fill.Write([]byte(body))
+			return fill
+		})
+		if cached.compressed != compress {
+			t.Fatalf("compress %v: entry compressed is %v", compress, cached.compressed)
+		}
+
+		clone := cached.Clone()
+		if clone.compressed || clone.Code != 201 || clone.Body.String() != body {
+			t.Fatalf("compress %v: clone holds %d %q", compress, clone.Code, clone.Body.String())
+		}
+		clone.Head.Add("X-Multi", "b")
+		clone.Head["X-Multi"][0] = "changed"
+		clone.Head.Set("Content-Type", "text/plain")
+		clone.Body.WriteString("more")
+		clone.Code = 500
+
+		rec := httptest.NewRecorder()
+		if err := c.GetOrFill("k", nil).Serve(rec, false); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != 201 || rec.Body.String() != body {
+			t.Fatalf("compress %v: original serves %d %q", compress, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header()["X-Multi"]; len(got) != 1 || got[0] != "a" || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("compress %v: original headers changed: %v", compress, rec.Header())
+		}
+	}
+}
+
+func TestCloneKeepsUnbufferedBody(t *testing.T) {
+	c := NewResponseCacher(0)
+	c.Body = nil
+	c.WriteHeader(204)
+	if clone := c.Clone(); clone.Body != nil || clone.Code != 204 {
+		t.Fatalf("clone of a response without a body has body %v, code %d", clone.Body, clone.Code)
+	}
+}
+
+func TestWriteStopsBufferingAtLimit(t *testing.T) {
+	rc := NewResponseCacher(0)
+	rc.limit = 10
+	if _, err := rc.Write([]byte("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Write([]byte("abcdef")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("writing past the limit: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := rc.Write([]byte(strings.Repeat("x", 1000))); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("writing on past the limit: %v", err)
+		}
+	}
+	if n := rc.Body.Len(); n != 0 || !rc.oversize {
+		t.Fatalf("%d bytes buffered past the limit", n)
+	}
+
+	// through the cache, the client still gets it all
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Second)
+	c.MaxBodyBytes = 10
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("abcdef"))
+		}
+	}))
+	if rec := get(h, "/x"); rec.Body.String() != strings.Repeat("abcdef", 5) {
+		t.Fatalf("served %q", rec.Body.String())
+	}
+	if _, ok := c.Peek("/x"); ok {
+		t.Fatal("an oversize response was cached")
+	}
+}
+
+func TestServedByteForByte(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	h := c.Chain(&counting{body: "no newline"})
+	get(h, "/x")
+	rec := get(h, "/x")
+	if body := rec.Body.String(); body != "no newline" || rec.Header().Get("Content-Length") != "10" {
+		t.Fatalf("served %q with Content-Length %s, want the body as written", body, rec.Header().Get("Content-Length"))
+	}
+}
@@ -0,0 +1,99 @@
+package burstcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	An error response (429, 503, ...) may carry a Retry-After, telling clients
+	when the backend expects to recover. Replaying the header as stored would
+	be wrong: a delta keeps promising the full delay however old the response
+	is. So the moment it points at is recorded when the response is stored,
+	replays count down to it, and the error isn't kept fresh beyond it either.
+*/
+
+/*
+	parseRetryAfter parses a Retry-After header, in delta-seconds or HTTP-date form
+*/
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at, true
+	}
+	return time.Time{}, false
+}
+
+/*
+	Record when an error response says the backend will recover
+*/
+func (c *ResponseCacher) recordRetryAfter(now time.Time) {
+	if c.Code < 400 {
+		return
+	}
+	if at, ok := parseRetryAfter(c.Head.Get("Retry-After"), now); ok {
+		c.retryAt = at
+	}
+}
+
+/*
+	retryAfter returns the Retry-After to send now, in whole seconds and never below zero
+*/
+func (c *ResponseCacher) retryAfter(now time.Time) string {
+	left := c.retryAt.Sub(now)
+	if left < 0 {
+		left = 0
+	}
+	return strconv.Itoa(int((left + time.Second - 1) / time.Second))
+}
+
+/*
+	requestTTL returns the time to live of what r fills, as set by WithTTL or
+	RouteTTL and capped by MaxTTL. 0 means TTL.
+*/
+func (c *Cache) requestTTL(cfg *CacheConfig, r *http.Request) time.Duration {
+	ttl, ok := contextTTL(r)
+	if !ok && c.RouteTTL != nil {
+		ttl, ok = c.RouteTTL(r)
+	}
+	if !ok || ttl <= 0 {
+		return 0
+	}
+	if cfg.MaxTTL > 0 && ttl > cfg.MaxTTL {
+		return cfg.MaxTTL
+	}
+	return ttl
+}
+
+/*
+	ttlFor returns the time to live of a cache, which is TTL (or what its request
+	set, see requestTTL), or the StatusTTL of its status code if there is one,
+	unless the response asked to be retried sooner. The caller must hold the lock.
+*/
+func (c *Cache) ttlFor(cache *ResponseCacher) time.Duration {
+	ttl := c.settings().TTL
+	if cache.ttl > 0 {
+		ttl = cache.ttl
+	}
+	if status, ok := c.StatusTTL[cache.Code]; ok && status > 0 {
+		// a 404 shouldn't live as long as the route would, nor a 301 as short
+		ttl = status
+	}
+	if !cache.retryAt.IsZero() {
+		if until := cache.retryAt.Sub(cache.stored); until < ttl {
+			ttl = until
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,79 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		" 0 ":                           0,
+		"Fri, 02 Jan 2026 03:05:05 GMT": time.Minute,
+	} {
+		at, ok := parseRetryAfter(value, now)
+		if !ok || at.Sub(now) != want {
+			t.Errorf("%q parsed as %v (%v), want %v from now", value, at.Sub(now), ok, want)
+		}
+	}
+	for _, value := range []string{"", "-5", "soon", "2026-01-02"} {
+		if _, ok := parseRetryAfter(value, now); ok {
+			t.Errorf("%q parsed", value)
+		}
+	}
+}
+
+func TestRetryAfterCountsDown(t *testing.T) {
+	// whole seconds, as the date form has them
+	stored := time.Now().Truncate(time.Second)
+	for _, value := range []string{"30", stored.Add(30 * time.Second).UTC().Format(http.TimeFormat)} {
+		cache := NewResponseCacher(0)
+		cache.Code = http.StatusServiceUnavailable
+		cache.stored = stored
+		cache.Head.Set("Retry-After", value)
+		cache.recordRetryAfter(stored)
+		for age, want := range map[time.Duration]string{
+			0:                "30",
+			10 * time.Second: "20",
+			time.Minute:      "0",
+		} {
+			if got := cache.retryAfter(stored.Add(age)); got != want {
+				t.Errorf("Retry-After: %s replayed as %s after %v, want %s", value, got, age, want)
+			}
+		}
+
+		c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+		c.mu.RLock()
+		ttl := c.ttlFor(cache)
+		c.mu.RUnlock()
+		if ttl != 30*time.Second {
+			t.Errorf("Retry-After: %s kept fresh for %v, want the TTL capped at it", value, ttl)
+		}
+	}
+}
+
+func TestRetryAfterServed(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	get(h, "/a")
+	rec := get(h, "/a")
+	if rec.Header().Get(markerHeader) == "" || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("replayed Retry-After %q", rec.Header().Get("Retry-After"))
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	rec = httptest.NewRecorder()
+	c.ServeCached("/a", rec)
+	if got := rec.Header().Get("Retry-After"); got != "0" {
+		t.Fatalf("replayed Retry-After %q once it passed, want 0", got)
+	}
+	if meta, _ := c.Peek("/a"); meta.Fresh {
+		t.Fatal("still fresh after its Retry-After")
+	}
+}
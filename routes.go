@@ -0,0 +1,206 @@
+package burstcache
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+	Some routes don't cache well: when nearly every request has a key of its own
+	(think per user dashboards), entries are filled, never hit and die, only
+	costing memory. With a Grouper naming the route of each key, the cache counts
+	per route how requests are answered, over the last rate buckets (see
+	RateBucket), and UnfriendlyRoutes reports the routes that hardly ever hit.
+	With BypassUnfriendly, it also switches them to be passed through uncached.
+*/
+
+/*
+	minRouteRequests is how many requests a route needs in the window to be judged
+*/
+const minRouteRequests = 10
+
+/*
+	route counts how the requests for the keys of one route were answered
+*/
+type route struct {
+	hits  rate // answered from the cache (fresh, stale or collapsed)
+	fills rate // answered by filling a new entry
+}
+
+/*
+	RouteReport describes how well a route caches over the recent window
+*/
+type RouteReport struct {
+	Route    string  // the route, as named by Grouper
+	Requests float64 // requests answered from the cache or by a fill
+	Fills    float64 // entries filled, the churn
+	HitRatio float64 // share of the requests answered from the cache
+	Bypassed bool    // the route is passed through uncached, see BypassRoute
+}
+
+/*
+	countRoute counts how a request for key was answered, with a Grouper
+*/
+func (c *Cache) countRoute(key string, outcome Outcome) {
+	if c.Grouper == nil {
+		return
+	}
+	name := c.Grouper(key)
+	c.mu.RLock()
+	rt := c.routes[name]
+	c.mu.RUnlock()
+	if rt == nil {
+		c.mu.Lock()
+		if rt = c.routes[name]; rt == nil {
+			if c.routes == nil {
+				c.routes = map[string]*route{}
+			}
+			rt = new(route)
+			c.routes[name] = rt
+		}
+		c.mu.Unlock()
+	}
+	now, bucket := time.Now(), c.rateBucket()
+	if outcome == OutcomeMiss {
+		rt.fills.hit(now, bucket)
+	} else {
+		rt.hits.hit(now, bucket)
+	}
+}
+
+/*
+	UnfriendlyRoutes returns the routes whose hit ratio over the recent window is
+	below threshold (0 to 1), worst first, and with BypassUnfriendly switches them
+	to bypass the cache. Routes with fewer than a handful of requests in the
+	window aren't judged. It takes a Grouper, without one nothing is reported.
+*/
+func (c *Cache) UnfriendlyRoutes(threshold float64) []RouteReport {
+	now, bucket := time.Now(), c.rateBucket()
+	var reports []RouteReport
+	c.mu.RLock()
+	for name, rt := range c.routes {
+		hits, fills := rt.hits.total(now, bucket), rt.fills.total(now, bucket)
+		requests := hits + fills
+		if requests < minRouteRequests || hits/requests >= threshold {
+			continue
+		}
+		reports = append(reports, RouteReport{
+			Route:    name,
+			Requests: requests,
+			Fills:    fills,
+			HitRatio: hits / requests,
+			Bypassed: c.bypassed[name],
+		})
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].HitRatio != reports[j].HitRatio {
+			return reports[i].HitRatio < reports[j].HitRatio
+		}
+		if reports[i].Fills != reports[j].Fills {
+			return reports[i].Fills > reports[j].Fills
+		}
+		return reports[i].Route < reports[j].Route
+	})
+
+	if c.BypassUnfriendly {
+		for i := range reports {
+			c.BypassRoute(reports[i].Route, true)
+			reports[i].Bypassed = true
+		}
+	}
+	return reports
+}
+
+/*
+	BypassRoute switches a route (as named by Grouper) to be passed through
+	uncached, or back to being cached. What is cached for it already stays
+	until it expires.
+*/
+func (c *Cache) BypassRoute(name string, bypass bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !bypass {
+		delete(c.bypassed, name)
+		return
+	}
+	if c.bypassed == nil {
+		c.bypassed = map[string]bool{}
+	}
+	c.bypassed[name] = true
+}
+
+/*
+	bypassRoute reports whether key belongs to a route that bypasses the cache
+*/
+func (c *Cache) bypassRoute(key string) bool {
+	if c.Grouper == nil {
+		return false
+	}
+	c.mu.RLock()
+	n := len(c.bypassed)
+	c.mu.RUnlock()
+	if n == 0 {
+		return false
+	}
+	name := c.Grouper(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bypassed[name]
+}
+
+/*
+	With a Grouper, cached entries are also indexed by route, so InvalidateRoute
+	removes all entries of a route (e.g. every /orders/{id}) without scanning the
+	cache. The index holds one slot per entry, accounted in its estimated memory
+	(see MaxBytes), so it is as bounded as the cache itself.
+*/
+
+/*
+	indexRoute adds a cache being swapped in to the route index. The caller must hold the lock.
+*/
+func (c *Cache) indexRoute(cache *ResponseCacher) {
+	if cache.route == "" {
+		return
+	}
+	keys := c.routed[cache.route]
+	if keys == nil {
+		if c.routed == nil {
+			c.routed = map[string]map[string]struct{}{}
+		}
+		keys = map[string]struct{}{}
+		c.routed[cache.route] = keys
+	}
+	keys[cache.key] = struct{}{}
+}
+
+/*
+	unindexRoute removes a cache being removed from the route index. The caller must hold the lock.
+*/
+func (c *Cache) unindexRoute(cache *ResponseCacher) {
+	if cache.route == "" {
+		return
+	}
+	keys := c.routed[cache.route]
+	delete(keys, cache.key)
+	if len(keys) == 0 {
+		delete(c.routed, cache.route)
+	}
+}
+
+/*
+	InvalidateRoute removes every response cached for a route (as named by Grouper),
+	from the shared tier too. Returns the number of responses removed locally.
+*/
+func (c *Cache) InvalidateRoute(route string) int {
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.routed[route]))
+	for key := range c.routed[route] {
+		keys = append(keys, key)
+	}
+	c.mu.RUnlock()
+
+	n, _ := c.invalidateAll(keys)
+	return n
+}
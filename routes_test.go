@@ -0,0 +1,75 @@
+package burstcache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnfriendlyRoutes(t *testing.T) {
+	for _, bypass := range []bool{false, true} {
+		c := NewCache(&Keymaker{}, nil, time.Minute, time.Minute)
+		c.Grouper = func(key string) string { return strings.Split(key, "/")[1] }
+		c.BypassUnfriendly = bypass
+		h := c.Chain(&counting{body: "x"})
+		// a list everyone shares, dashboards of their own, and a route too quiet to judge
+		for i := 0; i < 50; i++ {
+			get(h, "/list")
+			get(h, fmt.Sprint("/user/", i))
+		}
+		get(h, "/about/1")
+		get(h, "/about/2")
+
+		reports := c.UnfriendlyRoutes(0.5)
+		if len(reports) != 1 {
+			t.Fatalf("BypassUnfriendly %v: reported %+v, want the user route", bypass, reports)
+		}
+		if r := reports[0]; r.Route != "user" || r.Requests != 50 || r.Fills != 50 || r.HitRatio != 0 || r.Bypassed != bypass {
+			t.Fatalf("BypassUnfriendly %v: reported %+v", bypass, r)
+		}
+
+		before := c.Stats().Entries
+		get(h, "/user/new")
+		if cached := c.Stats().Entries > before; cached == bypass {
+			t.Fatalf("BypassUnfriendly %v: a new dashboard cached %v", bypass, cached)
+		}
+		if _, ok := c.Peek("/list"); !ok {
+			t.Fatalf("BypassUnfriendly %v: the friendly route isn't cached", bypass)
+		}
+	}
+}
+
+func TestInvalidateRoute(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Grouper = func(key string) string {
+		if strings.HasPrefix(key, "/orders/") {
+			return "/orders/{id}"
+		}
+		return "/users/{id}"
+	}
+	for i := 0; i < 100; i++ {
+		c.Store(fmt.Sprint("/orders/", i), filled("x"))
+		c.Store(fmt.Sprint("/users/", i), filled("x"))
+	}
+	// churn: replace some, remove others
+	for i := 0; i < 30; i++ {
+		c.Store(fmt.Sprint("/orders/", i), filled("x"))
+		c.Invalidate(fmt.Sprint("/users/", i))
+	}
+	if n := c.Stats().Routes; n != 2 {
+		t.Fatalf("%d routes indexed, want 2", n)
+	}
+	if n := c.InvalidateRoute("/users/{id}"); n != 70 {
+		t.Fatalf("%d users invalidated, want the 70 left", n)
+	}
+	if n := c.InvalidateRoute("/orders/{id}"); n != 100 {
+		t.Fatalf("%d orders invalidated, want 100", n)
+	}
+	if s := c.Stats(); s.Entries != 0 || s.Routes != 0 || s.Bytes != 0 {
+		t.Fatalf("%d entries, %d routes, %d bytes left", s.Entries, s.Routes, s.Bytes)
+	}
+	if n := c.InvalidateRoute("/nope"); n != 0 {
+		t.Fatalf("%d invalidated of a route never seen", n)
+	}
+}
@@ -0,0 +1,103 @@
+package burstcache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+	SchemeKeymaker wraps another Keyer and adds the effective scheme (http or https)
+	of the request to its key, so handlers that render absolute urls don't leak
+	bodies across schemes when TLS is terminated in different places.
+
+	The scheme is derived from r.TLS. X-Forwarded-Proto is only honoured when
+	TrustProxyHeaders is set and the request arrives from one of the TrustedProxies,
+	and then only its last value: a proxy appending to the header keeps what the
+	client sent in front of its own. Forwarded headers from anybody else are
+	ignored, otherwise any client could poison the https entries over plain http.
+*/
+type SchemeKeymaker struct {
+	Keyer Keyer // the keyer whose keys are made scheme aware
+
+	TrustProxyHeaders bool         // honour X-Forwarded-Proto from trusted proxies
+	TrustedProxies    []*net.IPNet // remote addresses allowed to set X-Forwarded-Proto
+}
+
+/*
+	Factory function, trusted is a list of CIDRs (e.g. "10.0.0.0/8") of the proxies
+	allowed to set X-Forwarded-Proto. Passing none disables the proxy header.
+*/
+func NewSchemeKeymaker(keyer Keyer, trusted ...string) (*SchemeKeymaker, error) {
+	k := &SchemeKeymaker{
+		Keyer:             keyer,
+		TrustProxyHeaders: len(trusted) > 0,
+	}
+	for _, cidr := range trusted {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		k.TrustedProxies = append(k.TrustedProxies, network)
+	}
+	return k, nil
+}
+
+func (k *SchemeKeymaker) Key(w http.ResponseWriter, r *http.Request) string {
+
+	key := k.Keyer.Key(w, r)
+	if key == "" {
+		return ""
+	}
+
+	return key + "|" + k.scheme(r)
+}
+
+/*
+	scheme returns the effective scheme of the request
+*/
+func (k *SchemeKeymaker) scheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !k.TrustProxyHeaders || !k.trusted(r.RemoteAddr) {
+		return scheme
+	}
+	values := r.Header.Values("X-Forwarded-Proto")
+	if len(values) == 0 {
+		return scheme
+	}
+	// the trusted proxy appends its own, whatever is in front came from the client
+	proto := values[len(values)-1]
+	if i := strings.LastIndexByte(proto, ','); i >= 0 {
+		proto = proto[i+1:]
+	}
+	switch strings.ToLower(strings.TrimSpace(proto)) {
+	case "https":
+		return "https"
+	case "http":
+		return "http"
+	}
+	return scheme
+}
+
+/*
+	trusted reports whether the remote address belongs to a trusted proxy
+*/
+func (k *SchemeKeymaker) trusted(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range k.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
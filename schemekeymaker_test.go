@@ -0,0 +1,71 @@
+package burstcache
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSchemeKeymaker(t *testing.T) {
+	k, err := NewSchemeKeymaker(&Keymaker{}, "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusting, err := NewSchemeKeymaker(&Keymaker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		keyer     *SchemeKeymaker
+		remote    string
+		tls       bool
+		forwarded string
+		want      string
+	}{
+		{"plain", k, "192.0.2.1:1234", false, "", "/x|http"},
+		{"tls", k, "192.0.2.1:1234", true, "", "/x|https"},
+		{"trusted proxy, https", k, "10.1.2.3:1234", false, "https", "/x|https"},
+		{"trusted proxy, http over tls", k, "10.1.2.3:1234", true, "http", "/x|http"},
+		{"trusted proxy, appended to the client's", k, "10.1.2.3:1234", false, "https, http", "/x|http"},
+		{"trusted proxy, appended to the client's over tls", k, "10.1.2.3:1234", true, "http, HTTPS", "/x|https"},
+		{"trusted proxy, nonsense", k, "10.1.2.3:1234", false, "gopher", "/x|http"},
+		{"untrusted client, https", k, "192.0.2.1:1234", false, "https", "/x|http"},
+		{"untrusted client, http over tls", k, "192.0.2.1:1234", true, "http", "/x|https"},
+		{"no proxies trusted", untrusting, "10.1.2.3:1234", false, "https", "/x|http"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.RemoteAddr = tt.remote
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.forwarded)
+		}
+		if got := tt.keyer.Key(httptest.NewRecorder(), r); got != tt.want {
+			t.Errorf("%s: key %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// a proxy adding a header line of its own behind the client's
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Add("X-Forwarded-Proto", "https")
+	r.Header.Add("X-Forwarded-Proto", "http")
+	if got := k.Key(httptest.NewRecorder(), r); got != "/x|http" {
+		t.Errorf("two header lines: key %q, want /x|http", got)
+	}
+
+	if _, err := NewSchemeKeymaker(&Keymaker{}, "10.0.0.0"); err == nil {
+		t.Error("a proxy that isn't a CIDR is accepted")
+	}
+}
+
+func TestSchemeKeymakerBypass(t *testing.T) {
+	k, _ := NewSchemeKeymaker(keyerFunc(func(r *http.Request) string { return "" }))
+	if key := k.Key(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil)); key != "" {
+		t.Fatalf("key %q for a request its Keyer bypasses", key)
+	}
+}
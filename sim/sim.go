@@ -0,0 +1,261 @@
+/*
+	Package sim replays recorded traffic against candidate cache settings, to see
+	what a change of TTL, TTD or MaxBytes would do before trying it in production:
+
+		trace := sim.FromEvents(cache.RecentEvents())
+		for _, report := range sim.Run(trace,
+			sim.Config{Name: "now", TTL: time.Second, TTD: 4 * time.Second},
+			sim.Config{Name: "longer", TTL: 5 * time.Second, TTD: 10 * time.Second},
+		) {
+			fmt.Println(report)
+		}
+
+	The replay runs through a real burstcache.Cache, on a burstcache.ManualClock,
+	so hours of traffic take milliseconds, and no handler is called: a fill takes
+	as long as fills of its key took when the trace was recorded (or Config.Regen),
+	it lands as a Store once the clock got there. Every request is looked up with
+	Cache.Access, so whether it is a hit, served stale or refreshes, when an entry
+	goes stale and dies, and which entries MaxBytes evicts are decided by the very
+	code that decides them in production. A request that misses while a fill of
+	its key is out is collapsed onto it, as Chain collapses cold misses.
+
+	What the config doesn't cover is left at the defaults of the cache, and what
+	takes a handler or requests is left out: per request and per status time to
+	live (WithTTL, RouteTTL, StatusTTL, Retry-After), Freshness, RetryBudget,
+	StrictTuning, MinBodyBytes and MaxBodyBytes, failing fills and WatchMemory.
+	Every entry has a body of Config.EntryBytes. As in the cache, MaxBytes picks
+	its victims from a sample of the entries, so with many of them replays of
+	the same trace may differ a little. Compare the reports of candidates with
+	each other, rather than taking them as what production will see.
+*/
+package sim
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/DapperDodo/burstcache"
+)
+
+/*
+	Request is one request of a trace
+*/
+type Request struct {
+	At  time.Time
+	Key string
+}
+
+/*
+	Trace is the recorded traffic to replay
+*/
+type Trace struct {
+	Requests []Request               // in any order, they are replayed by At
+	Regen    map[string]time.Duration // how long a fill of a key took, if recorded
+}
+
+/*
+	FromEvents makes a trace of the events of a cache (see burstcache.Cache.RecentEvents):
+	every request it answered, and per key how long its fills took on average.
+	Keys are as the events hold them, which is fine as long as Redact keeps them apart.
+*/
+func FromEvents(events []burstcache.Event) Trace {
+	trace := Trace{Regen: map[string]time.Duration{}}
+	took := map[string][]time.Duration{}
+	for _, e := range events {
+		switch e.Decision {
+		case burstcache.OutcomeHit.String(), burstcache.OutcomeStale.String(), burstcache.OutcomeCollapsed.String():
+			trace.Requests = append(trace.Requests, Request{At: e.At, Key: e.Key})
+		case burstcache.OutcomeMiss.String():
+			trace.Requests = append(trace.Requests, Request{At: e.At, Key: e.Key})
+			took[e.Key] = append(took[e.Key], e.Took)
+		case burstcache.DecisionRefresh:
+			took[e.Key] = append(took[e.Key], e.Took)
+		}
+	}
+	for key, durations := range took {
+		var sum time.Duration
+		for _, d := range durations {
+			sum += d
+		}
+		trace.Regen[key] = sum / time.Duration(len(durations))
+	}
+	return trace
+}
+
+/*
+	Config is a candidate setting of the cache
+*/
+type Config struct {
+	Name string // to tell the reports apart
+
+	TTL          time.Duration // as burstcache.Cache.TTL
+	TTD          time.Duration // as burstcache.Cache.TTD
+	RefreshDelay time.Duration // as burstcache.Cache.RefreshDelay
+	MaxBytes     int64         // as burstcache.Cache.MaxBytes, 0 for no limit
+
+	Regen      time.Duration // how long a fill takes for keys the trace has no duration of
+	EntryBytes int           // the body of every entry, defaults to 1024; the memory it holds is estimated as the cache does
+}
+
+/*
+	Report is the outcome of replaying a trace with one Config
+*/
+type Report struct {
+	Config Config
+
+	Requests  int // requests replayed
+	Hits      int // served fresh
+	Stale     int // served stale
+	Collapsed int // waited for the fill of another request
+	Misses    int // had to be filled
+
+	Upstream     int     // requests to the handler: fills and refreshes
+	UpstreamRate float64 // upstream requests per second over the trace
+	HitRatio     float64 // share of the requests served from the cache, fresh or stale
+
+	Staleness Staleness // how stale the stale responses were
+	PeakBytes int64     // the most memory the entries held at once, see burstcache.Stats.Bytes
+}
+
+/*
+	Staleness is the distribution of how long stale responses had been stale when served
+*/
+type Staleness struct {
+	P50, P90, P99, Max time.Duration
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%s: hit ratio %.3f, upstream %.2f/s, staleness p50 %v p99 %v, peak %d bytes",
+		r.Config.Name, r.HitRatio, r.UpstreamRate, r.Staleness.P50, r.Staleness.P99, r.PeakBytes)
+}
+
+/*
+	Run replays the trace with every config, and reports on each in the same order
+*/
+func Run(trace Trace, configs ...Config) []Report {
+	requests := append([]Request(nil), trace.Requests...)
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].At.Before(requests[j].At)
+	})
+	reports := make([]Report, len(configs))
+	for i, config := range configs {
+		reports[i] = replay(requests, trace.Regen, config)
+	}
+	return reports
+}
+
+/*
+	sim is one replay in progress
+*/
+type sim struct {
+	config  Config
+	regen   map[string]time.Duration
+	clock   *burstcache.ManualClock
+	cache   *burstcache.Cache
+	filling map[string]bool // keys with a cold fill out, requests collapse onto it
+	body    []byte          // of every response
+	report  Report
+	stale   []time.Duration
+}
+
+func replay(requests []Request, regen map[string]time.Duration, config Config) Report {
+	if config.EntryBytes <= 0 {
+		config.EntryBytes = 1024
+	}
+	var start time.Time
+	if len(requests) > 0 {
+		start = requests[0].At
+	}
+	s := &sim{
+		config:  config,
+		regen:   regen,
+		clock:   burstcache.NewManualClock(start),
+		filling: map[string]bool{},
+		body:    make([]byte, config.EntryBytes),
+		report:  Report{Config: config},
+	}
+	s.cache = burstcache.NewCache(nil, nil, config.TTL, config.TTD)
+	s.cache.Clock = s.clock
+	s.cache.RefreshDelay = config.RefreshDelay
+	s.cache.MaxBytes = config.MaxBytes
+	for _, r := range requests {
+		// fires what the cache and the fills have due by then
+		s.clock.AdvanceTo(r.At)
+		s.request(r)
+	}
+	return s.finish(requests)
+}
+
+func (s *sim) request(r Request) {
+	s.report.Requests++
+	state, refresh := s.cache.Access(r.Key)
+	switch {
+	case state == burstcache.Fresh:
+		s.report.Hits++
+	case state == burstcache.Stale:
+		s.report.Stale++
+		if meta, ok := s.cache.Peek(r.Key); ok {
+			s.stale = append(s.stale, r.At.Sub(meta.Staled))
+		}
+		if refresh {
+			s.fill(r.Key)
+		}
+	case s.filling[r.Key]:
+		s.report.Collapsed++
+	default:
+		s.report.Misses++
+		s.filling[r.Key] = true
+		s.fill(r.Key)
+	}
+}
+
+/*
+	fill starts a fill (or refresh) of key, landing when the key takes to fill
+*/
+func (s *sim) fill(key string) {
+	s.report.Upstream++
+	took, ok := s.regen[key]
+	if !ok {
+		took = s.config.Regen
+	}
+	s.clock.AfterFunc(took, func() {
+		s.land(key)
+	})
+}
+
+/*
+	land stores the response a fill of key produced
+*/
+func (s *sim) land(key string) {
+	delete(s.filling, key)
+	response := burstcache.NewResponseCacher(0)
+	response.WriteHeader(http.StatusOK)
+	response.Write(s.body)
+	// can't fail, the cache is never drained and takes bodies of any size
+	s.cache.Store(key, response)
+	if bytes := s.cache.Stats().Bytes; bytes > s.report.PeakBytes {
+		s.report.PeakBytes = bytes
+	}
+}
+
+func (s *sim) finish(requests []Request) Report {
+	r := s.report
+	if r.Requests > 0 {
+		r.HitRatio = float64(r.Hits+r.Stale) / float64(r.Requests)
+	}
+	if len(requests) > 1 {
+		if span := requests[len(requests)-1].At.Sub(requests[0].At).Seconds(); span > 0 {
+			r.UpstreamRate = float64(r.Upstream) / span
+		}
+	}
+	if len(s.stale) > 0 {
+		sort.Slice(s.stale, func(i, j int) bool { return s.stale[i] < s.stale[j] })
+		at := func(q float64) time.Duration {
+			return s.stale[int(q*float64(len(s.stale)-1))]
+		}
+		r.Staleness = Staleness{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: s.stale[len(s.stale)-1]}
+	}
+	return r
+}
@@ -0,0 +1,106 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DapperDodo/burstcache"
+)
+
+/*
+steady is a trace of two keys requested every 100ms for 10s
+*/
+func steady() Trace {
+	start := time.Unix(0, 0)
+	var trace Trace
+	for i := 0; i < 100; i++ {
+		at := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		trace.Requests = append(trace.Requests, Request{At: at, Key: "a"}, Request{At: at, Key: "b"})
+	}
+	return trace
+}
+
+/*
+only is the part of trace that requests key
+*/
+func only(key string, trace Trace) Trace {
+	var part Trace
+	for _, r := range trace.Requests {
+		if r.Key == key {
+			part.Requests = append(part.Requests, r)
+		}
+	}
+	return part
+}
+
+func TestRunComparesConfigs(t *testing.T) {
+	reports := Run(steady(),
+		Config{Name: "short", TTL: 100 * time.Millisecond, Regen: 50 * time.Millisecond},
+		Config{Name: "long", TTL: time.Second, TTD: 5 * time.Second, Regen: 50 * time.Millisecond},
+	)
+	short, long := reports[0], reports[1]
+	if short.Config.Name != "short" || long.Config.Name != "long" {
+		t.Fatalf("reports out of order: %v", reports)
+	}
+	if short.Requests != 200 || long.Requests != 200 {
+		t.Fatalf("replayed %d and %d requests, want 200", short.Requests, long.Requests)
+	}
+	if long.HitRatio <= short.HitRatio {
+		t.Errorf("hit ratio of the longer TTL %.3f, of the short one %.3f", long.HitRatio, short.HitRatio)
+	}
+	if long.Upstream >= short.Upstream || long.UpstreamRate >= short.UpstreamRate {
+		t.Errorf("upstream of the longer TTL %d, of the short one %d", long.Upstream, short.Upstream)
+	}
+	// without TTD nothing is ever served stale
+	if short.Stale != 0 || short.Staleness.Max != 0 {
+		t.Errorf("short served %d stale, up to %v", short.Stale, short.Staleness.Max)
+	}
+	if long.Stale == 0 || long.Staleness.Max == 0 || long.Staleness.Max > 50*time.Millisecond {
+		t.Errorf("long served %d stale, up to %v, want some, no staler than a refresh takes", long.Stale, long.Staleness.Max)
+	}
+	one := Run(only("a", steady()), long.Config)[0]
+	if one.PeakBytes <= 1024 || long.PeakBytes != 2*one.PeakBytes {
+		t.Errorf("peak memory %d, want two entries of %d", long.PeakBytes, one.PeakBytes)
+	}
+}
+
+func TestRunMaxBytes(t *testing.T) {
+	unlimited := Config{Name: "unlimited", TTL: time.Second, TTD: 5 * time.Second, Regen: 50 * time.Millisecond}
+	one := unlimited
+	one.Name, one.MaxBytes = "one entry", Run(only("a", steady()), unlimited)[0].PeakBytes
+	reports := Run(steady(), unlimited, one)
+	if reports[1].PeakBytes > one.MaxBytes {
+		t.Errorf("peak memory %d above MaxBytes %d", reports[1].PeakBytes, one.MaxBytes)
+	}
+	if reports[1].HitRatio >= reports[0].HitRatio {
+		t.Errorf("evicting didn't cost hits: %.3f against %.3f", reports[1].HitRatio, reports[0].HitRatio)
+	}
+}
+
+func TestRunCollapses(t *testing.T) {
+	start := time.Unix(0, 0)
+	trace := Trace{Regen: map[string]time.Duration{"a": time.Second}}
+	for i := 0; i < 10; i++ {
+		trace.Requests = append(trace.Requests, Request{At: start.Add(time.Duration(i) * 10 * time.Millisecond), Key: "a"})
+	}
+	report := Run(trace, Config{TTL: time.Minute})[0]
+	if report.Misses != 1 || report.Collapsed != 9 || report.Upstream != 1 {
+		t.Fatalf("%d misses, %d collapsed, %d upstream, want one fill all others wait for", report.Misses, report.Collapsed, report.Upstream)
+	}
+}
+
+func TestFromEvents(t *testing.T) {
+	start := time.Unix(0, 0)
+	trace := FromEvents([]burstcache.Event{
+		{At: start, Key: "a", Decision: burstcache.OutcomeMiss.String(), Took: time.Second},
+		{At: start.Add(time.Second), Key: "a", Decision: burstcache.OutcomeHit.String()},
+		{At: start.Add(2 * time.Second), Key: "a", Decision: burstcache.DecisionRefresh, Took: 3 * time.Second},
+		{At: start.Add(2 * time.Second), Key: "a", Decision: burstcache.DecisionKill},
+	})
+	if len(trace.Requests) != 2 {
+		t.Fatalf("trace holds %d requests, want the miss and the hit", len(trace.Requests))
+	}
+	if trace.Regen["a"] != 2*time.Second {
+		t.Fatalf("fills of a take %v, want the average of 1s and 3s", trace.Regen["a"])
+	}
+}
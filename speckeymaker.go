@@ -0,0 +1,116 @@
+package burstcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+	SpecKeymaker builds keys from the request attributes a spec declares, for the
+	keying needs that don't warrant a Keyer of their own:
+
+		k, err := NewSpecKeymaker("path", "query:q", "header:X-Tenant", "cookie:variant")
+
+	The attributes are
+		path          the url path
+		host          the host the request is for
+		method        the request method
+		query         the whole query, parameters sorted
+		query:name    the value of a query parameter
+		header:name   the value of a request header
+		cookie:name   the value of a cookie
+	An attribute the request lacks is keyed as empty, so requests without it share an entry.
+	The values are user data (think of a session cookie): RedactQuery hides them.
+*/
+type SpecKeymaker struct {
+	spec []attribute
+}
+
+/*
+	attribute is one part of a key spec
+*/
+type attribute struct {
+	kind string // path, host, method, query, header or cookie
+	name string // the parameter, header or cookie, if the kind takes one
+}
+
+/*
+	Factory function, parses the spec. It fails with ErrInvalidSpec on attributes
+	it doesn't know, and on an empty spec.
+*/
+func NewSpecKeymaker(spec ...string) (*SpecKeymaker, error) {
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("%w: no attributes", ErrInvalidSpec)
+	}
+	k := &SpecKeymaker{}
+	for _, s := range spec {
+		kind, name, named := strings.Cut(strings.TrimSpace(s), ":")
+		kind = strings.ToLower(kind)
+		switch kind {
+		case "path", "host", "method":
+			if named {
+				return nil, fmt.Errorf("%w: %s takes no name", ErrInvalidSpec, s)
+			}
+		case "query":
+		case "header", "cookie":
+			if !named || name == "" {
+				return nil, fmt.Errorf("%w: %s needs a name, as in %s:name", ErrInvalidSpec, s, kind)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown attribute %s", ErrInvalidSpec, s)
+		}
+		if kind == "header" {
+			name = http.CanonicalHeaderKey(name)
+		}
+		k.spec = append(k.spec, attribute{kind: kind, name: name})
+	}
+	return k, nil
+}
+
+func (k *SpecKeymaker) Key(w http.ResponseWriter, r *http.Request) string {
+
+	parts := make([]string, len(k.spec))
+	for i, a := range k.spec {
+		value := a.value(r)
+		if a.kind == "path" {
+			// as the vanilla Keymaker has it, so the usual patterns keep matching
+			parts[i] = value
+			continue
+		}
+		label := a.kind
+		if a.name != "" {
+			label += ":" + a.name
+		}
+		parts[i] = label + "=" + url.QueryEscape(value)
+	}
+
+	return strings.Join(parts, "|")
+}
+
+/*
+	value returns the attribute of r
+*/
+func (a attribute) value(r *http.Request) string {
+	switch a.kind {
+	case "path":
+		return r.URL.Path
+	case "host":
+		return strings.ToLower(r.Host)
+	case "method":
+		return r.Method
+	case "query":
+		if a.name == "" {
+			return r.URL.Query().Encode()
+		}
+		return r.URL.Query().Get(a.name)
+	case "header":
+		return r.Header.Get(a.name)
+	case "cookie":
+		if c, err := r.Cookie(a.name); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package burstcache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func specRequest(url, tenant, variant string) *http.Request {
+	r := httptest.NewRequest("GET", url, nil)
+	if tenant != "" {
+		r.Header.Set("X-Tenant", tenant)
+	}
+	if variant != "" {
+		r.AddCookie(&http.Cookie{Name: "variant", Value: variant})
+	}
+	return r
+}
+
+func TestSpecKeymakerDimensions(t *testing.T) {
+	k, err := NewSpecKeymaker("path", "query:q", "header:x-tenant", "cookie:variant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := k.Key(nil, specRequest("/s?q=a&x=1", "t1", "b"))
+	if base != "/s|query:q=a|header:X-Tenant=t1|cookie:variant=b" {
+		t.Fatalf("key is %q", base)
+	}
+	if key := k.Key(nil, specRequest("/s?q=a&x=2", "t1", "b")); key != base {
+		t.Fatalf("a parameter the spec doesn't list changed the key to %q", key)
+	}
+	for name, r := range map[string]*http.Request{
+		"path":      specRequest("/t?q=a", "t1", "b"),
+		"query":     specRequest("/s?q=b", "t1", "b"),
+		"header":    specRequest("/s?q=a", "t2", "b"),
+		"cookie":    specRequest("/s?q=a", "t1", "c"),
+		"no header": specRequest("/s?q=a", "", "b"),
+	} {
+		if k.Key(nil, r) == base {
+			t.Errorf("changing the %s leaves the key as is", name)
+		}
+	}
+}
+
+func TestSpecKeymakerInvalid(t *testing.T) {
+	for _, spec := range [][]string{{}, {"body"}, {"header"}, {"cookie:"}, {"path:x"}} {
+		if _, err := NewSpecKeymaker(spec...); !errors.Is(err, ErrInvalidSpec) {
+			t.Errorf("spec %q: err is %v, want ErrInvalidSpec", spec, err)
+		}
+	}
+}
+
+func TestSpecKeymakerRedacted(t *testing.T) {
+	k, err := NewSpecKeymaker("header:Authorization", "path", "cookie:session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/me", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abcdef"})
+	shown := RedactQuery(k.Key(nil, r))
+	if strings.Contains(shown, "s3cret") || strings.Contains(shown, "abcdef") {
+		t.Fatalf("redacted key %q shows the values", shown)
+	}
+	if !strings.Contains(shown, "header:Authorization=#") || !strings.Contains(shown, "|/me|") {
+		t.Fatalf("redacted key %q lost its shape", shown)
+	}
+}
@@ -0,0 +1,96 @@
+package burstcache
+
+import (
+	"sync/atomic"
+)
+
+/*
+	Stats holds counters describing how the cache has been serving.
+	A stale response is "served" as soon as it is written, but only "delivered"
+	when the write succeeded and the client was still connected afterwards.
+*/
+type Stats struct {
+	StaleServed       int64 // stale responses written to clients
+	StaleDelivered    int64 // stale responses that actually reached the client
+	Recursions        int64 // requests for a key made while filling that key, passed through
+	Evictions         int64 // entries evicted to stay within MaxBytes
+	IdleEvictions     int64 // entries evicted for not being served within IdleTimeout
+	PressureEvictions int64 // entries evicted to relieve memory pressure, see WatchMemory
+	LateWrites        int64 // writes by handlers after they returned, dropped
+	Hedges            int64 // hedged cold fills started, see HedgeAfter
+	HedgeWins         int64 // hedged cold fills that finished first
+	Throttled         int64 // regenerations RegenRate didn't allow (refreshes postponed, cold fills shed, hedges not sent)
+
+	Entries int   // number of cached responses
+	Bytes   int64 // estimated memory held by the cached responses
+	Tags    int   // number of distinct tags on the cached responses, see TagsHeader
+	Routes  int   // number of routes with cached responses, see InvalidateRoute
+
+	Regenerations map[Origin]int64 // responses stored (those of warmers in the shared tier only), by what created them
+	Removals      map[Cause]int64  // responses that left the cache, by why
+	Details       map[Detail]int64 // cached responses served other than as filled here, by how, see DetailHeader
+
+	TTFB map[Outcome]Histogram // time to first byte per outcome, with MeasureTTFB
+}
+
+/*
+	Stats returns a snapshot of the cache counters
+*/
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	entries, bytes, tags, routes := len(c.caches), c.bytes, len(c.tagged), len(c.routed)
+	c.mu.RUnlock()
+
+	regenerations := map[Origin]int64{}
+	for origin := range c.origins {
+		regenerations[Origin(origin)] = atomic.LoadInt64(&c.origins[origin])
+	}
+	removals := map[Cause]int64{}
+	for cause := range c.removals {
+		removals[Cause(cause)] = atomic.LoadInt64(&c.removals[cause])
+	}
+
+	details := map[Detail]int64{}
+	for detail := range c.details {
+		details[Detail(detail)] = atomic.LoadInt64(&c.details[detail])
+	}
+
+	var ttfb map[Outcome]Histogram
+	if c.MeasureTTFB {
+		ttfb = map[Outcome]Histogram{}
+		for outcome := range c.ttfb {
+			ttfb[Outcome(outcome)] = c.ttfb[outcome].snapshot()
+		}
+	}
+
+	return Stats{
+		StaleServed:       atomic.LoadInt64(&c.stats.StaleServed),
+		StaleDelivered:    atomic.LoadInt64(&c.stats.StaleDelivered),
+		Recursions:        atomic.LoadInt64(&c.stats.Recursions),
+		Evictions:         atomic.LoadInt64(&c.stats.Evictions),
+		IdleEvictions:     atomic.LoadInt64(&c.stats.IdleEvictions),
+		PressureEvictions: atomic.LoadInt64(&c.stats.PressureEvictions),
+		LateWrites:        atomic.LoadInt64(&c.stats.LateWrites),
+		Hedges:            atomic.LoadInt64(&c.stats.Hedges),
+		HedgeWins:         atomic.LoadInt64(&c.stats.HedgeWins),
+		Throttled:         atomic.LoadInt64(&c.stats.Throttled),
+		Entries:           entries,
+		Bytes:             bytes,
+		Tags:              tags,
+		Routes:            routes,
+		Regenerations:     regenerations,
+		Removals:          removals,
+		Details:           details,
+		TTFB:              ttfb,
+	}
+}
+
+/*
+	Count a stale serve, delivered tells whether it reached the client
+*/
+func (s *Stats) countStale(delivered bool) {
+	atomic.AddInt64(&s.StaleServed, 1)
+	if delivered {
+		atomic.AddInt64(&s.StaleDelivered, 1)
+	}
+}
@@ -0,0 +1,127 @@
+package burstcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	brokenWriter is the ResponseWriter of a client that went away, its writes fail
+*/
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write(buf []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestStaleDelivered(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	// the refresh the first stale request starts is held back, so all three are served stale
+	release := make(chan struct{})
+	var calls int32
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			<-release
+		}
+		fmt.Fprint(w, "stale")
+	}))
+	get(h, "/x")
+	waitStale(t, c, "/x")
+
+	// delivered
+	get(h, "/x")
+	// written to a client that went away
+	h.ServeHTTP(brokenWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/x", nil))
+	// written, but the client was gone by then
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil).WithContext(ctx))
+	close(release)
+	waitIdle(t, c)
+
+	// fresh ones don't count
+	c.Store("/fresh", filled("fresh"))
+	c.ServeCached("/fresh", brokenWriter{httptest.NewRecorder()})
+
+	stats := c.Stats()
+	if stats.StaleServed != 3 || stats.StaleDelivered != 1 {
+		t.Fatalf("%d stale served, %d delivered; want 3 and 1", stats.StaleServed, stats.StaleDelivered)
+	}
+}
+
+func TestStaleDeliveredServeCached(t *testing.T) {
+	c := NewCache(nil, nil, time.Millisecond, time.Hour)
+	c.Store("k", filled("stale"))
+	waitStale(t, c, "k")
+	c.ServeCached("k", httptest.NewRecorder())
+	c.ServeCached("k", brokenWriter{httptest.NewRecorder()})
+	if stats := c.Stats(); stats.StaleServed != 2 || stats.StaleDelivered != 1 {
+		t.Fatalf("%d stale served, %d delivered; want 2 and 1", stats.StaleServed, stats.StaleDelivered)
+	}
+}
+
+func TestRemovalCauses(t *testing.T) {
+	removed := func(c *Cache, cause Cause, want int64) {
+		t.Helper()
+		// kills and idle sweeps run in the background
+		for deadline := time.Now().Add(time.Second); c.Stats().Removals[cause] != want && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		if got := c.Stats().Removals[cause]; got != want {
+			t.Fatalf("%d removals %s, want %d", got, cause, want)
+		}
+	}
+
+	c := NewCache(&Keymaker{}, nil, 10*time.Millisecond, 10*time.Millisecond)
+	c.Store("/die", filled("x"))
+	removed(c, CauseDied, 1)
+
+	c = NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Store("/gone", filled("x"))
+	c.Invalidate("/gone")
+	removed(c, CauseInvalidated, 1)
+
+	c = NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.IdleTimeout = 20 * time.Millisecond
+	c.Store("/idle", filled("x"))
+	removed(c, CauseIdle, 1)
+
+	c = NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Store("/a", filled("x"))
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.MaxBytes = c.Stats().Bytes * 3 })
+	for i := 0; i < 5; i++ {
+		c.Store(fmt.Sprint("/e", i), filled("x"))
+	}
+	if n := c.Stats().Evictions; n < 3 {
+		t.Fatalf("%d evictions, want at least 3", n)
+	}
+	removed(c, CauseEvicted, c.Stats().Evictions)
+	removed(c, CauseInvalidated, 0)
+
+	// refreshed into a response that can't be cached
+	c = NewCache(&Keymaker{}, nil, 5*time.Millisecond, time.Hour)
+	var calls int
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls > 1 {
+			w.Header().Set("Vary", "*")
+		}
+		w.Write([]byte("x"))
+	}))
+	get(h, "/u")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if meta, _ := c.Peek("/u"); !meta.Fresh {
+			break
+		}
+	}
+	get(h, "/u")
+	waitIdle(t, c)
+	removed(c, CauseUncacheable, 1)
+}
@@ -0,0 +1,263 @@
+package burstcache
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	fetch looks up key in the shared tier. Errors are logged and count as a miss,
+	as do entries that were stored so long ago they would be dead by now.
+*/
+func (c *Cache) fetch(key string) *ResponseCacher {
+	if c.Shared == nil {
+		return nil
+	}
+	data, ok, err := c.Shared.Get(key)
+	c.countStore(err)
+	if err != nil {
+		log.Printf("burstcache: shared store get of %s failed, treating it as a miss: %v", c.redact(key), err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	cache, err := decode(data)
+	if err != nil {
+		log.Printf("burstcache: shared store returned an entry for %s that doesn't decode, treating it as a miss: %v", c.redact(key), err)
+		return nil
+	}
+	c.mu.RLock()
+	dies := cache.stored.Add(c.ttlFor(cache) + c.ttd(key))
+	c.mu.RUnlock()
+	if !cache.stored.IsZero() && !dies.After(c.now()) {
+		// it would be killed on arrival, better get a fresh one
+		return nil
+	}
+	c.adopt(cache, OriginRestore)
+	return cache
+}
+
+/*
+	publish a cache that is about to be stored locally to the shared tier as well.
+	The write happens in the background, errors are logged.
+*/
+func (c *Cache) publish(key string, cache *ResponseCacher) {
+	if c.Shared == nil || cache.origin == OriginRestore {
+		return
+	}
+	data, err := encode(cache)
+	if err != nil {
+		log.Printf("burstcache: can't encode response for %s for the shared store: %v", c.redact(key), err)
+		return
+	}
+	c.mu.RLock()
+	ttl := c.ttlFor(cache) + c.ttd(key)
+	c.mu.RUnlock()
+	set := func() {
+		err := c.Shared.Set(key, data, ttl)
+		c.countStore(err)
+		if err != nil {
+			log.Printf("burstcache: shared store set of %s failed: %v", c.redact(key), err)
+		}
+	}
+	if cache.share {
+		// Warm holds the lock of key until it is shared, see warmKey
+		set()
+		return
+	}
+	c.background(set)
+}
+
+/*
+	warm fills key from the handler for the shared tier only, see WithSharedOnly
+*/
+func (c *Cache) warm(cfg *CacheConfig, next http.Handler, key string, w http.ResponseWriter, r *http.Request) {
+	if c.Shared == nil || c.Draining() {
+		c.passThrough(next, w, r)
+		return
+	}
+	cache := c.fill(cfg, next, key, r, OriginWarm, w)
+	if cache.oversize {
+		// it went straight to the client, it can't be stored anywhere
+		return
+	}
+	if c.cacheable(cache) {
+		cache.key = key
+		cache.stored = c.now()
+		cache.recordRetryAfter(cache.stored)
+		c.publish(key, cache)
+		atomic.AddInt64(&c.origins[OriginWarm], 1)
+	}
+	cache.Serve(w, false)
+}
+
+/*
+	unpublish removes key from the shared tier. Errors are logged, and returned as ErrStoreUnavailable.
+*/
+func (c *Cache) unpublish(key string) error {
+	if c.Shared == nil {
+		return nil
+	}
+	err := c.Shared.Delete(key)
+	c.countStore(err)
+	if err != nil {
+		log.Printf("burstcache: shared store delete of %s failed: %v", c.redact(key), err)
+		return fmt.Errorf("%w: delete of %s: %v", ErrStoreUnavailable, c.redact(key), err)
+	}
+	return nil
+}
+
+/*
+	unpublishAll removes the keys from the shared tier, in batches of at most MaxBatch
+	keys when it is a BatchStorer. Returns the first failure, as ErrStoreUnavailable.
+*/
+func (c *Cache) unpublishAll(keys []string) error {
+	if c.Shared == nil {
+		return nil
+	}
+	batcher, ok := c.Shared.(BatchStorer)
+	if !ok || len(keys) == 1 {
+		return c.unpublishEach(keys)
+	}
+	size := c.MaxBatch
+	if size <= 0 {
+		size = defaultMaxBatch
+	}
+	var failed error
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > size {
+			batch = keys[:size]
+		}
+		keys = keys[len(batch):]
+		err := batcher.DeleteBatch(batch)
+		c.countStore(err)
+		if err != nil {
+			log.Printf("burstcache: shared store batch delete of %d keys failed, deleting them one by one: %v", len(batch), err)
+			if err := c.unpublishEach(batch); err != nil && failed == nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+/*
+	defaultMaxBatch is the MaxBatch used when it isn't set
+*/
+const defaultMaxBatch = 100
+
+/*
+	unpublishEach removes the keys from the shared tier one by one, returning the first failure
+*/
+func (c *Cache) unpublishEach(keys []string) error {
+	var failed error
+	for _, key := range keys {
+		if err := c.unpublish(key); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+/*
+	MemoryStore is an in-process Storer and Locker. It lets several caches in one
+	process share their responses, and serves as a reference for real shared stores.
+*/
+type MemoryStore struct {
+	mu    sync.Mutex
+	items map[string]memoryItem
+	locks map[string]memoryLock
+}
+
+type memoryItem struct {
+	data    []byte
+	expires time.Time
+}
+
+/*
+	memoryLock is the lock of a key, kept once released for its generation
+*/
+type memoryLock struct {
+	generation int64
+	expires    time.Time // zero once released
+}
+
+/*
+	Factory function
+*/
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: map[string]memoryItem{},
+		locks: map[string]memoryLock{},
+	}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(item.expires) {
+		delete(s.items, key)
+		return nil, false, nil
+	}
+	return append([]byte(nil), item.data...), true, nil
+}
+
+func (s *MemoryStore) Set(key string, data []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[key] = memoryItem{
+		data:    append([]byte(nil), data...),
+		expires: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+	return nil
+}
+
+func (s *MemoryStore) DeleteBatch(keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.items, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) TryLock(key string, ttl time.Duration) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	lock := s.locks[key]
+	if now.Before(lock.expires) {
+		return 0, false, nil
+	}
+	lock.generation++
+	lock.expires = now.Add(ttl)
+	s.locks[key] = lock
+	return lock.generation, true, nil
+}
+
+func (s *MemoryStore) Unlock(key string, generation int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lock, ok := s.locks[key]; ok && lock.generation == generation {
+		lock.expires = time.Time{}
+		s.locks[key] = lock
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package burstcache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+fakeStore is a shared tier that counts what is asked of it
+*/
+type fakeStore struct {
+	*MemoryStore
+	mu   sync.Mutex
+	gets int
+	sets int
+	ttls map[string]time.Duration
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{MemoryStore: NewMemoryStore(), ttls: map[string]time.Duration{}}
+}
+
+func (s *fakeStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	s.gets++
+	s.mu.Unlock()
+	return s.MemoryStore.Get(key)
+}
+
+func (s *fakeStore) Set(key string, data []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	s.sets++
+	s.ttls[key] = ttl
+	s.mu.Unlock()
+	return s.MemoryStore.Set(key, data, ttl)
+}
+
+func TestSharedTierReadThrough(t *testing.T) {
+	shared := newFakeStore()
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte("body"))
+	})
+	instance := func() (*Cache, http.Handler) {
+		c := NewCache(&Keymaker{}, nil, time.Minute, time.Minute)
+		c.Shared = shared
+		return c, c.Chain(handler)
+	}
+
+	// a miss everywhere fills both tiers
+	one, h1 := instance()
+	h1.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	waitIdle(t, one)
+	if calls != 1 || shared.sets != 1 {
+		t.Fatalf("after the first fill: %d upstream calls, %d shared sets", calls, shared.sets)
+	}
+
+	// a local miss is a shared hit, and populates the local tier
+	two, h2 := instance()
+	rec := httptest.NewRecorder()
+	h2.ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+	if calls != 1 || rec.Body.String() != "body" {
+		t.Fatalf("local miss, shared hit: %d upstream calls, served %q", calls, rec.Body.String())
+	}
+	if meta, ok := two.Peek("/x"); !ok || meta.Origin != OriginRestore {
+		t.Fatalf("the shared hit didn't populate the local tier: %+v", meta)
+	}
+	gets := shared.gets
+	h2.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	if shared.gets != gets {
+		t.Fatal("a local hit went to the shared tier")
+	}
+	waitIdle(t, two)
+	if shared.sets != 1 {
+		t.Fatalf("the shared hit was written back, %d sets", shared.sets)
+	}
+}
+
+func TestSharedTierOutlivesLocal(t *testing.T) {
+	shared := newFakeStore()
+	c := NewCache(nil, nil, time.Second, 100*time.Millisecond)
+	c.Shared = shared
+	c.StrictTuning = true
+	for i := 0; i < tuneMinSamples; i++ {
+		c.tune("/x", 2*time.Second)
+	}
+	c.Store("/x", filled("x"))
+	waitIdle(t, c)
+
+	c.mu.RLock()
+	ttd := c.ttd("/x")
+	c.mu.RUnlock()
+	if ttd <= c.TTD {
+		t.Fatalf("StrictTuning didn't extend TTD: %v", ttd)
+	}
+	if got, want := shared.ttls["/x"], time.Second+ttd; got != want {
+		t.Fatalf("shared entry expires after %v, the local one after %v", got, want)
+	}
+}
+
+func TestSharedOnly(t *testing.T) {
+	shared := newFakeStore()
+	c := NewCache(&Keymaker{}, nil, time.Minute, time.Minute)
+	c.Shared = shared
+	h := &counting{body: "body"}
+	served := c.Chain(h)
+
+	warm := httptest.NewRequest("GET", "/x", nil)
+	rec := httptest.NewRecorder()
+	served.ServeHTTP(rec, warm.WithContext(WithSharedOnly(warm.Context())))
+	waitIdle(t, c)
+	if rec.Body.String() != "body" {
+		t.Fatalf("the warmer got %q", rec.Body.String())
+	}
+	if _, ok := c.Peek("/x"); ok {
+		t.Fatal("the warmer populated the local tier")
+	}
+	if _, ok, _ := shared.Get("/x"); !ok {
+		t.Fatal("the warmer didn't populate the shared tier")
+	}
+
+	// a client of the same instance is served from the shared tier
+	if rec := get(served, "/x"); rec.Body.String() != "body" || h.count() != 1 {
+		t.Fatalf("%d upstream calls, served %q", h.count(), rec.Body.String())
+	}
+	if meta, ok := c.Peek("/x"); !ok || meta.Origin != OriginRestore {
+		t.Fatalf("a client didn't restore what the warmer stored: %+v", meta)
+	}
+}
+
+/*
+batchStore is a BatchStorer that counts its deletes, and fails its batches when told to
+*/
+type batchStore struct {
+	*MemoryStore
+	mu      sync.Mutex
+	deletes int
+	batches int
+	fail    bool
+}
+
+func (s *batchStore) Delete(key string) error {
+	s.mu.Lock()
+	s.deletes++
+	s.mu.Unlock()
+	return s.MemoryStore.Delete(key)
+}
+
+func (s *batchStore) DeleteBatch(keys []string) error {
+	s.mu.Lock()
+	s.batches++
+	fail := s.fail
+	s.mu.Unlock()
+	if fail {
+		return errors.New("pipeline broke")
+	}
+	return s.MemoryStore.DeleteBatch(keys)
+}
+
+func TestBatchedUnpublish(t *testing.T) {
+	shared := &batchStore{MemoryStore: NewMemoryStore()}
+	c := NewCache(nil, nil, time.Minute, time.Minute)
+	c.MaxBatch = 10
+	for i := 0; i < 25; i++ {
+		c.Store(fmt.Sprint("/", i), tagged("t"))
+	}
+	c.Shared = shared
+	if n := c.InvalidateTag("t"); n != 25 || shared.batches != 3 || shared.deletes != 0 {
+		t.Fatalf("invalidated %d in %d batches and %d deletes, want 25 in 3 and 0", n, shared.batches, shared.deletes)
+	}
+
+	// a failed batch is retried key by key
+	shared.fail = true
+	c.Store("/a", filled("x"))
+	c.Store("/b", filled("x"))
+	if n, err := c.RemoveMatching("/*"); n != 2 || err != nil || shared.deletes != 2 {
+		t.Fatalf("removed %d (%v) with %d deletes after the batch failed, want 2 and 2", n, err, shared.deletes)
+	}
+}
@@ -0,0 +1,96 @@
+package burstcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	diskStore keeps bodies gzip compressed at rest, and streams them inflated,
+	so it doesn't know how long they are until they are served
+*/
+type diskStore struct {
+	bodies map[string][]byte
+	opened int
+}
+
+func (s *diskStore) put(key, body string) {
+	packed := new(bytes.Buffer)
+	zw := gzip.NewWriter(packed)
+	io.WriteString(zw, body)
+	zw.Close()
+	s.bodies[key] = packed.Bytes()
+}
+
+func (s *diskStore) response(key string, length int) *ResponseCacher {
+	rc := NewResponseCacher(0)
+	rc.Header().Set("Content-Type", "text/plain")
+	rc.WriteHeader(http.StatusOK)
+	rc.StreamBody(func() (io.ReadCloser, error) {
+		s.opened++
+		return gzip.NewReader(bytes.NewReader(s.bodies[key]))
+	}, length)
+	return rc
+}
+
+func TestStreamedBodyOfUnknownLength(t *testing.T) {
+	body := strings.Repeat("streamed from a store that doesn't know the length\n", 200)
+	store := &diskStore{bodies: map[string][]byte{}}
+	store.put("/x", body)
+	store.put("/y", body)
+
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Compress = true
+	for key, n := range map[string]int{"/x": -1, "/y": len(body)} {
+		if err := c.Store(key, store.response(key, n)); err != nil {
+			t.Fatalf("a streamed response isn't cacheable: %v", err)
+		}
+	}
+	srv := httptest.NewServer(c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s wasn't served from cache", r.URL.Path)
+	})))
+	defer srv.Close()
+	get := func(path string) *http.Response {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(got) != body {
+			t.Fatalf("%s served %d bytes, want the %d stored", path, len(got), len(body))
+		}
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := get("/x")
+		if resp.ContentLength != -1 || len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+			t.Fatalf("unknown length served with Content-Length %d, Transfer-Encoding %v; want it chunked",
+				resp.ContentLength, resp.TransferEncoding)
+		}
+	}
+	if store.opened != 2 {
+		t.Fatalf("body opened %d times for 2 serves", store.opened)
+	}
+	if meta, _ := c.Peek("/x"); meta.Size != -1 {
+		t.Fatalf("size %d, want -1 for unknown", meta.Size)
+	}
+
+	resp := get("/y")
+	if resp.ContentLength != int64(len(body)) {
+		t.Fatalf("known length served with Content-Length %d, want %d", resp.ContentLength, len(body))
+	}
+
+	// a copy holds the body itself
+	clone := c.caches["/x"].Clone()
+	if clone.stream != nil || clone.Body.String() != body || clone.contentLength() != len(body) {
+		t.Fatalf("clone holds %d bytes, length %d", clone.Body.Len(), clone.contentLength())
+	}
+}
@@ -0,0 +1,127 @@
+package burstcache
+
+import (
+	"container/list"
+)
+
+/*
+	With a SubjectFunc every subject (typically a user) gets caches of its own.
+	To keep a single subject from filling the cache, each subject may hold at most
+	SubjectMax caches. Beyond that its least recently used stale cache is evicted,
+	or its least recently used cache when all are fresh. Other
+	subjects are never affected. subjects keeps the usage order per subject and
+	is guarded by the cache lock.
+*/
+type subjects struct {
+	lists map[string]*list.List    // subject -> its keys, most recently used in front
+	elems map[string]*list.Element // key -> its element in the list of its subject
+}
+
+type subjectKey struct {
+	subject string
+	key     string
+}
+
+/*
+	use marks key as the most recently used cache of subject
+*/
+func (s *subjects) use(subject string, key string) {
+	if s.lists == nil {
+		s.lists = map[string]*list.List{}
+		s.elems = map[string]*list.Element{}
+	}
+	if e, ok := s.elems[key]; ok {
+		s.lists[subject].MoveToFront(e)
+		return
+	}
+	l, ok := s.lists[subject]
+	if !ok {
+		l = list.New()
+		s.lists[subject] = l
+	}
+	s.elems[key] = l.PushFront(subjectKey{subject, key})
+}
+
+/*
+	drop forgets about key
+*/
+func (s *subjects) drop(key string) {
+	e, ok := s.elems[key]
+	if !ok {
+		return
+	}
+	subject := e.Value.(subjectKey).subject
+	l := s.lists[subject]
+	l.Remove(e)
+	if l.Len() == 0 {
+		delete(s.lists, subject)
+	}
+	delete(s.elems, key)
+}
+
+/*
+	count returns the number of keys subject has
+*/
+func (s *subjects) count(subject string) int {
+	if l, ok := s.lists[subject]; ok {
+		return l.Len()
+	}
+	return 0
+}
+
+/*
+	victim returns the key of subject to evict: the least recently used one whose
+	cache is stale, or else the least recently used one. Pinned keys are passed over,
+	ok is false when all are pinned.
+*/
+func (s *subjects) victim(subject string, caches map[string]*ResponseCacher, pinned map[string]bool) (key string, ok bool) {
+	l, found := s.lists[subject]
+	if !found {
+		return "", false
+	}
+	for e := l.Back(); e != nil; e = e.Prev() {
+		k := e.Value.(subjectKey).key
+		if pinned[k] {
+			continue
+		}
+		if cache := caches[k]; cache != nil && !cache.fresh {
+			return k, true
+		}
+		if !ok {
+			key, ok = k, true
+		}
+	}
+	return key, ok
+}
+
+/*
+	touch marks a served cache as most recently used by its subject
+*/
+func (c *Cache) touch(cache *ResponseCacher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caches[cache.key] == cache {
+		c.lru.use(cache.subject, cache.key)
+	}
+}
+
+/*
+	limitSubject registers a newly stored cache with its subject and evicts the subject's
+	stale, then least recently used caches while it holds more than SubjectMax.
+	Pinned caches are never evicted, even when that leaves the subject over its limit.
+	The caller must hold the lock.
+*/
+func (c *Cache) limitSubject(cache *ResponseCacher) {
+	c.lru.use(cache.subject, cache.key)
+	max := c.settings().SubjectMax
+	if max <= 0 {
+		return
+	}
+	for c.lru.count(cache.subject) > max {
+		key, ok := c.lru.victim(cache.subject, c.caches, c.pinned)
+		if !ok {
+			return
+		}
+		c.drop(key, CauseSubject)
+	}
+}
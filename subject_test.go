@@ -0,0 +1,72 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSubjects(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.SubjectFunc = func(r *http.Request) string { return r.Header.Get("X-User") }
+	c.SubjectMax = 2
+	h := &counting{body: "dashboard"}
+	served := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		w.Write([]byte(" of " + r.Header.Get("X-User")))
+	}))
+	as := func(user, path string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		rec := httptest.NewRecorder()
+		served.ServeHTTP(rec, r)
+		return rec.Body.String()
+	}
+	cached := func(user, path string) bool {
+		_, ok := c.Peek(path + "|sub=" + user)
+		return ok
+	}
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if got := as(user, "/dash"); got != "dashboard of "+user {
+			t.Fatalf("%s got %q", user, got)
+		}
+	}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if got := as(user, "/dash"); got != "dashboard of "+user {
+			t.Fatalf("%s got %q from the cache", user, got)
+		}
+	}
+	if h.count() != 3 {
+		t.Fatalf("%d upstream calls for three users polling twice, want one each", h.count())
+	}
+
+	// alice goes over her cap: her least recently used cache goes, nobody else's
+	as("alice", "/a")
+	as("alice", "/dash")
+	as("alice", "/b")
+	if cached("alice", "/a") || !cached("alice", "/dash") || !cached("alice", "/b") {
+		t.Fatal("alice's least recently used cache wasn't the one evicted")
+	}
+	if !cached("bob", "/dash") || !cached("carol", "/dash") {
+		t.Fatal("alice's caches evicted those of other users")
+	}
+	if got := c.Stats().Entries; got != 4 {
+		t.Fatalf("%d entries, want 2 of alice, 1 of bob and 1 of carol", got)
+	}
+
+	// anonymous requests share their caches, unless they bypass it
+	as("", "/public")
+	as("", "/public")
+	if h.count() != 6 {
+		t.Fatalf("%d upstream calls, want anonymous requests to share a cache", h.count())
+	}
+	reconfigure(t, c, func(cfg *CacheConfig) { cfg.BypassAnonymous = true })
+	as("", "/public")
+	if h.count() != 7 {
+		t.Fatalf("%d upstream calls, want anonymous requests passed through", h.count())
+	}
+}
@@ -0,0 +1,115 @@
+package burstcache
+
+import (
+	"strings"
+)
+
+/*
+	A handler can tag its response by listing tags in the X-BurstCache-Tags
+	header (comma separated), and InvalidateTag then removes every entry carrying
+	a tag, e.g. all pages showing an order. Tags are trimmed, case folded and
+	deduplicated when captured ("Orders, orders" is one tag), and an entry keeps
+	at most MaxTagsPerEntry of them, each at most MaxTagLength long. The header
+	itself is not replayed to clients.
+
+	An index from tag to keys is kept up to date as entries come and go, so
+	invalidation doesn't scan the cache. Watch Stats.Tags: a tag per user or per
+	id easily grows into millions.
+*/
+
+const (
+	TagsHeader      = "X-BurstCache-Tags" // response header listing the tags of a response
+	MaxTagsPerEntry = 32                  // further tags of an entry are ignored
+	MaxTagLength    = 128                 // longer tags are cut off
+)
+
+/*
+	normalizeTag returns the canonical form of tag, "" if it is no tag at all
+*/
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if len(tag) > MaxTagLength {
+		tag = tag[:MaxTagLength]
+	}
+	return tag
+}
+
+/*
+	captureTags moves the tags in the tags header of a filled cache to its tags
+*/
+func (c *ResponseCacher) captureTags() {
+	vals := c.Head.Values(TagsHeader)
+	if len(vals) == 0 {
+		return
+	}
+	c.Head.Del(TagsHeader)
+
+	seen := make(map[string]bool, len(c.tags))
+	for _, tag := range c.tags {
+		seen[tag] = true
+	}
+	for _, val := range vals {
+		for _, tag := range strings.Split(val, ",") {
+			tag = normalizeTag(tag)
+			if tag == "" || seen[tag] {
+				continue
+			}
+			if len(c.tags) == MaxTagsPerEntry {
+				return
+			}
+			seen[tag] = true
+			c.tags = append(c.tags, tag)
+		}
+	}
+}
+
+/*
+	index the tags (and the route, see InvalidateRoute) of a cache being swapped in.
+	The caller must hold the lock.
+*/
+func (c *Cache) index(cache *ResponseCacher) {
+	c.indexRoute(cache)
+	for _, tag := range cache.tags {
+		keys := c.tagged[tag]
+		if keys == nil {
+			if c.tagged == nil {
+				c.tagged = map[string]map[string]struct{}{}
+			}
+			keys = map[string]struct{}{}
+			c.tagged[tag] = keys
+		}
+		keys[cache.key] = struct{}{}
+	}
+}
+
+/*
+	unindex the tags (and the route) of a cache being removed. The caller must hold the lock.
+*/
+func (c *Cache) unindex(cache *ResponseCacher) {
+	c.unindexRoute(cache)
+	for _, tag := range cache.tags {
+		keys := c.tagged[tag]
+		delete(keys, cache.key)
+		if len(keys) == 0 {
+			delete(c.tagged, tag)
+		}
+	}
+}
+
+/*
+	InvalidateTag removes every response tagged with tag (see TagsHeader), from the
+	shared tier too. Returns the number of responses removed locally.
+*/
+func (c *Cache) InvalidateTag(tag string) int {
+	tag = normalizeTag(tag)
+
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.tagged[tag]))
+	for key := range c.tagged[tag] {
+		keys = append(keys, key)
+	}
+	c.mu.RUnlock()
+
+	n, _ := c.invalidateAll(keys)
+	return n
+}
@@ -0,0 +1,96 @@
+package burstcache
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	tagged is a filled response carrying tags
+*/
+func tagged(tags ...string) *ResponseCacher {
+	rc := NewResponseCacher(0)
+	for _, tag := range tags {
+		rc.Header().Add(TagsHeader, tag)
+	}
+	rc.Write([]byte("body"))
+	return rc
+}
+
+func TestCaptureTags(t *testing.T) {
+	rc := tagged("Orders, orders ,user:1", "ORDERS,, "+strings.Repeat("x", 200))
+	rc.captureTags()
+	if want := []string{"orders", "user:1", strings.Repeat("x", MaxTagLength)}; !reflect.DeepEqual(rc.tags, want) {
+		t.Fatalf("captured %q, want %q", rc.tags, want)
+	}
+	if rc.Head.Get(TagsHeader) != "" {
+		t.Fatal("the tags header is kept for replay")
+	}
+
+	many := make([]string, 2*MaxTagsPerEntry)
+	for i := range many {
+		many[i] = fmt.Sprint("tag", i)
+	}
+	rc = tagged(strings.Join(many, ","))
+	rc.captureTags()
+	if len(rc.tags) != MaxTagsPerEntry || rc.tags[0] != "tag0" {
+		t.Fatalf("captured %d tags, want the first %d", len(rc.tags), MaxTagsPerEntry)
+	}
+}
+
+func TestTagIndex(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	indexed := func(tag string) []string {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		var keys []string
+		for key := range c.tagged[tag] {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	c.Store("/a", tagged("Orders, user:1"))
+	c.Store("/b", tagged("orders"))
+	c.Store("/c", tagged("other"))
+	if n := c.Stats().Tags; n != 3 {
+		t.Fatalf("%d tags, want orders, user:1 and other", n)
+	}
+
+	// a swap drops the tags of the old response from the index
+	c.Store("/a", tagged("user:1"))
+	if keys := indexed("orders"); !reflect.DeepEqual(keys, []string{"/b"}) {
+		t.Fatalf("orders indexes %v after /a was swapped", keys)
+	}
+	// killed and evicted entries leave it
+	c.Invalidate("/c")
+	if n := c.Stats().Tags; n != 2 || indexed("other") != nil {
+		t.Fatalf("%d tags once /c is gone", n)
+	}
+	c.MaxBytes = c.Stats().Bytes
+	c.Store("/d", tagged("new"))
+	c.mu.RLock()
+	for tag, keys := range c.tagged {
+		for key := range keys {
+			if c.caches[key] == nil {
+				t.Errorf("tag %s indexes %s, which was evicted", tag, key)
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	c.MaxBytes = 0
+	c.Store("/e", tagged("Orders"))
+	c.Store("/f", tagged("ORDERS, user:2"))
+	want := len(indexed("orders"))
+	if n := c.InvalidateTag(" Orders "); n != want || n < 2 || indexed("orders") != nil {
+		t.Fatalf("invalidated %d of the %d entries tagged orders", n, want)
+	}
+	for _, key := range []string{"/e", "/f"} {
+		if _, ok := c.Peek(key); ok {
+			t.Fatalf("%s survived invalidating its tag", key)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package burstcache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	With MeasureTTFB set, Chain measures the time to first byte its clients see:
+	from the moment a request enters Chain until the status line goes out.
+	The durations are kept in a histogram per Outcome, see Stats.TTFB.
+	Requests passed through uncached are not measured. Without MeasureTTFB
+	nothing is measured, and nothing is allocated for it.
+*/
+
+/*
+	Outcome tells how Chain answered a request
+*/
+type Outcome int
+
+const (
+	OutcomeHit       Outcome = iota // served fresh from the cache
+	OutcomeStale                    // served stale from the cache
+	OutcomeCollapsed                // missed, and waited for the fill of another request
+	OutcomeMiss                     // missed, and filled the cache
+	numOutcomes
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeHit:
+		return "hit"
+	case OutcomeStale:
+		return "stale"
+	case OutcomeCollapsed:
+		return "collapsed"
+	case OutcomeMiss:
+		return "miss"
+	}
+	return "unknown"
+}
+
+/*
+	TTFBBuckets are the upper bounds of the histogram buckets, doubling from
+	a quarter of a millisecond up to about 16 seconds. Slower first bytes are
+	only counted in Count and Sum.
+*/
+var TTFBBuckets = func() []time.Duration {
+	bounds := make([]time.Duration, numBuckets)
+	for i := range bounds {
+		bounds[i] = 250 * time.Microsecond << i
+	}
+	return bounds
+}()
+
+const numBuckets = 17
+
+/*
+	Histogram is a snapshot of a latency histogram, in the usual cumulative
+	form: Counts[i] is the number of durations up to TTFBBuckets[i].
+*/
+type Histogram struct {
+	Counts []int64       // cumulative counts per bucket of TTFBBuckets
+	Count  int64         // number of durations observed
+	Sum    time.Duration // sum of the durations observed
+}
+
+/*
+	histogram collects durations, updated atomically
+*/
+type histogram struct {
+	counts [numBuckets]int64 // per bucket, not cumulative
+	count  int64
+	sum    int64
+}
+
+/*
+	observe records a duration
+*/
+func (h *histogram) observe(d time.Duration) {
+	for i, bound := range TTFBBuckets {
+		if d <= bound {
+			atomic.AddInt64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+/*
+	snapshot returns the histogram in its exported form
+*/
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Counts: make([]int64, numBuckets)}
+	total := int64(0)
+	for i := range h.counts {
+		total += atomic.LoadInt64(&h.counts[i])
+		s.Counts[i] = total
+	}
+	s.Count = atomic.LoadInt64(&h.count)
+	s.Sum = time.Duration(atomic.LoadInt64(&h.sum))
+	return s
+}
+
+/*
+	ttfbWriter notes when the first byte goes out to the client
+*/
+type ttfbWriter struct {
+	http.ResponseWriter
+	start time.Time
+	first time.Time
+}
+
+func (w *ttfbWriter) mark() {
+	if w.first.IsZero() {
+		w.first = time.Now()
+	}
+}
+
+func (w *ttfbWriter) WriteHeader(code int) {
+	w.mark()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ttfbWriter) Write(buf []byte) (int, error) {
+	w.mark()
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *ttfbWriter) Flush() {
+	w.mark()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *ttfbWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+/*
+	measure wraps w to measure its time to first byte, if MeasureTTFB is set
+*/
+func (c *Cache) measure(w http.ResponseWriter) (http.ResponseWriter, *ttfbWriter) {
+	if !c.MeasureTTFB {
+		return w, nil
+	}
+	tw := &ttfbWriter{ResponseWriter: w, start: time.Now()}
+	return tw, tw
+}
+
+/*
+	record the time to first byte of a measured request, tw may be nil
+*/
+func (c *Cache) record(tw *ttfbWriter, outcome Outcome) {
+	if tw == nil || tw.first.IsZero() {
+		return
+	}
+	c.ttfb[outcome].observe(tw.first.Sub(tw.start))
+}
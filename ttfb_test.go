@@ -0,0 +1,64 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTTFB(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.MeasureTTFB = true
+	h := c.Chain(slow(20 * time.Millisecond))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(h, "/x")
+		}()
+		// the second one collapses onto the fill of the first
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	for i := 0; i < 3; i++ {
+		get(h, "/x")
+	}
+
+	ttfb := c.Stats().TTFB
+	miss, collapsed, hit := ttfb[OutcomeMiss], ttfb[OutcomeCollapsed], ttfb[OutcomeHit]
+	if miss.Count != 1 || collapsed.Count != 1 || hit.Count != 3 {
+		t.Fatalf("measured %d misses, %d collapsed, %d hits", miss.Count, collapsed.Count, hit.Count)
+	}
+	if miss.Sum < 20*time.Millisecond || hit.Sum/3 >= collapsed.Sum || collapsed.Sum >= miss.Sum {
+		t.Fatalf("first bytes after %v for the miss, %v collapsed, %v per hit", miss.Sum, collapsed.Sum, hit.Sum/3)
+	}
+	if n := len(miss.Counts); n != len(TTFBBuckets) || miss.Counts[n-1] != 1 {
+		t.Fatalf("miss buckets %v", miss.Counts)
+	}
+}
+
+func TestTTFBOffDoesntAllocate(t *testing.T) {
+	hits := func(measure bool) float64 {
+		c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+		c.MeasureTTFB = measure
+		h := c.Chain(&counting{body: "body"})
+		get(h, "/x")
+		r := httptest.NewRequest("GET", "/x", nil)
+		w := httptest.NewRecorder()
+		return testing.AllocsPerRun(100, func() {
+			w.Body.Reset()
+			w.HeaderMap = http.Header{}
+			h.ServeHTTP(w, r)
+		})
+	}
+	if off, on := hits(false), hits(true); off > on {
+		t.Fatalf("a hit allocates %v times without MeasureTTFB, %v times with it", off, on)
+	}
+	if ttfb := NewCache(&Keymaker{}, nil, time.Hour, time.Hour).Stats().TTFB; ttfb != nil {
+		t.Fatal("histograms without MeasureTTFB")
+	}
+}
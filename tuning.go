@@ -0,0 +1,157 @@
+package burstcache
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	TTD should outlast a regeneration (see the tips on Cache). When it doesn't,
+	stale caches are killed before their refresh arrives and requests stampede anyway.
+	The tuner keeps track of recent regeneration durations so a misconfigured TTD
+	can be detected, and with StrictTuning, corrected at runtime.
+
+	Endpoints differ though: a slow report and a quick lookup averaged together
+	fit neither. With a Grouper, durations are also kept per group (e.g. per route),
+	and the TTD of a key follows the profile of its group once that has enough
+	samples. A new key in a known slow group so starts out with a fitting TTD.
+	Groups are never forgotten, so a Grouper must return a bounded set of names.
+*/
+
+const (
+	tuneSamples    = 128         // regeneration durations kept
+	tuneMinSamples = 20          // durations needed before drawing conclusions
+	tuneWarnEvery  = time.Minute // at most one warning per interval
+)
+
+type tuner struct {
+	mu      sync.Mutex
+	samples [tuneSamples]time.Duration // ring buffer of regeneration durations
+	n       int                        // number of durations recorded in total
+	warned  time.Time                  // when the last warning was logged
+}
+
+/*
+	record a regeneration duration
+*/
+func (t *tuner) record(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.n%tuneSamples] = d
+	t.n++
+}
+
+/*
+	p95 returns the 95th percentile of the recent regeneration durations,
+	ok is false while too few have been recorded
+*/
+func (t *tuner) p95() (p95 time.Duration, ok bool) {
+	t.mu.Lock()
+	n := t.n
+	if n > tuneSamples {
+		n = tuneSamples
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, t.samples[:n])
+	t.mu.Unlock()
+
+	if n < tuneMinSamples {
+		return 0, false
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[n*95/100], true
+}
+
+/*
+	warn returns true when a warning may be logged now
+*/
+func (t *tuner) warn(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.warned) < tuneWarnEvery {
+		return false
+	}
+	t.warned = now
+	return true
+}
+
+/*
+	Record how long a regeneration of key took and warn when TTD doesn't cover it
+*/
+func (c *Cache) tune(key string, d time.Duration) {
+	c.tuner.record(d)
+	if c.Grouper != nil {
+		c.mu.Lock()
+		group := c.Grouper(key)
+		t := c.groups[group]
+		if t == nil {
+			if c.groups == nil {
+				c.groups = make(map[string]*tuner)
+			}
+			t = new(tuner)
+			c.groups[group] = t
+		}
+		c.mu.Unlock()
+		t.record(d)
+	}
+	p95, ok := c.tuner.p95()
+	ttd, margin := c.settings().TTD, c.tuningMargin(p95)
+	if !ok || p95 <= ttd || !c.tuner.warn(time.Now()) {
+		return
+	}
+	log.Printf("burstcache: p95 regeneration takes %v but TTD is %v, stale caches die before they are refreshed; consider a TTD of at least %v",
+		p95, ttd, p95+margin)
+}
+
+/*
+	profile returns the p95 regeneration duration for key: that of its group
+	when known, otherwise that of all keys. The caller must hold the cache lock.
+*/
+func (c *Cache) profile(key string) (time.Duration, bool) {
+	if c.Grouper != nil && key != "" {
+		if t := c.groups[c.Grouper(key)]; t != nil {
+			if p95, ok := t.p95(); ok {
+				return p95, true
+			}
+		}
+	}
+	return c.tuner.p95()
+}
+
+/*
+	ttd returns the effective time to die for key. Normally this is TTD, but with StrictTuning
+	it is extended to the p95 regeneration duration plus a margin whenever that is longer.
+	The caller must hold the cache lock.
+*/
+func (c *Cache) ttd(key string) time.Duration {
+	if cfg := c.settings(); !cfg.StrictTuning {
+		return cfg.TTD
+	}
+	return c.extend(c.profile(key))
+}
+
+/*
+	extend TTD to cover the p95 regeneration duration, if known
+*/
+func (c *Cache) extend(p95 time.Duration, ok bool) time.Duration {
+	ttd := c.settings().TTD
+	if !ok {
+		return ttd
+	}
+	if extended := p95 + c.tuningMargin(p95); extended > ttd {
+		return extended
+	}
+	return ttd
+}
+
+/*
+	Margin on top of the p95 regeneration duration, defaults to a quarter of it
+*/
+func (c *Cache) tuningMargin(p95 time.Duration) time.Duration {
+	if margin := c.settings().TuningMargin; margin > 0 {
+		return margin
+	}
+	return p95 / 4
+}
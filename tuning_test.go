@@ -0,0 +1,100 @@
+package burstcache
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	captureLog collects what the package logs for the duration of a test
+*/
+func captureLog(t *testing.T) *bytes.Buffer {
+	buf, out := new(bytes.Buffer), log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return buf
+}
+
+/*
+	fills fills n keys under prefix through h
+*/
+func fills(h http.Handler, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		get(h, fmt.Sprint(prefix, i))
+	}
+}
+
+/*
+	slow is a handler taking d to answer
+*/
+func slow(d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(d)
+		w.Write([]byte("slow"))
+	})
+}
+
+func TestTTDShorterThanRegenerationWarns(t *testing.T) {
+	logged := captureLog(t)
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Millisecond)
+	fills(c.Chain(slow(5*time.Millisecond)), "/", tuneMinSamples)
+
+	if !strings.Contains(logged.String(), "but TTD is 1ms") {
+		t.Fatalf("no warning about a TTD shorter than the regenerations, logged %q", logged.String())
+	}
+	if ttd := c.Config().EffectiveTTD; ttd != time.Millisecond {
+		t.Fatalf("TTD %v applied without StrictTuning, want it as configured", ttd)
+	}
+	// at most once per tuneWarnEvery
+	logged.Reset()
+	fills(c.Chain(slow(5*time.Millisecond)), "/more/", 3)
+	if logged.Len() != 0 {
+		t.Fatalf("warned again right away: %q", logged.String())
+	}
+}
+
+func TestStrictTuningExtendsTTD(t *testing.T) {
+	captureLog(t)
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Millisecond)
+	c.StrictTuning = true
+	c.TuningMargin = 10 * time.Millisecond
+	h := c.Chain(slow(5 * time.Millisecond))
+
+	fills(h, "/", tuneMinSamples-1)
+	if ttd := c.Config().EffectiveTTD; ttd != time.Millisecond {
+		t.Fatalf("TTD extended to %v on %d samples, want it to wait for %d", ttd, tuneMinSamples-1, tuneMinSamples)
+	}
+	fills(h, "/last/", 1)
+	if ttd := c.Config().EffectiveTTD; ttd < 15*time.Millisecond || ttd > 100*time.Millisecond {
+		t.Fatalf("TTD extended to %v, want the p95 of about 5ms plus the 10ms margin", ttd)
+	}
+}
+
+func TestGroupTTD(t *testing.T) {
+	captureLog(t)
+	c := NewCache(&Keymaker{}, nil, time.Second, time.Millisecond)
+	c.StrictTuning = true
+	c.Grouper = func(key string) string {
+		return strings.SplitN(key, "/", 3)[1]
+	}
+	fills(c.Chain(slow(20*time.Millisecond)), "/slow/", tuneMinSamples)
+	fills(c.Chain(&counting{body: "fast"}), "/fast/", tuneMinSamples)
+
+	c.mu.RLock()
+	sibling, fast := c.ttd("/slow/never-filled"), c.ttd("/fast/never-filled")
+	c.mu.RUnlock()
+	if sibling < 20*time.Millisecond {
+		t.Fatalf("TTD %v for a new key of the slow group, want it to start from the group's 20ms", sibling)
+	}
+	if fast >= 20*time.Millisecond {
+		t.Fatalf("TTD %v for a new key of the fast group, the slow group shouldn't affect it", fast)
+	}
+	if groups := c.Config().GroupTTD; groups["slow"] != sibling || groups["fast"] != fast {
+		t.Fatalf("Config shows group TTDs %v, applied are %v and %v", groups, sibling, fast)
+	}
+}
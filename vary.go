@@ -0,0 +1,153 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/*
+	Responses can declare the request headers they depend on, in the response
+	headers named by VaryHeaders (e.g. the standard Vary, or an X-Cache-Vary that
+	the upstream sets for the cache only):
+
+		X-Cache-Vary: X-Region
+
+	Once a response for a key declares that, the key is remembered to vary on
+	X-Region, and its responses are kept per value of X-Region from then on, each
+	under its own variant key. Requests collapsed on the very first fill of a key
+	only learn about the dimensions when it lands; those whose values differ from
+	the filling request are passed through.
+*/
+
+/*
+	varyMarker separates a key from its variant part
+*/
+const varyMarker = "|vary="
+
+/*
+	vary returns the variant key of a request, key itself if no response
+	for key declared dimensions (yet)
+*/
+func (c *Cache) vary(key string, r *http.Request) string {
+	if len(c.VaryHeaders) == 0 {
+		return key
+	}
+	c.mu.RLock()
+	names := c.dims[key]
+	c.mu.RUnlock()
+	if len(names) == 0 {
+		return key
+	}
+	return key + variant(names, r)
+}
+
+/*
+	variant returns the variant part of a key for the values of the named request headers
+*/
+func variant(names []string, r *http.Request) string {
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = url.QueryEscape(name) + "=" + url.QueryEscape(strings.Join(r.Header.Values(name), ","))
+	}
+	return varyMarker + strings.Join(parts, "&")
+}
+
+/*
+	dimensions picks up the dimensions a response filled for key declares, unless
+	key is a variant already. They are applied when the response is kept, see declare.
+*/
+func (c *Cache) dimensions(key string, cache *ResponseCacher, r *http.Request) {
+	if len(c.VaryHeaders) == 0 || strings.Contains(key, varyMarker) {
+		return
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, header := range c.VaryHeaders {
+		for _, val := range cache.Head.Values(header) {
+			for _, field := range strings.Split(val, ",") {
+				name := http.CanonicalHeaderKey(strings.TrimSpace(field))
+				if name == "" || name == "*" || seen[name] {
+					// Vary: * isn't cached at all, see varyAll
+					continue
+				}
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	cache.dims = names
+	cache.variant = variant(names, r)
+}
+
+/*
+	declare remembers the dimensions of key declared by cache, and returns the variant
+	key cache is to be kept under
+*/
+func (c *Cache) declare(key string, cache *ResponseCacher) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dims == nil {
+		c.dims = map[string][]string{}
+	}
+	c.dims[key] = cache.dims
+	return key + cache.variant
+}
+
+/*
+	variants forgets the dimensions of key and returns the variant keys cached for it
+*/
+func (c *Cache) variants(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.dims[key]; !ok {
+		return nil
+	}
+	delete(c.dims, key)
+	var keys []string
+	for k := range c.caches {
+		if strings.HasPrefix(k, key+varyMarker) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+/*
+	countVariant adds n to the variants cached for the key variant is of, if
+	it is one. The caller must hold the lock.
+*/
+func (c *Cache) countVariant(variant string, n int) {
+	i := strings.Index(variant, varyMarker)
+	if i < 0 {
+		return
+	}
+	if c.varied == nil {
+		c.varied = map[string]int{}
+	}
+	base := variant[:i]
+	c.varied[base] += n
+	if c.varied[base] <= 0 {
+		delete(c.varied, base)
+	}
+}
+
+/*
+	forgetDimensions forgets the dimensions of the key variant is of once its
+	last variant is gone, so keys that varied once don't pile up. A response
+	filled for the key later declares them anew. The caller must hold the lock.
+*/
+func (c *Cache) forgetDimensions(variant string) {
+	i := strings.Index(variant, varyMarker)
+	if i < 0 {
+		return
+	}
+	if base := variant[:i]; c.varied[base] == 0 {
+		delete(c.dims, base)
+	}
+}
@@ -0,0 +1,125 @@
+package burstcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	regional returns a cache whose handler varies on X-Region, counting its calls
+*/
+func regional(ttl, ttd time.Duration, calls *int32) (*Cache, func(region string) string) {
+	c := NewCache(&Keymaker{}, nil, ttl, ttd)
+	c.VaryHeaders = []string{"X-Cache-Vary"}
+	h := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.Header().Set("X-Cache-Vary", "X-Region")
+		w.Write([]byte("region " + r.Header.Get("X-Region")))
+	}))
+	return c, func(region string) string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.Header.Set("X-Region", region)
+		h.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+}
+
+func dimensionsOf(c *Cache, key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dims[key]
+}
+
+func TestVaryHeaders(t *testing.T) {
+	var calls int32
+	c, get := regional(time.Hour, time.Hour, &calls)
+	for i := 0; i < 3; i++ {
+		if eu, us := get("eu"), get("us"); eu != "region eu" || us != "region us" {
+			t.Fatalf("served %q and %q", eu, us)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("%d fills, want one per region", n)
+	}
+	if !c.Invalidate("/x") || c.Stats().Entries != 0 {
+		t.Fatalf("%d entries left after invalidating the key", c.Stats().Entries)
+	}
+	if dims := dimensionsOf(c, "/x"); dims != nil {
+		t.Fatalf("dimensions %v kept after invalidating the key", dims)
+	}
+}
+
+func TestDimensionsForgottenWithLastVariant(t *testing.T) {
+	var calls int32
+	c, get := regional(time.Hour, time.Hour, &calls)
+	get("eu")
+	get("us")
+	variant := func(region string) string {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.Header.Set("X-Region", region)
+		key, _ := c.ResolveKey(r)
+		return key
+	}
+	eu, us := variant("eu"), variant("us")
+
+	if !c.Invalidate(eu) {
+		t.Fatalf("%s wasn't cached", eu)
+	}
+	if dims := dimensionsOf(c, "/x"); len(dims) != 1 {
+		t.Fatalf("dimensions %v, want them kept while %s is cached", dims, us)
+	}
+	if !c.Invalidate(us) {
+		t.Fatalf("%s wasn't cached", us)
+	}
+	if dims := dimensionsOf(c, "/x"); dims != nil {
+		t.Fatalf("dimensions %v kept after the last variant went", dims)
+	}
+
+	// learned anew from the next fill
+	if got := get("eu"); got != "region eu" || dimensionsOf(c, "/x") == nil {
+		t.Fatalf("served %q, dimensions %v", got, dimensionsOf(c, "/x"))
+	}
+}
+
+func TestDimensionsForgottenWhenVariantsDie(t *testing.T) {
+	var calls int32
+	c, get := regional(5*time.Millisecond, 5*time.Millisecond, &calls)
+	get("eu")
+	get("us")
+	time.Sleep(50 * time.Millisecond)
+	if n := c.Stats().Entries; n != 0 {
+		t.Fatalf("%d entries alive past TTL+TTD", n)
+	}
+	if dims := dimensionsOf(c, "/x"); dims != nil {
+		t.Fatalf("dimensions %v kept after the variants died", dims)
+	}
+}
+
+func TestVaryStarIsUncacheable(t *testing.T) {
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	h := &counting{body: "body"}
+	served := c.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", r.URL.Query().Get("vary"))
+		h.ServeHTTP(w, r)
+	}))
+	for _, vary := range []string{"*", "Accept-Language, *"} {
+		path := "/x?vary=" + url.QueryEscape(vary)
+		for i := 0; i < 2; i++ {
+			if rec := get(served, path); rec.Body.String() != "body" || rec.Header().Get(markerHeader) != "" {
+				t.Fatalf("Vary: %s served %q from the cache %v", vary, rec.Body.String(), rec.Header().Get(markerHeader) != "")
+			}
+		}
+		if _, ok := c.Peek("/x"); ok {
+			t.Fatalf("a response with Vary: %s was stored", vary)
+		}
+	}
+	if h.count() != 4 {
+		t.Fatalf("%d upstream calls, want every request passed through", h.count())
+	}
+}
@@ -0,0 +1,152 @@
+package burstcache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+	Warm fills the cache with the responses of a manifest, e.g. at deploy time
+	before an instance takes traffic. When a fleet of instances warms the same
+	manifest against a shared tier, WarmStrategy picks which of them warm which
+	entries, and with a shared tier that is a Locker every entry is locked while
+	it is generated: the instance that gets the lock runs the handler and shares
+	the response before letting go, the others skip the entry (it is in the
+	shared tier by the time they are asked for it) or find it there.
+*/
+
+/*
+	WarmStrategy decides which instances Warm fills which entries, see Warm
+*/
+type WarmStrategy int
+
+const (
+	WarmAll         WarmStrategy = iota // every instance warms the whole manifest, a Locker keeps them from generating an entry twice
+	WarmLeader                          // only the instance Leader reports as the leader warms, the others return right away
+	WarmPartitioned                     // every instance warms the entries a consistent hash of their key assigns it, see WarmPeers
+)
+
+/*
+	warmLockTTL is how long an entry stays locked when the instance generating it
+	dies before it could unlock
+*/
+const warmLockTTL = time.Minute
+
+/*
+	Warm runs a GET of every URL in the manifest through next and caches the
+	responses, skipping those cached already, here or in the shared tier (which
+	are restored from there). Requests are keyed like Chain keys them, which
+	takes a Keymaker (ErrKeyerRequired); those Chain wouldn't cache are skipped.
+	Returns how many entries this instance generated. Fails with ErrClosed once
+	the cache is draining, and with ErrStoreUnavailable when the shared tier
+	couldn't lock an entry, which is then left for the other instances.
+*/
+func (c *Cache) Warm(next http.Handler, manifest []string) (warmed int, err error) {
+	if c.Keymaker == nil {
+		return 0, ErrKeyerRequired
+	}
+	if c.WarmStrategy == WarmLeader && (c.Leader == nil || !c.Leader()) {
+		return 0, nil
+	}
+	for _, url := range manifest {
+		if c.Draining() {
+			return warmed, fmt.Errorf("%w: warming stopped", ErrClosed)
+		}
+		r, failed := http.NewRequest(http.MethodGet, url, nil)
+		if failed != nil {
+			return warmed, fmt.Errorf("burstcache: manifest entry %q: %w", url, failed)
+		}
+		cfg := c.settings()
+		base, ok := c.key(cfg, discard{}, r)
+		if !ok {
+			continue
+		}
+		key := c.vary(base, r)
+		if c.WarmStrategy == WarmPartitioned && !c.owns(key) {
+			continue
+		}
+		generated, failed := c.warmKey(cfg, next, key, r)
+		if generated {
+			warmed++
+		}
+		if failed != nil && err == nil {
+			err = failed
+		}
+	}
+	return warmed, err
+}
+
+/*
+	warmKey fills key from next, unless it is cached here or in the shared tier
+	already, or another instance holds its lock. Reports whether it ran next.
+*/
+func (c *Cache) warmKey(cfg *CacheConfig, next http.Handler, key string, r *http.Request) (bool, error) {
+	if c.restored(key) {
+		return false, nil
+	}
+	if locker, ok := c.Shared.(Locker); ok {
+		generation, ok, err := locker.TryLock(key, warmLockTTL)
+		c.countStore(err)
+		if err != nil {
+			log.Printf("burstcache: shared store lock of %s failed, not warming it: %v", c.redact(key), err)
+			return false, fmt.Errorf("%w: lock of %s: %v", ErrStoreUnavailable, c.redact(key), err)
+		}
+		if !ok {
+			// another instance is generating it
+			return false, nil
+		}
+		defer func() {
+			if err := locker.Unlock(key, generation); err != nil {
+				log.Printf("burstcache: shared store unlock of %s failed, it stays locked for %v: %v", c.redact(key), warmLockTTL, err)
+			}
+		}()
+		// the instance that had the lock before may have just shared it
+		if c.restored(key) {
+			return false, nil
+		}
+	}
+	cache := c.fill(cfg, next, key, r, OriginWarm, nil)
+	cache.share = true
+	c.keep(key, cache)
+	return true, nil
+}
+
+/*
+	restored reports whether key is cached here, restoring it from the shared tier if need be
+*/
+func (c *Cache) restored(key string) bool {
+	if cache, _, _ := c.lookup(key); cache != nil {
+		return true
+	}
+	if cache := c.fetch(key); cache != nil {
+		return c.keep(key, cache)
+	}
+	return false
+}
+
+/*
+	owns reports whether WarmPartitioned assigns key to this instance. Keys go to
+	the peer that hashes highest together with them (rendezvous hashing), so a peer
+	joining or leaving only moves the keys it gains or loses. Without peers, every
+	key is ours.
+*/
+func (c *Cache) owns(key string) bool {
+	if len(c.WarmPeers) == 0 {
+		return true
+	}
+	var owner string
+	var highest uint64
+	for _, peer := range c.WarmPeers {
+		h := fnv.New64a()
+		h.Write([]byte(peer))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if sum := h.Sum64(); owner == "" || sum > highest {
+			owner, highest = peer, sum
+		}
+	}
+	return owner == c.WarmSelf
+}
@@ -0,0 +1,144 @@
+package burstcache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	perPath is a handler counting its calls per path
+*/
+type perPath struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (h *perPath) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if h.calls == nil {
+		h.calls = map[string]int{}
+	}
+	h.calls[r.URL.Path]++
+	h.mu.Unlock()
+	// long enough for the other instance to run into the lock
+	time.Sleep(time.Millisecond)
+	w.Write([]byte("warm " + r.URL.Path))
+}
+
+/*
+	once fails unless every path of the manifest was generated exactly once
+*/
+func (h *perPath) once(t *testing.T, manifest []string) {
+	t.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, path := range manifest {
+		if n := h.calls[path]; n != 1 {
+			t.Errorf("%s generated %d times, want once", path, n)
+		}
+	}
+}
+
+func manifestOf(n int) []string {
+	manifest := make([]string, n)
+	for i := range manifest {
+		manifest[i] = fmt.Sprint("/w/", i)
+	}
+	return manifest
+}
+
+func TestWarmOncePerEntry(t *testing.T) {
+	manifest := manifestOf(50)
+	shared := newFakeStore()
+	handler := &perPath{}
+	instances := make([]*Cache, 2)
+	warmed := make([]int, len(instances))
+	var wg sync.WaitGroup
+	for i := range instances {
+		instances[i] = NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+		instances[i].Shared = shared
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := instances[i].Warm(handler, manifest)
+			if err != nil {
+				t.Errorf("Warm: %v", err)
+			}
+			warmed[i] = n
+		}(i)
+	}
+	wg.Wait()
+	handler.once(t, manifest)
+	if warmed[0]+warmed[1] != len(manifest) {
+		t.Fatalf("warmed %v, want %d in total", warmed, len(manifest))
+	}
+
+	// a late instance finds it all in the shared tier
+	late := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	late.Shared = shared
+	if n, err := late.Warm(handler, manifest); n != 0 || err != nil {
+		t.Fatalf("the late instance warmed %d: %v", n, err)
+	}
+	handler.once(t, manifest)
+	if meta, ok := late.Peek("/w/0"); !ok || meta.Origin != OriginRestore {
+		t.Fatalf("the late instance didn't restore what it skipped: %+v", meta)
+	}
+}
+
+func TestWarmStrategies(t *testing.T) {
+	manifest := manifestOf(50)
+	instance := func(shared Storer) *Cache {
+		c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+		c.Shared = shared
+		return c
+	}
+
+	// partitioned: no lock needed, each key has one owner
+	shared := struct{ Storer }{NewMemoryStore()}
+	handler := &perPath{}
+	total := 0
+	for _, self := range []string{"a", "b"} {
+		c := instance(shared)
+		c.WarmStrategy = WarmPartitioned
+		c.WarmPeers = []string{"a", "b"}
+		c.WarmSelf = self
+		n, err := c.Warm(handler, manifest)
+		if err != nil || n == 0 || n == len(manifest) {
+			t.Fatalf("%s warmed %d of %d: %v, want its share", self, n, len(manifest), err)
+		}
+		total += n
+	}
+	if total != len(manifest) {
+		t.Fatalf("partitioned: warmed %d, want %d", total, len(manifest))
+	}
+	handler.once(t, manifest)
+
+	// leader only
+	handler = &perPath{}
+	for _, leader := range []bool{false, true} {
+		leader := leader
+		c := instance(NewMemoryStore())
+		c.WarmStrategy = WarmLeader
+		c.Leader = func() bool { return leader }
+		n, _ := c.Warm(handler, manifest)
+		if want := map[bool]int{false: 0, true: len(manifest)}[leader]; n != want {
+			t.Fatalf("leader %v warmed %d, want %d", leader, n, want)
+		}
+	}
+	handler.once(t, manifest)
+}
+
+func TestWarmErrors(t *testing.T) {
+	if _, err := NewCache(nil, nil, time.Hour, time.Hour).Warm(&perPath{}, manifestOf(1)); !errors.Is(err, ErrKeyerRequired) {
+		t.Fatalf("Warm without a Keymaker: %v", err)
+	}
+	c := NewCache(&Keymaker{}, nil, time.Hour, time.Hour)
+	c.Drain()
+	if _, err := c.Warm(&perPath{}, manifestOf(1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Warm once draining: %v", err)
+	}
+}